@@ -0,0 +1,34 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/eycorsican/go-tun2socks/common/log"
+)
+
+// ServeAPI serves the state of the app as JSON on addr.
+//
+//	GET /sessions  当前的会话表
+func ServeAPI(addr string, app *App) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/sessions", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, app.Sessions())
+	})
+
+	go func() {
+		log.Infof("api listening on %v", addr)
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Errorf("api server failed: %v", err)
+		}
+	}()
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
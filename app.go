@@ -1,174 +1,222 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"github.com/eycorsican/go-tun2socks/common/log"
 	"github.com/google/gopacket/layers"
-	"github.com/pmezard/adblock/adblock"
 	"io"
-	"sync"
+	"os"
+	"strings"
+	"sync/atomic"
 	"time"
 
-	"github.com/MissGod1/PProxy/common"
+	"github.com/MissGod1/PProxy/common/dns"
+	"github.com/MissGod1/PProxy/common/packet"
+	"github.com/MissGod1/PProxy/device"
 	"github.com/google/gopacket"
-	"github.com/imgk/shadow/device/windivert"
-	shadow "github.com/imgk/shadow/utils"
 )
 
 type App struct {
-	pids      map[uint32]bool  	// pid列表
-	sessions  *sync.Map   		// session列表
-	processes map[string]bool	// 进程列表
-	whitelist map[string]bool	// 域名列表
-	domainMatcher *adblock.RuleMatcher
-
-	hSocket  *windivert.Handle
-	hNetwork *windivert.Handle
+	pids      *PidCache      	// pid列表
+	sessions  *SessionTable		// session列表
+	domainIPs *DomainIPTable	// DNS解析出的IP对应的域名
+	rules     atomic.Value		// *RuleSet, 规则列表
+	outbounds *Outbounds		// 代理服务器列表
+	self      []uint32			// 自己和插件的pid
+
+	device device.Device
+	routed bool // 设备只收到路由进来的流量, 除了拒绝的全部代理
 	*io.PipeReader
 	*io.PipeWriter
-	*windivert.Address
 
 	event chan struct{}
+	done  chan struct{}
 }
 
-const (
-	Filter1 = "outbound and !loopback and !ipv6 and (tcp or udp) and event == CONNECT and remoteAddr != %v"
-	Filter2 = "ifIdx == %d and outbound and !loopback and !ipv6 and (tcp or udp) and remoteAddr != %v"
-)
-
-func SetParam(hd *windivert.Handle) error {
-	if er := hd.SetParam(windivert.QueueLength, windivert.QueueLengthMax); er != nil {
-		err := fmt.Errorf("set handle parameter queue length error %v", er)
-		return err
-	}
-	if er := hd.SetParam(windivert.QueueTime, windivert.QueueTimeMax); er != nil {
-		err := fmt.Errorf("set handle parameter queue time error %v", er)
-		return err
-	}
-	if er := hd.SetParam(windivert.QueueSize, windivert.QueueSizeMax); er != nil {
-		err := fmt.Errorf("set handle parameter queue size error %v", er)
-		return err
-	}
-	return nil
-}
-
-func NewApp(_server *Server, _process *Process) (*App, error) {
-	iface, subiface, err := common.GetInterfaceIndex(_server.Server)
-	h1, err := windivert.Open(fmt.Sprintf(Filter1, _server.Server), windivert.LayerSocket, 100, windivert.FlagSniff | windivert.FlagRecvOnly)
-	if err != nil {
-		err = fmt.Errorf("Open Socket Handle Failed.")
-		return nil, err
-	}
-	h2, err := windivert.Open(fmt.Sprintf(Filter2, iface, _server.Server), windivert.LayerNetwork, 101, 0)
-	if err != nil {
-		err = fmt.Errorf("Open Network Handle Falied.")
-		return nil, err
+func NewApp(dev device.Device, _process *Process, outbounds *Outbounds) (*App, error) {
+	_, routed := dev.(device.Router)
+	if routed {
+		if err := checkRouted(_process); err != nil {
+			return nil, err
+		}
 	}
-	err = SetParam(h1)
+	self := append([]uint32{uint32(os.Getpid())}, outbounds.PIDs()...)
+	rules, err := NewRuleSet(_process, self...)
 	if err != nil {
 		return nil, err
 	}
-	err = SetParam(h2)
-	if err != nil {
+	if err := checkOutbounds(rules, outbounds); err != nil {
 		return nil, err
 	}
 
-	processes := make(map[string]bool)
-	for _,v := range _process.Processes {
-		processes[v] = true
-	}
-
-	whitelist := make(map[string]bool)
-	for _,v := range _process.Whitelist {
-		whitelist[v] = true
-	}
-
-	matcher := adblock.NewMatcher()
-	for _, r := range _process.Whitelist {
-		rule, err := adblock.ParseRule(r)
-		if err != nil {
-			continue
-		}
-		matcher.AddRule(rule, 0)
+	// 回放时进程来自socket事件
+	var lookup ProcessLookup = systemLookup{}
+	if l, ok := dev.(ProcessLookup); ok {
+		lookup = l
 	}
 
 	r, w := io.Pipe()
 	app := &App{
-		pids: make(map[uint32]bool),
-		sessions: &sync.Map{},
-		processes: processes,
-		whitelist: whitelist,
-		hSocket:   h1,
-		hNetwork:  h2,
-		Address: new(windivert.Address),
+		pids: NewPidCache(lookup, _process.Children),
+		domainIPs: NewDomainIPTable(),
+		sessions: NewSessionTable(time.Duration(_process.UDPTimeout)*time.Second, time.Duration(_process.TCPTimeout)*time.Second),
+		outbounds: outbounds,
+		self: self,
+		device: dev,
 		PipeWriter: w,
 		PipeReader: r,
 		event: make(chan struct{}, 1),
-		domainMatcher: matcher,
+		done: make(chan struct{}),
+	}
+	app.rules.Store(rules)
+	outbounds.route = app.sessions.Outbound
+	app.routed = routed
+	if monitor, ok := dev.(device.Monitor); ok {
+		go app.filtersession(monitor)
 	}
-	app.Address.Network().InterfaceIndex = iface
-	app.Address.Network().SubInterfaceIndex = subiface
-	go app.filtersession()
 	go app.writeloop()
+	go app.expireloop()
+	go app.pids.sweeploop(30*time.Second, app.done)
 
 	return app, nil
 }
 
-func ConvertToSession(address windivert.Address) string {
-	localAddr := address.Socket().LocalAddress
-	remoteAddr := address.Socket().RemoteAddress
-	localPort := address.Socket().LocalPort
-	remotePort := address.Socket().RemotePort
-	protocol := address.Socket().Protocol
+// checkRouted refuses the config a Router backend can not follow. It only
+// gets the routed traffic with no process, and has no other network to
+// send a direct flow to, so such rules would silently proxy.
+func checkRouted(p *Process) error {
+	if strings.ToLower(p.Mode) == ModeExclude {
+		return errors.New("mode exclude is not supported on a tun device, the processes of the flows are not known")
+	}
+	if len(p.Processes) > 0 {
+		return errors.New("processes are not supported on a tun device, the processes of the flows are not known")
+	}
+	for i, r := range p.Rules {
+		if len(r.Processes) > 0 {
+			return fmt.Errorf("rule %v error: processes are not supported on a tun device", i+1)
+		}
+		if r.Action == ActionDirect {
+			return fmt.Errorf("rule %v error: direct is not supported on a tun device, leave the addresses out of tun routes instead", i+1)
+		}
+	}
+	return nil
+}
+
+// checkOutbounds makes sure the outbounds named by the rules exist.
+func checkOutbounds(rules *RuleSet, outbounds *Outbounds) error {
+	for _, name := range rules.Outbounds() {
+		if !outbounds.Has(name) {
+			return fmt.Errorf("unknown outbound %v", name)
+		}
+	}
+	return nil
+}
+
+// Rules returns the rules in use.
+func (a *App) Rules() *RuleSet {
+	return a.rules.Load().(*RuleSet)
+}
 
-	lip := fmt.Sprintf("%v.%v.%v.%v", localAddr[3], localAddr[2], localAddr[1], localAddr[0])
-	rip := fmt.Sprintf("%v.%v.%v.%v", remoteAddr[3], remoteAddr[2], remoteAddr[1], remoteAddr[0])
-	return fmt.Sprintf("%v:%v=>%v:%v#%v", lip, localPort, rip, remotePort, protocol)
+func ConvertToSession(s *device.Socket) packet.Key {
+	return packet.NewKey(s.Protocol, s.LocalIP, s.LocalPort, s.RemoteIP, s.RemotePort)
 }
 
-func (a *App) filtersession()  {
-	address := make([]windivert.Address, windivert.BatchMax)
-	buffer := make([]byte, 1500*windivert.BatchMax)
+func (a *App) filtersession(monitor device.Monitor)  {
+	sockets := make([]device.Socket, device.BatchMax)
 	for {
-		_, nx, err := a.hSocket.RecvEx(buffer, address, nil)
+		nx, err := monitor.ReadSockets(sockets)
 		if err != nil {
 			return
 		}
 		if nx < 1	{
 			continue
 		}
-		for i := uint(0); i < nx; i++ {
-			if v, ok := a.pids[address[i].Socket().ProcessID]; ok {
-				if v {
-					// TODO: 列表中
-					session := ConvertToSession(address[i])
-					log.Debugf("Socket Layer: %v", session)
-					a.sessions.LoadOrStore(session, true)
-				}
-			} else if pName, _ := shadow.QueryName(address[i].Socket().ProcessID); pName != "" {
-				log.Debugf("Program: %v", pName)
-				if _, ok := a.processes[pName]; ok {
-					a.pids[address[i].Socket().ProcessID]= true
-					session := ConvertToSession(address[i])
-					log.Debugf("Socket Layer: %v", session)
-					a.sessions.LoadOrStore(session, true)
-					// TODO: 处理session
-				} else {
-					a.pids[address[i].Socket().ProcessID] = false
-				}
+		for i := 0; i < nx; i++ {
+			if sockets[i].Event == device.SocketClose {
+				a.closesession(&sockets[i])
+				continue
+			}
+			if sockets[i].Protocol == packet.ProtocolUDP {
+				a.sessions.Bind(sockets[i].LocalPort, sockets[i].ProcessID)
+			}
+			flow := Flow{
+				Key:  ConvertToSession(&sockets[i]),
+				Proc: a.pids.Lookup(sockets[i].ProcessID),
+			}
+			flow.Domain, _ = a.domainIPs.Lookup(flow.DstIP)
+			if action, outbound := a.Rules().Match(&flow); action != ActionNone {
+				log.Debugf("Socket Layer: %v %v %v", flow.Key, action, outbound)
+				a.sessions.Add(flow.Key, sockets[i].Protocol, sockets[i].ProcessID, action, outbound)
 			}
 		}
 	}
 }
 
-func (a *App) WriteTo(w io.Writer) (n int64, err error) {
-	buffer := make([]byte, 1500*windivert.BatchMax)
-	address := make([]windivert.Address, windivert.BatchMax)
+// closesession drops the session of a closed socket. A closed TCP socket
+// counts as the local FIN, the session is kept until the remote side
+// finished too.
+func (a *App) closesession(s *device.Socket) {
+	session := ConvertToSession(s)
+	if s.Protocol == packet.ProtocolTCP {
+		a.sessions.FIN(session, false)
+	} else {
+		a.sessions.Remove(session)
+		a.sessions.Unbind(s.LocalPort)
+	}
+	log.Debugf("Socket Closed: %v", session)
+}
 
-	const f = uint8(0x01<<7) | uint8(0x01<<6) | uint8(0x01<<5) | uint8(0x01<<3)
+func (a *App) expireloop() {
+	t := time.NewTicker(5 * time.Second)
+	defer t.Stop()
 
 	for {
-		nr, nx, err := a.hNetwork.RecvEx(buffer, address, nil)
+		select {
+		case now := <-t.C:
+			if n := a.sessions.Expire(now); n > 0 {
+				log.Debugf("%v sessions expired, %v left", n, a.sessions.Len())
+			}
+			if n := a.domainIPs.Expire(now); n > 0 {
+				log.Debugf("%v domain addresses expired, %v left", n, a.domainIPs.Len())
+			}
+		case <-a.done:
+			return
+		}
+	}
+}
+
+// Reload replaces the rules. Flows opened from now on are matched against
+// the new rules, existing sessions are kept.
+func (a *App) Reload(_process *Process) error {
+	if a.routed {
+		if err := checkRouted(_process); err != nil {
+			return err
+		}
+	}
+	rules, err := NewRuleSet(_process, a.self...)
+	if err != nil {
+		return err
+	}
+	if err := checkOutbounds(rules, a.outbounds); err != nil {
+		return err
+	}
+	a.rules.Store(rules)
+	a.pids.Reload(_process.Children)
+	return nil
+}
+
+// Sessions returns the current session table.
+func (a *App) Sessions() []Session {
+	return a.sessions.Snapshot()
+}
+
+func (a *App) WriteTo(w io.Writer) (n int64, err error) {
+	buffer := make([]byte, 1500*device.BatchMax)
+	diverted := make([]bool, device.BatchMax)
+
+	for {
+		nr, nx, err := a.device.ReadPackets(buffer)
 		if err != nil {
 			return 0, err
 		}
@@ -178,33 +226,38 @@ func (a *App) WriteTo(w io.Writer) (n int64, err error) {
 		// TODO: 处理捕获的数据包
 		n += int64(nr)
 		bb := buffer[:nr]
-		for i := uint(0); i < nx; i++ {
-			l := int(bb[2])<<8 | int(bb[3])
+		for i := 0; i < nx; i++ {
+			l := device.PacketLen(bb)
 
-			if a.CheckSession(bb[:l]) {
+			action := a.CheckSession(bb[:l])
+			if a.routed && action != ActionReject {
+				action = ActionProxy
+			}
+			// 拒绝的数据包既不重新注入也不交给协议栈
+			diverted[i] = action == ActionProxy || action == ActionReject
+			if action == ActionProxy {
 				_, err = w.Write(bb[:l])
 				if err != nil {
 					return 0, err
 				}
-
-				address[i].Flags |= f
-
-				bb[8] = 0 // TTL = 0
 			}
 
 			bb = bb[l:]
 		}
 
-		a.hNetwork.Lock()
-		_, err = a.hNetwork.SendEx(buffer[:nr], address[:nx], nil)
-		a.hNetwork.Unlock()
-		if err != nil && err != windivert.ErrHostUnreachable {
+		err = a.device.Reinject(buffer[:nr], diverted[:nx])
+		if err != nil {
 			return 0, err
 		}
 	}
 }
 
 func (a *App) Write(data []byte) (n int, err error) {
+	var p packet.Packet
+	if packet.Parse(data, &p) {
+		a.checkReply(&p)
+		a.learnDns(&p)
+	}
 	a.event <- struct{}{}
 	n, err = a.PipeWriter.Write(data)
 	return
@@ -214,24 +267,14 @@ func (a *App)writeloop()  {
 	t := time.NewTicker(time.Millisecond)
 	defer t.Stop()
 
-	const f = uint8(0x01<<7) | uint8(0x01<<6) | uint8(0x01<<5)
-
-	address := make([]windivert.Address, windivert.BatchMax)
-	buffer := make([]byte, 1500*windivert.BatchMax)
-
-	for i := range address {
-		address[i] = *a.Address
-		address[i].Flags |= f
-	}
+	buffer := make([]byte, 1500*device.BatchMax)
 
 	n, m := 0, 0
 	for {
 		select {
 		case <-t.C:
 			if m > 0 {
-				a.hNetwork.Lock()
-				_, err := a.hNetwork.SendEx(buffer[:n], address[:m], nil)
-				a.hNetwork.Unlock()
+				err := a.device.WritePackets(buffer[:n], m)
 				if err != nil {
 					return
 				}
@@ -247,10 +290,8 @@ func (a *App)writeloop()  {
 			n += nr
 			m++
 
-			if m == windivert.BatchMax {
-				a.hNetwork.Lock()
-				_, err := a.hNetwork.SendEx(buffer[:n], address[:m], nil)
-				a.hNetwork.Unlock()
+			if m == device.BatchMax {
+				err := a.device.WritePackets(buffer[:n], m)
 				if err != nil {
 					return
 				}
@@ -261,69 +302,112 @@ func (a *App)writeloop()  {
 	}
 }
 
-func (a *App) checkDns(domain string) bool {
-	url := fmt.Sprintf("https://%v/", domain)
-	rq := &adblock.Request{
-		URL: url,
+// checkReply keeps the session of a packet written back by the stack
+// alive and tracks the FIN or RST the stack sends for the remote side.
+func (a *App) checkReply(p *packet.Packet) {
+	key := p.Key.Reverse()
+	if _, ok := a.sessions.Lookup(key); !ok {
+		return
 	}
-	found, _, err := a.domainMatcher.Match(rq)
-	if err != nil {
-		return false
+	if p.TCPFlags&packet.FlagRST != 0 {
+		a.sessions.Remove(key)
+	} else if p.TCPFlags&packet.FlagFIN != 0 {
+		a.sessions.FIN(key, true)
 	}
-	return found
 }
 
-func (a *App) CheckSession(buffer []byte) bool {
-	packet := gopacket.NewPacket(buffer, layers.LayerTypeIPv4, gopacket.Default)
-	if ipLayer := packet.Layer(layers.LayerTypeIPv4); ipLayer != nil {
-		ip, _ := ipLayer.(*layers.IPv4)
-		var session string
-		if tcpLayer := packet.Layer(layers.LayerTypeTCP); tcpLayer != nil {
-			tcp, _ := tcpLayer.(*layers.TCP)
-			session = fmt.Sprintf("%v:%v=>%v:%v#%v", ip.SrcIP, uint16(tcp.SrcPort), ip.DstIP, uint16(tcp.DstPort), uint8(ip.Protocol))
-
-		} else if udpLayer := packet.Layer(layers.LayerTypeUDP); udpLayer != nil {
-			udp, _:= udpLayer.(*layers.UDP)
-			session = fmt.Sprintf("%v:%v=>%v:%v#%v", ip.SrcIP, uint16(udp.SrcPort), ip.DstIP, uint16(udp.DstPort), uint8(ip.Protocol))
-		}
-		if session != "" {
-			//fmt.Println("Network Layer : ", session)
-			if _, ok := a.sessions.Load(session); ok {
-				log.Debugf("Network Layer : %v", session)
-				return true
-			} else if dnsLayer := packet.Layer(layers.LayerTypeDNS); dnsLayer != nil {
-				dns, _ := dnsLayer.(*layers.DNS)
-				domain := string(dns.Questions[0].Name)
-				//fmt.Println("Domain : ", domain)
-				//if _, ok := a.whitelist[domain]; ok {
-				if a.checkDns(domain) {
-					log.Debugf("Domain : %v => %v", domain, ip.DstIP)
-					return true
-				}
-			}
+// learnDns remembers the domains of the addresses in the DNS answers
+// written back by the stack, either from the fake DNS or from the upstream
+// resolver.
+func (a *App) learnDns(p *packet.Packet) {
+	if p.Protocol != packet.ProtocolUDP || p.SrcPort != dns.COMMON_DNS_PORT {
+		return
+	}
+
+	msg := &layers.DNS{}
+	if err := msg.DecodeFromBytes(p.Payload, gopacket.NilDecodeFeedback); err != nil {
+		return
+	}
+	if !msg.QR || len(msg.Questions) == 0 {
+		return
+	}
+	domain := string(msg.Questions[0].Name)
+	for _, rr := range msg.Answers {
+		if rr.Type != layers.DNSTypeA && rr.Type != layers.DNSTypeAAAA {
+			continue
 		}
+		a.domainIPs.Add(rr.IP, domain, time.Duration(rr.TTL)*time.Second)
+		log.Debugf("Domain : %v => %v", domain, rr.IP)
 	}
-	return false
 }
 
-func (a *App) Close() error {
-
-	if err := a.hSocket.Shutdown(windivert.ShutdownBoth); err != nil {
-		return fmt.Errorf("shutdown handle error: %v", err)
+// CheckSession returns the action for the packet. Packets of a session get
+// the action of the session. New flows and DNS queries are matched against
+// the rules without the process, which is only known from the socket
+// events. The 5-tuple is read straight from the headers, the DNS layer is
+// only decoded for unmatched packets to port 53.
+func (a *App) CheckSession(buffer []byte) Action {
+	var p packet.Packet
+	if !packet.Parse(buffer, &p) {
+		return ActionNone
 	}
-
-	if err := a.hSocket.Close(); err != nil {
-		return fmt.Errorf("close handle error: %v", err)
+	if action, ok := a.sessions.Lookup(p.Key); ok {
+		if debug {
+			log.Debugf("Network Layer : %v %v", p.Key, action)
+		}
+		if p.TCPFlags&packet.FlagRST != 0 {
+			a.sessions.Remove(p.Key)
+		} else if p.TCPFlags&packet.FlagFIN != 0 {
+			a.sessions.FIN(p.Key, false)
+		}
+		return action
+	}
+	// 只接管新的连接, 已经直连的TCP连接中途转给协议栈会断开
+	if p.Protocol == packet.ProtocolUDP || p.TCPFlags&(packet.FlagSYN|packet.FlagACK) == packet.FlagSYN {
+		flow := Flow{Key: p.Key}
+		flow.Domain, _ = a.domainIPs.Lookup(p.DstIP)
+		// UDP会话过期后socket仍然打开, 按本地端口找回进程
+		var pid uint32
+		if p.Protocol == packet.ProtocolUDP {
+			if owner, ok := a.sessions.Owner(p.SrcPort); ok {
+				pid = owner
+				flow.Proc = a.pids.Lookup(pid)
+			}
+		}
+		if action, outbound := a.Rules().Match(&flow); action != ActionNone {
+			log.Debugf("Network Layer : %v %v %v %v", p.Key, flow.Domain, action, outbound)
+			a.sessions.Add(p.Key, p.Protocol, pid, action, outbound)
+			return action
+		}
+	}
+	if p.Protocol != packet.ProtocolUDP || p.DstPort != dns.COMMON_DNS_PORT {
+		return ActionNone
 	}
 
-	if err := a.hNetwork.Shutdown(windivert.ShutdownBoth); err != nil {
-		return fmt.Errorf("shutdown handle error: %v", err)
+	msg := &layers.DNS{}
+	if err := msg.DecodeFromBytes(p.Payload, gopacket.NilDecodeFeedback); err != nil {
+		return ActionNone
 	}
+	if len(msg.Questions) == 0 {
+		return ActionNone
+	}
+	flow := Flow{
+		Key:    p.Key,
+		Domain: string(msg.Questions[0].Name),
+	}
+	action, _ := a.Rules().Match(&flow)
+	if action != ActionNone {
+		log.Debugf("Domain : %v => %v %v", flow.Domain, p.Dst(), action)
+	}
+	return action
+}
 
-	if err := a.hNetwork.Close(); err != nil {
-		return fmt.Errorf("close handle error: %v", err)
+func (a *App) Close() error {
+	if err := a.device.Close(); err != nil {
+		return err
 	}
 
+	close(a.done)
 	close(a.event)
 	a.PipeWriter.Close()
 	a.PipeReader.Close()
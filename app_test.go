@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/MissGod1/PProxy/common/packet"
+	"github.com/MissGod1/PProxy/device"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// ipPacket builds a TCP SYN or UDP packet over IPv4 or IPv6. ext puts a
+// destination options header in front of the transport header of an IPv6
+// packet.
+func ipPacket(t testing.TB, src string, dst string, tcp, ext bool) []byte {
+	var network gopacket.NetworkLayer
+	var ip gopacket.SerializableLayer
+	proto := layers.IPProtocolUDP
+	if tcp {
+		proto = layers.IPProtocolTCP
+	}
+	if v4 := net.ParseIP(src).To4(); v4 != nil {
+		l := &layers.IPv4{Version: 4, TTL: 64, SrcIP: v4, DstIP: net.ParseIP(dst).To4(), Protocol: proto}
+		network, ip = l, l
+	} else {
+		l := &layers.IPv6{Version: 6, HopLimit: 64, SrcIP: net.ParseIP(src), DstIP: net.ParseIP(dst), NextHeader: proto}
+		network, ip = l, l
+	}
+
+	var transport gopacket.SerializableLayer
+	if tcp {
+		l := &layers.TCP{SrcPort: 50000, DstPort: 443, SYN: true, Window: 65535}
+		l.SetNetworkLayerForChecksum(network)
+		transport = l
+	} else {
+		l := &layers.UDP{SrcPort: 50000, DstPort: 443}
+		l.SetNetworkLayerForChecksum(network)
+		transport = l
+	}
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, ip, transport, gopacket.Payload("payload")); err != nil {
+		t.Fatal(err)
+	}
+	b := buf.Bytes()
+	if !ext || b[0]>>4 != 6 {
+		return b
+	}
+
+	out := make([]byte, 0, len(b)+8)
+	out = append(out, b[:40]...)
+	out = append(out, b[6], 0, 1, 4, 0, 0, 0, 0)
+	out = append(out, b[40:]...)
+	out[6] = 60
+	binary.BigEndian.PutUint16(out[4:6], uint16(len(out)-40))
+	return out
+}
+
+// BenchmarkCheckSession measures packets of a known session and of new
+// flows that no rule matches.
+func BenchmarkCheckSession(b *testing.B) {
+	cases := []struct {
+		name     string
+		src, dst string
+		tcp, ext bool
+	}{
+		{"tcp4", "10.0.0.2", "1.2.3.4", true, false},
+		{"udp4", "10.0.0.2", "1.2.3.4", false, false},
+		{"tcp6", "fd00::2", "2001:db8::1", true, false},
+		{"udp6", "fd00::2", "2001:db8::1", false, false},
+		{"tcp6-extensions", "fd00::2", "2001:db8::1", true, true},
+		{"udp6-extensions", "fd00::2", "2001:db8::1", false, true},
+	}
+	for _, c := range cases {
+		pkt := ipPacket(b, c.src, c.dst, c.tcp, c.ext)
+		var p packet.Packet
+		if !packet.Parse(pkt, &p) {
+			b.Fatalf("%v is not parsed", c.name)
+		}
+
+		b.Run(c.name+"/session", func(b *testing.B) {
+			app := testApp(b, newFakeLookup(), &Process{Processes: []ProcessRule{{Name: "curl"}}})
+			app.sessions.Add(p.Key, p.Protocol, 42, ActionProxy, "")
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if app.CheckSession(pkt) != ActionProxy {
+					b.Fatal("session is not matched")
+				}
+			}
+		})
+		b.Run(c.name+"/new", func(b *testing.B) {
+			app := testApp(b, newFakeLookup(), &Process{Processes: []ProcessRule{{Name: "curl"}}})
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if app.CheckSession(pkt) != ActionNone {
+					b.Fatal("new flow is matched")
+				}
+			}
+		})
+	}
+}
+
+// TUN设备不知道进程, 也不能直连, 这些配置要在启动时拒绝
+func TestCheckRouted(t *testing.T) {
+	cases := []struct {
+		name string
+		p    Process
+		ok   bool
+	}{
+		{"proxy", Process{Rules: []Rule{{CIDR: []string{"1.2.3.0/24"}, Action: ActionProxy}}}, true},
+		{"reject", Process{Rules: []Rule{{Ports: "25", Action: ActionReject}}}, true},
+		{"whitelist", Process{Whitelist: []string{"||example.com^"}}, true},
+		{"direct", Process{Rules: []Rule{{CIDR: []string{"10.0.0.0/8"}, Action: ActionDirect}}}, false},
+		{"process rule", Process{Rules: []Rule{{Processes: []ProcessRule{{Name: "curl"}}, Action: ActionProxy}}}, false},
+		{"processes", Process{Processes: []ProcessRule{{Name: "curl"}}}, false},
+		{"exclude", Process{Mode: "Exclude"}, false},
+	}
+	for _, c := range cases {
+		if err := checkRouted(&c.p); (err == nil) != c.ok {
+			t.Errorf("%v: %v", c.name, err)
+		}
+	}
+}
+
+// fakeDevice is a capture backend fed with crafted packets, one per batch.
+// It reports the sockets and processes of the host too, like the replay.
+type fakeDevice struct {
+	*fakeLookup
+	in      chan []byte
+	sockets chan device.Socket
+	// 每个数据包是否被协议栈接管
+	diverted chan bool
+	// 协议栈写回主机的数据包
+	written chan []byte
+	closed  chan struct{}
+	once    sync.Once
+}
+
+func newFakeDevice(lookup *fakeLookup) *fakeDevice {
+	return &fakeDevice{
+		fakeLookup: lookup,
+		in:         make(chan []byte),
+		sockets:    make(chan device.Socket),
+		diverted:   make(chan bool, 1),
+		written:    make(chan []byte, 1),
+		closed:     make(chan struct{}),
+	}
+}
+
+func (d *fakeDevice) ReadPackets(b []byte) (int, int, error) {
+	select {
+	case p := <-d.in:
+		return copy(b, p), 1, nil
+	case <-d.closed:
+		return 0, 0, io.EOF
+	}
+}
+
+func (d *fakeDevice) Reinject(b []byte, divert []bool) error {
+	d.diverted <- divert[0]
+	return nil
+}
+
+func (d *fakeDevice) WritePackets(b []byte, n int) error {
+	for i := 0; i < n; i++ {
+		l := device.PacketLen(b)
+		d.written <- append([]byte(nil), b[:l]...)
+		b = b[l:]
+	}
+	return nil
+}
+
+func (d *fakeDevice) ReadSockets(s []device.Socket) (int, error) {
+	select {
+	case s[0] = <-d.sockets:
+		return 1, nil
+	case <-d.closed:
+		return 0, io.EOF
+	}
+}
+
+func (d *fakeDevice) Close() error {
+	d.once.Do(func() { close(d.closed) })
+	return nil
+}
+
+// stackWriter is the lwip stack, it records the packets handed to it.
+type stackWriter chan []byte
+
+func (w stackWriter) Write(b []byte) (int, error) {
+	w <- append([]byte(nil), b...)
+	return len(b), nil
+}
+
+// 通过后端接口驱动App: socket事件决定进程, 数据包按会话和规则分流
+func TestAppDevice(t *testing.T) {
+	lookup := newFakeLookup(Proc{PID: 42, Name: "curl", Start: 1})
+	dev := newFakeDevice(lookup)
+	outbounds := &Outbounds{
+		names:  map[string]*Outbound{DefaultOutbound: {Name: DefaultOutbound}},
+		groups: make(map[string]*group),
+	}
+	app, err := NewApp(dev, &Process{
+		Rules:     []Rule{{CIDR: []string{"9.9.9.9"}, Action: ActionReject}},
+		Processes: []ProcessRule{{Name: "curl"}},
+	}, outbounds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app.Close()
+	stack := make(stackWriter, 1)
+	go app.WriteTo(stack)
+
+	// feed hands pkt to App and returns whether the stack got it
+	feed := func(pkt []byte) (diverted, proxied bool) {
+		select {
+		case dev.in <- pkt:
+		case <-time.After(3 * time.Second):
+			t.Fatal("device is not read")
+		}
+		select {
+		case diverted = <-dev.diverted:
+		case <-time.After(3 * time.Second):
+			t.Fatal("batch is not reinjected")
+		}
+		select {
+		case b := <-stack:
+			if !bytes.Equal(b, pkt) {
+				t.Fatal("stack got another packet")
+			}
+			proxied = true
+		default:
+		}
+		return diverted, proxied
+	}
+
+	dev.sockets <- device.Socket{
+		Event:      device.SocketConnect,
+		ProcessID:  42,
+		Protocol:   packet.ProtocolTCP,
+		LocalIP:    net.ParseIP("10.0.0.2"),
+		LocalPort:  50000,
+		RemoteIP:   net.ParseIP("1.2.3.4"),
+		RemotePort: 443,
+	}
+	for i := 0; len(app.Sessions()) == 0; i++ {
+		if i > 300 {
+			t.Fatal("socket of curl has no session")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if diverted, proxied := feed(ipPacket(t, "10.0.0.2", "1.2.3.4", true, false)); !diverted || !proxied {
+		t.Fatalf("curl: diverted %v, proxied %v", diverted, proxied)
+	}
+	if diverted, proxied := feed(ipPacket(t, "10.0.0.2", "5.6.7.8", false, false)); diverted || proxied {
+		t.Fatalf("unknown process: diverted %v, proxied %v", diverted, proxied)
+	}
+	if diverted, proxied := feed(udpPacket(t, "10.0.0.2", 50001, "9.9.9.9", 53)); !diverted || proxied {
+		t.Fatalf("rejected: diverted %v, proxied %v", diverted, proxied)
+	}
+	if n := len(app.Sessions()); n != 2 {
+		t.Fatalf("%v sessions", n)
+	}
+
+	// 协议栈的应答写回设备
+	reply := udpPacket(t, "1.2.3.4", 443, "10.0.0.2", 50000)
+	if _, err := app.Write(reply); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case b := <-dev.written:
+		if !bytes.Equal(b, reply) {
+			t.Fatal("device got another packet")
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("reply is not written to the device")
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+)
+
+type ipRange struct {
+	lo, hi [net.IPv6len]byte
+}
+
+// CIDRSet is a set of address ranges that is searched in logarithmic time,
+// so long lists like a country's allocations stay cheap. Addresses are
+// stored IPv4-mapped like packet.Key.
+type CIDRSet struct {
+	ranges []ipRange
+}
+
+// Add adds a CIDR or a single address. Call Compact after the last Add.
+func (s *CIDRSet) Add(cidr string) error {
+	if !strings.Contains(cidr, "/") {
+		if ip := net.ParseIP(cidr); ip != nil && ip.To4() != nil {
+			cidr += "/32"
+		} else {
+			cidr += "/128"
+		}
+	}
+	_, n, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return err
+	}
+
+	r := ipRange{}
+	ip, mask := n.IP.To16(), n.Mask
+	if len(mask) == net.IPv4len {
+		mask = append(net.CIDRMask(96, 128)[:12], mask...)
+	}
+	for i := range r.lo {
+		r.lo[i] = ip[i] & mask[i]
+		r.hi[i] = ip[i] | ^mask[i]
+	}
+	s.ranges = append(s.ranges, r)
+	return nil
+}
+
+// AddFile adds the CIDRs in a file, one per line. Empty lines and lines
+// starting with '#' are skipped.
+func (s *CIDRSet) AddFile(file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err := s.Add(line); err != nil {
+			return fmt.Errorf("%v:%v: %v", file, n, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// Compact sorts the ranges and merges the overlapping and adjacent ones.
+func (s *CIDRSet) Compact() {
+	sort.Slice(s.ranges, func(i, j int) bool {
+		return bytes.Compare(s.ranges[i].lo[:], s.ranges[j].lo[:]) < 0
+	})
+	merged := s.ranges[:0]
+	for _, r := range s.ranges {
+		if n := len(merged); n > 0 && adjoins(merged[n-1].hi, r.lo) {
+			if bytes.Compare(r.hi[:], merged[n-1].hi[:]) > 0 {
+				merged[n-1].hi = r.hi
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	s.ranges = merged
+}
+
+// adjoins reports whether a range starting at lo overlaps or directly
+// follows a range ending at hi.
+func adjoins(hi, lo [net.IPv6len]byte) bool {
+	if bytes.Compare(lo[:], hi[:]) <= 0 {
+		return true
+	}
+	for i := len(hi) - 1; i >= 0; i-- {
+		hi[i]++
+		if hi[i] != 0 {
+			break
+		}
+	}
+	return lo == hi
+}
+
+// Contains reports whether ip is in the set.
+func (s *CIDRSet) Contains(ip *[net.IPv6len]byte) bool {
+	// 找到第一个lo大于ip的区间, ip只可能在它前一个区间里
+	i, j := 0, len(s.ranges)
+	for i < j {
+		h := int(uint(i+j) >> 1)
+		if bytes.Compare(s.ranges[h].lo[:], ip[:]) > 0 {
+			j = h
+		} else {
+			i = h + 1
+		}
+	}
+	return i > 0 && bytes.Compare(ip[:], s.ranges[i-1].hi[:]) <= 0
+}
+
+// Len returns the number of ranges.
+func (s *CIDRSet) Len() int {
+	return len(s.ranges)
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+)
+
+func ip16(t *testing.T, s string) *[net.IPv6len]byte {
+	ip := net.ParseIP(s)
+	if ip == nil {
+		t.Fatalf("invalid ip %v", s)
+	}
+	var b [net.IPv6len]byte
+	copy(b[:], ip.To16())
+	return &b
+}
+
+func newCIDRSet(t *testing.T, cidrs ...string) *CIDRSet {
+	s := &CIDRSet{}
+	for _, c := range cidrs {
+		if err := s.Add(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.Compact()
+	return s
+}
+
+func TestCIDRSetContains(t *testing.T) {
+	s := newCIDRSet(t,
+		// 重叠和包含
+		"10.0.0.0/16", "10.0.128.0/17", "10.0.255.0/24", "10.0.200.0/21",
+		// 相邻
+		"192.168.0.0/25", "192.168.0.128/25",
+		// 单个地址
+		"1.1.1.1",
+		"2001:db8::/32", "2001:db8:1::/48", "::1",
+	)
+	if s.Len() != 5 {
+		t.Fatalf("%v ranges after compact, want 5", s.Len())
+	}
+	cases := []struct {
+		ip   string
+		want bool
+	}{
+		{"10.0.0.0", true},
+		{"10.0.255.255", true},
+		{"9.255.255.255", false},
+		{"10.1.0.0", false},
+		{"192.168.0.0", true},
+		{"192.168.0.127", true},
+		{"192.168.0.128", true},
+		{"192.168.0.255", true},
+		{"192.168.1.0", false},
+		{"1.1.1.1", true},
+		{"1.1.1.0", false},
+		{"1.1.1.2", false},
+		// IPv4-mapped的IPv6地址就是IPv4地址
+		{"::ffff:10.0.1.2", true},
+		{"::ffff:1.1.1.2", false},
+		{"2001:db8::", true},
+		{"2001:db8:ffff:ffff:ffff:ffff:ffff:ffff", true},
+		{"2001:db9::", false},
+		{"2001:db7:ffff:ffff:ffff:ffff:ffff:ffff", false},
+		{"::1", true},
+		{"::2", false},
+		{"::", false},
+		{"0.0.0.0", false},
+		{"255.255.255.255", false},
+		{"ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff", false},
+	}
+	for _, c := range cases {
+		if got := s.Contains(ip16(t, c.ip)); got != c.want {
+			t.Errorf("Contains(%v) = %v, want %v", c.ip, got, c.want)
+		}
+	}
+}
+
+// IPv4的CIDR不能匹配IPv6地址, 反过来也一样
+func TestCIDRSetFamilies(t *testing.T) {
+	s := newCIDRSet(t, "0.0.0.0/0")
+	if !s.Contains(ip16(t, "255.255.255.255")) || !s.Contains(ip16(t, "0.0.0.0")) {
+		t.Fatal("ipv4 address is not in 0.0.0.0/0")
+	}
+	if s.Contains(ip16(t, "2001:db8::1")) || s.Contains(ip16(t, "::")) {
+		t.Fatal("ipv6 address is in 0.0.0.0/0")
+	}
+
+	s = newCIDRSet(t, "::ffff:0:0/96")
+	if !s.Contains(ip16(t, "8.8.8.8")) {
+		t.Fatal("ipv4 address is not in ::ffff:0:0/96")
+	}
+
+	s = newCIDRSet(t, "2000::/3")
+	if s.Contains(ip16(t, "8.8.8.8")) || !s.Contains(ip16(t, "2001:db8::1")) {
+		t.Fatal("2000::/3 is wrong")
+	}
+}
+
+func TestCIDRSetEmpty(t *testing.T) {
+	s := newCIDRSet(t)
+	if s.Contains(ip16(t, "1.2.3.4")) {
+		t.Fatal("empty set contains an address")
+	}
+}
+
+func TestCIDRSetInvalid(t *testing.T) {
+	for _, c := range []string{"10.0.0.0/33", "example.com", "10.0.0.256", ""} {
+		if err := (&CIDRSet{}).Add(c); err == nil {
+			t.Errorf("%q accepted", c)
+		}
+	}
+}
+
+func TestCIDRSetAddFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "cidr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("# comment\n\n1.2.3.0/24\n  5.6.7.8  \n2001:db8::/32\n")
+	f.Close()
+
+	s := &CIDRSet{}
+	if err := s.AddFile(f.Name()); err != nil {
+		t.Fatal(err)
+	}
+	s.Compact()
+	for _, ip := range []string{"1.2.3.255", "5.6.7.8", "2001:db8::1"} {
+		if !s.Contains(ip16(t, ip)) {
+			t.Errorf("%v is not in the file", ip)
+		}
+	}
+
+	ioutil.WriteFile(f.Name(), []byte("1.2.3.0/24\nbad\n"), 0644)
+	if err := (&CIDRSet{}).AddFile(f.Name()); err == nil {
+		t.Fatal("bad line accepted")
+	}
+}
@@ -1,6 +1,7 @@
 package fakedns
 
 import (
+	"bytes"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -21,6 +22,10 @@ const (
 	FakeResponseTtl uint32 = 1          // in sec
 )
 
+// FakeIPv6Prefix is the /96 prefix of fake IPv6 addresses, the low 32 bits
+// carry the same cursor as the fake IPv4 address of the domain.
+var FakeIPv6Prefix = net.ParseIP("fdfe:dcba:9876::")
+
 type simpleFakeDns struct {
 	sync.Mutex
 
@@ -70,8 +75,15 @@ func uint322ip(n uint32) net.IP {
 	return net.IPv4(byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
 }
 
+func uint322ip6(n uint32) net.IP {
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, FakeIPv6Prefix)
+	binary.BigEndian.PutUint32(ip[net.IPv6len-net.IPv4len:], n)
+	return ip
+}
+
 func ip2uint32(ip net.IP) uint32 {
-	return binary.BigEndian.Uint32([]byte(ip)[net.IPv6len-net.IPv4len:])
+	return binary.BigEndian.Uint32([]byte(ip)[len(ip)-net.IPv4len:])
 }
 
 func NewSimpleFakeDns() cdns.FakeDns {
@@ -99,6 +111,9 @@ func (f *simpleFakeDns) allocateIP(domain string) net.IP {
 }
 
 func (f *simpleFakeDns) QueryDomain(ip net.IP) string {
+	if !f.IsFakeIP(ip) {
+		return ""
+	}
 	f.Lock()
 	defer f.Unlock()
 	if domain, found := f.ip2domain[ip2uint32(ip)]; found {
@@ -141,7 +156,7 @@ func (f *simpleFakeDns) GenerateFakeResponse(request []byte) ([]byte, error) {
 				Ttl:      FakeResponseTtl,
 				Rdlength: net.IPv6len,
 			},
-			AAAA: ip,
+			AAAA: uint322ip6(ip2uint32(ip)),
 		})
 	} else {
 		return nil, fmt.Errorf("unexcepted dns qtype %v", qtype)
@@ -156,6 +171,12 @@ func (f *simpleFakeDns) GenerateFakeResponse(request []byte) ([]byte, error) {
 }
 
 func (f *simpleFakeDns) IsFakeIP(ip net.IP) bool {
+	if len(ip) != net.IPv4len && len(ip) != net.IPv6len {
+		return false
+	}
+	if ip.To4() == nil && !bytes.Equal(ip[:net.IPv6len-net.IPv4len], FakeIPv6Prefix[:net.IPv6len-net.IPv4len]) {
+		return false
+	}
 	c := ip2uint32(ip)
 	if c >= MinFakeIPCursor && c <= MaxFakeIPCursor {
 		return true
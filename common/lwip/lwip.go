@@ -0,0 +1,146 @@
+package lwip
+
+/*
+// 以下布局对应 go-tun2socks v1.16.9 自带的 lwip 2.1:
+// LWIP_IPV4 && LWIP_IPV6, LWIP_IPV6_SCOPES 默认开启 (ip6_addr_t 带 zone),
+// struct udp_pcb 以 IP_PCB 开头, 即 local_ip 位于偏移 0.
+#include <stddef.h>
+
+typedef struct {
+	unsigned int addr[4];
+	unsigned char zone;
+} mirror_ip6_addr;
+
+typedef struct {
+	union {
+		mirror_ip6_addr ip6;
+		unsigned int ip4;
+	} u_addr;
+	unsigned char type;
+} mirror_ip_addr;
+
+#define MIRROR_TYPE_V4  0
+#define MIRROR_TYPE_ANY 46
+
+extern void *udp_pcbs;
+extern const mirror_ip_addr ip_addr_any_type;
+extern signed char udp_bind(void *pcb, const void *ipaddr, unsigned short port);
+
+static int is_zero(const mirror_ip_addr *addr)
+{
+	int i;
+	for (i = 0; i < 4; i++) {
+		if (addr->u_addr.ip6.addr[i] != 0) {
+			return 0;
+		}
+	}
+	return 1;
+}
+
+static int rebind_udp_any_type(void)
+{
+	const mirror_ip_addr *local;
+
+	if (ip_addr_any_type.type != MIRROR_TYPE_ANY || !is_zero(&ip_addr_any_type)) {
+		return 1;
+	}
+	if (udp_pcbs == 0) {
+		return 2;
+	}
+	local = (const mirror_ip_addr *)udp_pcbs;
+	if (local->type != MIRROR_TYPE_V4 || !is_zero(local)) {
+		return 3;
+	}
+	if (udp_bind(udp_pcbs, &ip_addr_any_type, 0) != 0) {
+		return 4;
+	}
+	if (local->type != MIRROR_TYPE_ANY) {
+		return 5;
+	}
+	return 0;
+}
+
+static void mirror_layout(int *out)
+{
+	out[0] = sizeof(mirror_ip_addr);
+	out[1] = offsetof(mirror_ip_addr, type);
+	out[2] = sizeof(mirror_ip6_addr);
+	out[3] = offsetof(mirror_ip6_addr, zone);
+	// local_ip 在 udp_pcb 的开头
+	out[4] = 0;
+	out[5] = MIRROR_TYPE_ANY;
+	out[6] = MIRROR_TYPE_V4;
+}
+*/
+import "C"
+import (
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"unsafe"
+)
+
+// Module 和 Version 是验证过 udp pcb 布局的 go-tun2socks 版本,
+// 升级依赖时需要重新核对 lwip 的 ip_addr_t 和 udp_pcb 定义.
+const (
+	Module  = "github.com/eycorsican/go-tun2socks"
+	Version = "v1.16.9"
+)
+
+var errLayout = [...]string{
+	1: "unexpected ip_addr_any_type layout",
+	2: "no udp pcb, core.NewLWIPStack is not called",
+	3: "unexpected udp pcb layout",
+	4: "udp_bind failed",
+	5: "udp pcb is not rebound",
+}
+
+// EnableIPv6UDP rebinds the udp pcb created by core.NewLWIPStack to the
+// dual stack any address. The stack binds it to the IPv4 any address, so
+// lwip refuses to send UDP replies to IPv6 peers. It has to be called once
+// after core.NewLWIPStack and before any packet is written to the stack.
+//
+// It reads lwip internals directly, so it refuses to run against any
+// go-tun2socks other than Version and checks the layout before and after
+// rebinding.
+func EnableIPv6UDP() error {
+	if err := checkVersion(); err != nil {
+		return err
+	}
+	if code := C.rebind_udp_any_type(); code != 0 {
+		return fmt.Errorf("rebind udp pcb error: %v (%v %v)", errLayout[code], Module, Version)
+	}
+	return nil
+}
+
+// layout returns the sizes, offsets and constants the mirror structs
+// assume, in the order of mirror_layout.
+func layout() [7]int {
+	var out [7]C.int
+	C.mirror_layout((*C.int)(unsafe.Pointer(&out[0])))
+	var l [7]int
+	for i, v := range out {
+		l[i] = int(v)
+	}
+	return l
+}
+
+func checkVersion() error {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return errors.New("no build info, can not verify " + Module)
+	}
+	for _, dep := range info.Deps {
+		if dep.Path != Module {
+			continue
+		}
+		if dep.Replace != nil {
+			dep = dep.Replace
+		}
+		if dep.Version != Version {
+			return fmt.Errorf("%v %v is not verified, want %v", Module, dep.Version, Version)
+		}
+		return nil
+	}
+	return errors.New("can not find " + Module + " in build info")
+}
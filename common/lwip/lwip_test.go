@@ -0,0 +1,94 @@
+package lwip
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/eycorsican/go-tun2socks/core"
+)
+
+func TestEnableIPv6UDP(t *testing.T) {
+	stack := core.NewLWIPStack()
+	defer stack.Close()
+
+	if err := EnableIPv6UDP(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 和lwip头文件中的定义比较, 不依赖go-tun2socks的版本号
+const layoutProgram = `#include <stdio.h>
+#include <stddef.h>
+#include "lwip/udp.h"
+
+int main(void)
+{
+	printf("%d %d %d %d %d %d %d\n",
+		(int)sizeof(ip_addr_t), (int)offsetof(ip_addr_t, type),
+		(int)sizeof(ip6_addr_t), (int)offsetof(ip6_addr_t, zone),
+		(int)offsetof(struct udp_pcb, local_ip),
+		IPADDR_TYPE_ANY, IPADDR_TYPE_V4);
+	return 0;
+}
+`
+
+func TestLayout(t *testing.T) {
+	out, err := exec.Command("go", "list", "-m", "-f", "{{.Dir}}", Module).Output()
+	if err != nil {
+		t.Fatalf("find %v: %v", Module, err)
+	}
+	dir := strings.TrimSpace(string(out))
+
+	tmp, err := ioutil.TempDir("", "lwip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	src := filepath.Join(tmp, "layout.c")
+	bin := filepath.Join(tmp, "layout")
+	if err := ioutil.WriteFile(src, []byte(layoutProgram), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cc := "cc"
+	if out, err := exec.Command("go", "env", "CC").Output(); err == nil && len(strings.TrimSpace(string(out))) > 0 {
+		cc = strings.Fields(string(out))[0]
+	}
+	cmd := exec.Command(cc,
+		"-I", filepath.Join(dir, "core", "c", "include"),
+		"-I", filepath.Join(dir, "core", "c", "custom"),
+		"-o", bin, src)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("compile against lwip headers: %v\n%s", err, out)
+	}
+	out, err = exec.Command(bin).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var want [7]int
+	for i, f := range strings.Fields(string(out)) {
+		if i < len(want) {
+			if want[i], err = strconv.Atoi(f); err != nil {
+				t.Fatalf("bad output %q", out)
+			}
+		}
+	}
+	names := [...]string{
+		"sizeof(ip_addr_t)", "offsetof(ip_addr_t, type)",
+		"sizeof(ip6_addr_t)", "offsetof(ip6_addr_t, zone)",
+		"offsetof(struct udp_pcb, local_ip)",
+		"IPADDR_TYPE_ANY", "IPADDR_TYPE_V4",
+	}
+	got := layout()
+	for i := range got {
+		if got[i] != want[i] {
+			t.Errorf("%v: mirror %v, lwip %v", names[i], got[i], want[i])
+		}
+	}
+}
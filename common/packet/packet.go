@@ -0,0 +1,188 @@
+package packet
+
+import (
+	"encoding/binary"
+	"net"
+	"strconv"
+)
+
+const (
+	ProtocolTCP = 6
+	ProtocolUDP = 17
+)
+
+// TCP flags
+const (
+	FlagFIN = 0x01
+	FlagSYN = 0x02
+	FlagRST = 0x04
+	FlagACK = 0x10
+)
+
+// IPv6 extension headers that are skipped to find the transport header.
+const (
+	ipv6HopByHop    = 0
+	ipv6Routing     = 43
+	ipv6Fragment    = 44
+	ipv6Destination = 60
+)
+
+// Key is the 5-tuple of a connection as seen from the local host. IPv4
+// addresses are stored IPv4-mapped, so keys of both versions compare with ==
+// and can be used as map keys.
+type Key struct {
+	SrcIP    [net.IPv6len]byte
+	DstIP    [net.IPv6len]byte
+	SrcPort  uint16
+	DstPort  uint16
+	Protocol uint8
+}
+
+// Packet is the part of an IP packet needed to classify it.
+type Packet struct {
+	Key
+	TCPFlags uint8
+	// Payload is the transport payload.
+	Payload []byte
+}
+
+var v4InV6Prefix = [12]byte{10: 0xff, 11: 0xff}
+
+// NewKey builds a key from the addresses of a connection.
+func NewKey(protocol uint8, srcIP net.IP, srcPort uint16, dstIP net.IP, dstPort uint16) Key {
+	k := Key{
+		SrcPort:  srcPort,
+		DstPort:  dstPort,
+		Protocol: protocol,
+	}
+	copy(k.SrcIP[:], srcIP.To16())
+	copy(k.DstIP[:], dstIP.To16())
+	return k
+}
+
+// Parse reads the addresses, ports and TCP flags of the IPv4 or IPv6 packet
+// in b into p without allocating. It returns false if b is not a TCP or UDP
+// packet, or is a non-first fragment.
+func Parse(b []byte, p *Packet) bool {
+	if len(b) < 1 {
+		return false
+	}
+
+	var proto uint8
+	var hdr []byte
+	switch b[0] >> 4 {
+	case 4:
+		if len(b) < 20 {
+			return false
+		}
+		ihl := int(b[0]&0x0f) * 4
+		if ihl < 20 || len(b) < ihl {
+			return false
+		}
+		// fragment offset
+		if binary.BigEndian.Uint16(b[6:8])&0x1fff != 0 {
+			return false
+		}
+		proto = b[9]
+		copy(p.SrcIP[:12], v4InV6Prefix[:])
+		copy(p.SrcIP[12:], b[12:16])
+		copy(p.DstIP[:12], v4InV6Prefix[:])
+		copy(p.DstIP[12:], b[16:20])
+		hdr = b[ihl:]
+	case 6:
+		if len(b) < 40 {
+			return false
+		}
+		proto = b[6]
+		copy(p.SrcIP[:], b[8:24])
+		copy(p.DstIP[:], b[24:40])
+		hdr = b[40:]
+		for proto != ProtocolTCP && proto != ProtocolUDP {
+			if len(hdr) < 8 {
+				return false
+			}
+			switch proto {
+			case ipv6HopByHop, ipv6Routing, ipv6Destination:
+				l := (int(hdr[1]) + 1) * 8
+				if len(hdr) < l {
+					return false
+				}
+				proto, hdr = hdr[0], hdr[l:]
+			case ipv6Fragment:
+				if binary.BigEndian.Uint16(hdr[2:4])&0xfff8 != 0 {
+					return false
+				}
+				proto, hdr = hdr[0], hdr[8:]
+			default:
+				return false
+			}
+		}
+	default:
+		return false
+	}
+
+	switch proto {
+	case ProtocolTCP:
+		if len(hdr) < 20 {
+			return false
+		}
+		off := int(hdr[12]>>4) * 4
+		if off < 20 || len(hdr) < off {
+			return false
+		}
+		p.TCPFlags = hdr[13]
+		p.Payload = hdr[off:]
+	case ProtocolUDP:
+		if len(hdr) < 8 {
+			return false
+		}
+		p.TCPFlags = 0
+		p.Payload = hdr[8:]
+	default:
+		return false
+	}
+	p.Protocol = proto
+	p.SrcPort = binary.BigEndian.Uint16(hdr[0:2])
+	p.DstPort = binary.BigEndian.Uint16(hdr[2:4])
+	return true
+}
+
+// Src returns the source IP address.
+func (k *Key) Src() net.IP {
+	return toIP(k.SrcIP)
+}
+
+// Dst returns the destination IP address.
+func (k *Key) Dst() net.IP {
+	return toIP(k.DstIP)
+}
+
+// Reverse returns the key of the other direction of the connection.
+func (k Key) Reverse() Key {
+	return Key{
+		SrcIP:    k.DstIP,
+		DstIP:    k.SrcIP,
+		SrcPort:  k.DstPort,
+		DstPort:  k.SrcPort,
+		Protocol: k.Protocol,
+	}
+}
+
+func toIP(b [net.IPv6len]byte) net.IP {
+	ip := net.IP(b[:])
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip
+}
+
+// String formats the key as src:port=>dst:port#protocol.
+func (k Key) String() string {
+	return k.Src().String() + ":" + strconv.Itoa(int(k.SrcPort)) + "=>" +
+		k.Dst().String() + ":" + strconv.Itoa(int(k.DstPort)) + "#" + strconv.Itoa(int(k.Protocol))
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (k Key) MarshalText() ([]byte, error) {
+	return []byte(k.String()), nil
+}
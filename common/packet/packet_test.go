@@ -0,0 +1,137 @@
+package packet
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func build(t testing.TB, src, dst string, tcp bool) []byte {
+	var network gopacket.NetworkLayer
+	var ip gopacket.SerializableLayer
+	if v4 := net.ParseIP(src).To4(); v4 != nil {
+		l := &layers.IPv4{Version: 4, TTL: 64, SrcIP: v4, DstIP: net.ParseIP(dst).To4(), Protocol: layers.IPProtocolUDP}
+		if tcp {
+			l.Protocol = layers.IPProtocolTCP
+		}
+		network, ip = l, l
+	} else {
+		l := &layers.IPv6{Version: 6, HopLimit: 64, SrcIP: net.ParseIP(src), DstIP: net.ParseIP(dst), NextHeader: layers.IPProtocolUDP}
+		if tcp {
+			l.NextHeader = layers.IPProtocolTCP
+		}
+		network, ip = l, l
+	}
+
+	var transport gopacket.SerializableLayer
+	if tcp {
+		l := &layers.TCP{SrcPort: 50000, DstPort: 443, SYN: true, Window: 65535}
+		l.SetNetworkLayerForChecksum(network)
+		transport = l
+	} else {
+		l := &layers.UDP{SrcPort: 50000, DstPort: 53}
+		l.SetNetworkLayerForChecksum(network)
+		transport = l
+	}
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, ip, transport, gopacket.Payload("payload")); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// withOptions pads the IPv4 header with 4 NOP options.
+func withOptions(b []byte) []byte {
+	out := make([]byte, 0, len(b)+4)
+	out = append(out, b[:20]...)
+	out = append(out, 1, 1, 1, 1)
+	out = append(out, b[20:]...)
+	out[0] = 0x46
+	binary.BigEndian.PutUint16(out[2:4], uint16(len(out)))
+	return out
+}
+
+// withExtensions puts a hop-by-hop and a destination options header in
+// front of the transport header of the IPv6 packet.
+func withExtensions(b []byte) []byte {
+	out := make([]byte, 0, len(b)+16)
+	out = append(out, b[:40]...)
+	out = append(out, ipv6Destination, 0, 1, 4, 0, 0, 0, 0)
+	out = append(out, b[6], 0, 1, 4, 0, 0, 0, 0)
+	out = append(out, b[40:]...)
+	out[6] = ipv6HopByHop
+	binary.BigEndian.PutUint16(out[4:6], uint16(len(out)-40))
+	return out
+}
+
+type testCase struct {
+	name string
+	b    []byte
+	tcp  bool
+}
+
+func testCases(t testing.TB) []testCase {
+	tcp4 := build(t, "10.0.0.2", "1.2.3.4", true)
+	udp4 := build(t, "10.0.0.2", "1.2.3.4", false)
+	tcp6 := build(t, "fd00::2", "2001:db8::1", true)
+	udp6 := build(t, "fd00::2", "2001:db8::1", false)
+	return []testCase{
+		{"tcp4", tcp4, true},
+		{"udp4", udp4, false},
+		{"tcp4-options", withOptions(tcp4), true},
+		{"udp4-options", withOptions(udp4), false},
+		{"tcp6", tcp6, true},
+		{"udp6", udp6, false},
+		{"tcp6-extensions", withExtensions(tcp6), true},
+		{"udp6-extensions", withExtensions(udp6), false},
+	}
+}
+
+func TestParse(t *testing.T) {
+	for _, c := range testCases(t) {
+		t.Run(c.name, func(t *testing.T) {
+			var p Packet
+			if !Parse(c.b, &p) {
+				t.Fatal("not parsed")
+			}
+			if p.SrcPort != 50000 || string(p.Payload) != "payload" {
+				t.Errorf("port %v, payload %q", p.SrcPort, p.Payload)
+			}
+			if c.tcp && (p.Protocol != ProtocolTCP || p.DstPort != 443 || p.TCPFlags != FlagSYN) {
+				t.Errorf("tcp %v, port %v, flags %#x", p.Protocol, p.DstPort, p.TCPFlags)
+			}
+			if !c.tcp && (p.Protocol != ProtocolUDP || p.DstPort != 53) {
+				t.Errorf("udp %v, port %v", p.Protocol, p.DstPort)
+			}
+		})
+	}
+}
+
+// 非首个分片没有传输层头部
+func TestParseFragment(t *testing.T) {
+	b := build(t, "10.0.0.2", "1.2.3.4", false)
+	binary.BigEndian.PutUint16(b[6:8], 1)
+	var p Packet
+	if Parse(b, &p) {
+		t.Fatal("non-first fragment parsed")
+	}
+}
+
+func BenchmarkParse(b *testing.B) {
+	for _, c := range testCases(b) {
+		b.Run(c.name, func(b *testing.B) {
+			var p Packet
+			b.ReportAllocs()
+			b.SetBytes(int64(len(c.b)))
+			for i := 0; i < b.N; i++ {
+				if !Parse(c.b, &p) {
+					b.Fatal("not parsed")
+				}
+			}
+		})
+	}
+}
@@ -45,6 +45,14 @@ func (p *Plugin)StartPlugin(plugin, pluginOpts, ssAddr string, isServer bool) (n
 	return
 }
 
+// PID returns the pid of the plugin process, 0 if it is not running.
+func (p *Plugin) PID() uint32 {
+	if p.cmd == nil || p.cmd.Process == nil {
+		return 0
+	}
+	return uint32(p.cmd.Process.Pid)
+}
+
 func (p *Plugin) KillPlugin() {
 	if p.cmd != nil {
 		p.cmd.Process.Signal(syscall.SIGTERM)
@@ -0,0 +1,51 @@
+package common
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+func GetInterfaceIndex(dest string) (uint32, uint32, error) {
+	handle, err := syscall.LoadLibrary("iphlpapi.dll")
+	defer syscall.FreeLibrary(handle)
+	if err != nil {
+		panic("Load DLL failed.")
+	}
+
+	if ip := net.ParseIP(dest); ip != nil && ip.To4() == nil {
+		return getInterfaceIndex6(handle, ip)
+	}
+
+	GetBestInterface, err := syscall.GetProcAddress(handle, "GetBestInterface")
+	if err != nil {
+		panic("No function named GetBestInterface")
+	}
+	var index uint32 = 0
+	var dst = IpToInt32(dest)
+	r1, _, _ := syscall.Syscall(GetBestInterface, 2, (uintptr)(unsafe.Pointer(&dst)), (uintptr)(unsafe.Pointer(&index)), 0)
+	if r1 != 0 {
+		return 0, 0, fmt.Errorf("GetBestInterface %v error: %v", dest, syscall.Errno(r1))
+	}
+	return index, 0, nil
+}
+
+// getInterfaceIndex6 uses GetBestInterfaceEx, GetBestInterface only takes
+// IPv4 addresses.
+func getInterfaceIndex6(handle syscall.Handle, ip net.IP) (uint32, uint32, error) {
+	GetBestInterfaceEx, err := syscall.GetProcAddress(handle, "GetBestInterfaceEx")
+	if err != nil {
+		panic("No function named GetBestInterfaceEx")
+	}
+	var index uint32 = 0
+	var dst = syscall.RawSockaddrInet6{
+		Family: syscall.AF_INET6,
+	}
+	copy(dst.Addr[:], ip)
+	r1, _, _ := syscall.Syscall(GetBestInterfaceEx, 2, (uintptr)(unsafe.Pointer(&dst)), (uintptr)(unsafe.Pointer(&index)), 0)
+	if r1 != 0 {
+		return 0, 0, fmt.Errorf("GetBestInterfaceEx %v error: %v", ip, syscall.Errno(r1))
+	}
+	return index, 0, nil
+}
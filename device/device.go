@@ -0,0 +1,71 @@
+package device
+
+import (
+	"net"
+)
+
+// BatchMax is the maximum number of packets moved in one batch.
+const BatchMax = 0xff
+
+// Device is a packet capture backend. App reads the outbound IP packets of
+// the host from it, hands the ones that belong to a proxied session to the
+// lwip stack and writes the packets emitted by the stack back through it.
+type Device interface {
+	// ReadPackets receives a batch of outbound IP packets into b, stored back
+	// to back, and returns the number of bytes and packets read.
+	ReadPackets(b []byte) (nr, nx int, err error)
+
+	// Reinject hands the batch returned by the last ReadPackets back to the
+	// network. Packets whose index is set in divert have been taken over by
+	// the stack and are dropped instead.
+	Reinject(b []byte, divert []bool) error
+
+	// WritePackets writes n back to back IP packets emitted by the stack
+	// to the host.
+	WritePackets(b []byte, n int) error
+
+	Close() error
+}
+
+// SocketEvent is what happened to a socket reported by a Monitor.
+type SocketEvent uint8
+
+const (
+	SocketConnect SocketEvent = iota
+	SocketClose
+)
+
+// Socket is an outbound socket reported by a Monitor.
+type Socket struct {
+	Event      SocketEvent
+	ProcessID  uint32
+	Protocol   uint8
+	LocalIP    net.IP
+	LocalPort  uint16
+	RemoteIP   net.IP
+	RemotePort uint16
+}
+
+// Monitor is implemented by backends that can tell which process opened
+// an outbound socket.
+type Monitor interface {
+	// ReadSockets receives a batch of outbound sockets that were connected
+	// or closed into s and returns the number of sockets read.
+	ReadSockets(s []Socket) (int, error)
+}
+
+// Router is implemented by backends that only receive the traffic routed
+// to them. App diverts every packet read from such a backend.
+type Router interface {
+	// AddRoutes steers the traffic to cidr into the backend.
+	AddRoutes(cidr []string) error
+}
+
+// PacketLen returns the total length of the IPv4 or IPv6 packet at the
+// start of b.
+func PacketLen(b []byte) int {
+	if b[0]>>4 == 6 {
+		return 40 + (int(b[4])<<8 | int(b[5]))
+	}
+	return int(b[2])<<8 | int(b[3])
+}
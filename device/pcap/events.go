@@ -0,0 +1,189 @@
+package pcap
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/MissGod1/PProxy/device"
+)
+
+// Process is the process of a replayed socket event.
+type Process struct {
+	PID     uint32 `json:"pid"`
+	PPID    uint32 `json:"ppid"`
+	Name    string `json:"name"`
+	Path    string `json:"path"`
+	Cmdline string `json:"cmdline"`
+	Start   int64  `json:"start"`
+}
+
+// SocketEvent is a line of the socket events file, e.g.
+//
+//	{"time": "2020-08-01T10:00:00.5Z", "event": "connect", "protocol": "tcp",
+//	 "local": "192.168.1.2:50000", "remote": "1.2.3.4:443", "pid": 42, "name": "curl"}
+//
+// Events are handed to the monitor before the first packet captured at or
+// after their time.
+type SocketEvent struct {
+	Time     time.Time `json:"time"`
+	Event    string    `json:"event"`
+	Protocol string    `json:"protocol"`
+	Local    string    `json:"local"`
+	Remote   string    `json:"remote"`
+	Process
+}
+
+type event struct {
+	time   time.Time
+	socket device.Socket
+}
+
+func parseHostPort(s string) (net.IP, uint16, error) {
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		return nil, 0, err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, 0, fmt.Errorf("invalid ip %v", host)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, 0, err
+	}
+	return ip, uint16(p), nil
+}
+
+func (e *SocketEvent) socket() (device.Socket, error) {
+	s := device.Socket{ProcessID: e.PID}
+	switch strings.ToLower(e.Event) {
+	case "connect":
+		s.Event = device.SocketConnect
+	case "close":
+		s.Event = device.SocketClose
+	default:
+		return s, fmt.Errorf("unknown event %q", e.Event)
+	}
+	switch strings.ToLower(e.Protocol) {
+	case "tcp":
+		s.Protocol = 6
+	case "udp":
+		s.Protocol = 17
+	default:
+		return s, fmt.Errorf("unknown protocol %q", e.Protocol)
+	}
+	var err error
+	if s.LocalIP, s.LocalPort, err = parseHostPort(e.Local); err != nil {
+		return s, fmt.Errorf("local address: %v", err)
+	}
+	if s.RemoteIP, s.RemotePort, err = parseHostPort(e.Remote); err != nil {
+		return s, fmt.Errorf("remote address: %v", err)
+	}
+	return s, nil
+}
+
+// LoadEvents reads the socket events that go with the capture, one JSON
+// object per line. The processes of the events are returned by Process.
+func (d *Device) LoadEvents(r io.Reader) error {
+	var events []event
+	procs := make(map[uint32]Process)
+	sc := bufio.NewScanner(r)
+	for line := 1; sc.Scan(); line++ {
+		text := strings.TrimSpace(sc.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		var e SocketEvent
+		if err := json.Unmarshal([]byte(text), &e); err != nil {
+			return fmt.Errorf("socket event line %v: %v", line, err)
+		}
+		s, err := e.socket()
+		if err != nil {
+			return fmt.Errorf("socket event line %v: %v", line, err)
+		}
+		events = append(events, event{time: e.Time, socket: s})
+		if e.Name != "" {
+			procs[e.PID] = e.Process
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	sort.SliceStable(events, func(i, j int) bool { return events[i].time.Before(events[j].time) })
+
+	d.Lock()
+	d.events = events
+	d.procs = procs
+	d.Unlock()
+	return nil
+}
+
+// Process returns the process with pid named by the socket events.
+func (d *Device) Process(pid uint32) (Process, bool) {
+	d.Lock()
+	defer d.Unlock()
+	p, ok := d.procs[pid]
+	return p, ok
+}
+
+// deliver hands the events due at t to the monitor and waits until it has
+// handled them, so the sessions exist before the packet is read.
+func (d *Device) deliver(t time.Time) error {
+	n := 0
+	for n < len(d.events) && !d.events[n].time.After(t) {
+		n++
+	}
+	if n == 0 {
+		return nil
+	}
+	batch := make([]device.Socket, n)
+	for i := range batch {
+		batch[i] = d.events[i].socket
+	}
+	d.events = d.events[n:]
+
+	for len(batch) > 0 {
+		select {
+		case d.sockets <- batch:
+		case <-d.closed:
+			return io.EOF
+		}
+		select {
+		case <-d.handled:
+		case <-d.closed:
+			return io.EOF
+		}
+		if len(batch) > device.BatchMax {
+			batch = batch[device.BatchMax:]
+		} else {
+			batch = nil
+		}
+	}
+	return nil
+}
+
+// ReadSockets returns the socket events of the replay. A call after a
+// batch tells the replay that the batch was handled.
+func (d *Device) ReadSockets(s []device.Socket) (int, error) {
+	if d.pending {
+		select {
+		case d.handled <- struct{}{}:
+		case <-d.closed:
+			return 0, io.EOF
+		}
+	}
+	select {
+	case batch := <-d.sockets:
+		d.pending = true
+		return copy(s, batch), nil
+	case <-d.closed:
+		return 0, io.EOF
+	}
+}
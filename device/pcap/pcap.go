@@ -0,0 +1,202 @@
+package pcap
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+
+	"github.com/MissGod1/PProxy/device"
+)
+
+// Device replays the packets of a pcap file as outbound traffic and records
+// the packets emitted by the stack to another pcap file. Every IP packet in
+// the input is treated as outbound, so captures should be taken in one
+// direction only, e.g. with tcpdump -Q out. The socket events loaded with
+// LoadEvents are reported as a device.Monitor, so the packets can be
+// attributed to processes.
+type Device struct {
+	sync.Mutex
+
+	in  io.Reader
+	out io.Writer
+	r   *pcapgo.Reader
+	w   *pcapgo.Writer
+
+	// Pace replays the packets with the gaps of the capture instead of as
+	// fast as possible.
+	Pace bool
+	last time.Time
+
+	passed   int
+	diverted int
+	recorded int
+
+	// 按时间排序的socket事件, 在对应的数据包之前交给监视器
+	events  []event
+	procs   map[uint32]Process
+	sockets chan []device.Socket
+	handled chan struct{}
+	// 只在监视器的goroutine中使用
+	pending bool
+	closed  chan struct{}
+	once    sync.Once
+}
+
+// NewDevice reads packets from in and records to out. out may be nil, the
+// output is discarded then.
+func NewDevice(in io.Reader, out io.Writer) (*Device, error) {
+	r, err := pcapgo.NewReader(in)
+	if err != nil {
+		return nil, fmt.Errorf("read pcap header error: %v", err)
+	}
+	switch r.LinkType() {
+	case layers.LinkTypeNull, layers.LinkTypeLoop, layers.LinkTypeEthernet, layers.LinkTypeLinuxSLL,
+		layers.LinkTypeRaw, layers.LinkTypeIPv4, layers.LinkTypeIPv6:
+	default:
+		return nil, fmt.Errorf("unsupported pcap link type %v", r.LinkType())
+	}
+
+	if out == nil {
+		out = ioutil.Discard
+	}
+	w := pcapgo.NewWriter(out)
+	if err := w.WriteFileHeader(65535, layers.LinkTypeRaw); err != nil {
+		return nil, fmt.Errorf("write pcap header error: %v", err)
+	}
+
+	return &Device{
+		in:      in,
+		out:     out,
+		r:       r,
+		w:       w,
+		sockets: make(chan []device.Socket),
+		handled: make(chan struct{}),
+		closed:  make(chan struct{}),
+	}, nil
+}
+
+// ReadPackets returns the next IP packet of the capture, or io.EOF at the
+// end of it.
+func (d *Device) ReadPackets(b []byte) (int, int, error) {
+	for {
+		data, ci, err := d.r.ReadPacketData()
+		if err != nil {
+			return 0, 0, err
+		}
+		data = d.stripLinkLayer(data)
+		if data == nil {
+			continue
+		}
+		if len(data) < 40 && data[0]>>4 == 6 || len(data) < 20 || device.PacketLen(data) > len(data) {
+			continue
+		}
+		if d.Pace {
+			if !d.last.IsZero() && ci.Timestamp.After(d.last) {
+				time.Sleep(ci.Timestamp.Sub(d.last))
+			}
+			d.last = ci.Timestamp
+		}
+		if err := d.deliver(ci.Timestamp); err != nil {
+			return 0, 0, err
+		}
+		return copy(b, data[:device.PacketLen(data)]), 1, nil
+	}
+}
+
+// stripLinkLayer returns the IP packet in data, or nil if there is none.
+func (d *Device) stripLinkLayer(data []byte) []byte {
+	var etherType layers.EthernetType
+	switch d.r.LinkType() {
+	case layers.LinkTypeRaw, layers.LinkTypeIPv4, layers.LinkTypeIPv6:
+	case layers.LinkTypeNull, layers.LinkTypeLoop:
+		if len(data) < 4 {
+			return nil
+		}
+		data = data[4:]
+	case layers.LinkTypeEthernet:
+		if len(data) < 14 {
+			return nil
+		}
+		etherType = layers.EthernetType(uint16(data[12])<<8 | uint16(data[13]))
+		data = data[14:]
+		for etherType == layers.EthernetTypeDot1Q && len(data) >= 4 {
+			etherType = layers.EthernetType(uint16(data[2])<<8 | uint16(data[3]))
+			data = data[4:]
+		}
+	case layers.LinkTypeLinuxSLL:
+		if len(data) < 16 {
+			return nil
+		}
+		etherType = layers.EthernetType(uint16(data[14])<<8 | uint16(data[15]))
+		data = data[16:]
+	}
+	if etherType != 0 && etherType != layers.EthernetTypeIPv4 && etherType != layers.EthernetTypeIPv6 {
+		return nil
+	}
+	if len(data) < 1 || data[0]>>4 != 4 && data[0]>>4 != 6 {
+		return nil
+	}
+	return data
+}
+
+// Reinject counts the packets, there is no network to hand them to.
+func (d *Device) Reinject(b []byte, diverted []bool) error {
+	d.Lock()
+	defer d.Unlock()
+	for _, v := range diverted {
+		if v {
+			d.diverted++
+		} else {
+			d.passed++
+		}
+	}
+	return nil
+}
+
+func (d *Device) WritePackets(b []byte, n int) error {
+	d.Lock()
+	defer d.Unlock()
+	now := time.Now()
+	for i := 0; i < n; i++ {
+		l := device.PacketLen(b)
+		ci := gopacket.CaptureInfo{
+			Timestamp:     now,
+			CaptureLength: l,
+			Length:        l,
+		}
+		if err := d.w.WritePacket(ci, b[:l]); err != nil {
+			return err
+		}
+		d.recorded++
+		b = b[l:]
+	}
+	return nil
+}
+
+// Stats returns the number of packets reinjected, taken over by the stack
+// and written by the stack so far.
+func (d *Device) Stats() (passed, diverted, recorded int) {
+	d.Lock()
+	defer d.Unlock()
+	return d.passed, d.diverted, d.recorded
+}
+
+// Close closes the input and output if they are closers.
+func (d *Device) Close() error {
+	d.once.Do(func() { close(d.closed) })
+	d.Lock()
+	defer d.Unlock()
+	if c, ok := d.in.(io.Closer); ok {
+		c.Close()
+	}
+	if c, ok := d.out.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
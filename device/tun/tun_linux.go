@@ -0,0 +1,111 @@
+package tun
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+	"strings"
+
+	"github.com/MissGod1/PProxy/device"
+	"github.com/eycorsican/go-tun2socks/common/log"
+	shadowtun "github.com/imgk/shadow/device/tun"
+)
+
+// Device reads the packets the kernel routes into a TUN interface. Every
+// packet read from it is handed to the stack, so the routes decide which
+// traffic is proxied.
+type Device struct {
+	*shadowtun.Device
+	buffer []byte
+	// 关闭时删除的绕过路由
+	bypass []string
+}
+
+// NewDevice creates the TUN interface, assigns it the addresses in CIDR
+// form and brings it up.
+func NewDevice(name string, address ...string) (*Device, error) {
+	dev, err := shadowtun.NewDevice(name)
+	if err != nil {
+		return nil, fmt.Errorf("create tun device error: %v", err)
+	}
+	for _, addr := range address {
+		if err := dev.SetInterfaceAddress(addr); err != nil {
+			dev.Close()
+			return nil, fmt.Errorf("set tun address %v error: %v", addr, err)
+		}
+	}
+	if err := dev.Activate(); err != nil {
+		dev.Close()
+		return nil, fmt.Errorf("activate tun device error: %v", err)
+	}
+	log.Infof("tun device %v is up with address %v", dev.Name, address)
+	return &Device{
+		Device: dev,
+		buffer: make([]byte, 4+dev.MTU),
+	}, nil
+}
+
+// AddRoutes steers the traffic to cidr into the device.
+func (d *Device) AddRoutes(cidr []string) error {
+	return d.Device.AddRouteEntry(cidr)
+}
+
+// Bypass pins the route to ip to the gateway it uses now, so that traffic
+// to the proxy server does not loop back into the device once the routes
+// are installed. It must be called before AddRoutes, the route is removed
+// on Close.
+func (d *Device) Bypass(ip net.IP) error {
+	out, err := exec.Command("ip", "route", "get", ip.String()).Output()
+	if err != nil {
+		return fmt.Errorf("query route to %v error: %v", ip, err)
+	}
+	args := []string{"route", "replace", ip.String()}
+	fields := strings.Fields(string(out))
+	for i := 0; i+1 < len(fields); i++ {
+		switch fields[i] {
+		case "via", "dev":
+			args = append(args, fields[i], fields[i+1])
+		}
+	}
+	if out, err := exec.Command("ip", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("add bypass route for %v error: %v %s", ip, err, out)
+	}
+	d.bypass = append(d.bypass, ip.String())
+	return nil
+}
+
+// Close removes the bypass routes and the device.
+func (d *Device) Close() error {
+	for _, ip := range d.bypass {
+		if out, err := exec.Command("ip", "route", "del", ip).CombinedOutput(); err != nil {
+			log.Warnf("remove bypass route for %v error: %v %s", ip, err, out)
+		}
+	}
+	d.bypass = nil
+	return d.Device.Close()
+}
+
+func (d *Device) ReadPackets(b []byte) (int, int, error) {
+	n, err := d.Device.Device.Read(d.buffer, 4)
+	if err != nil {
+		return 0, 0, err
+	}
+	return copy(b, d.buffer[4:4+n]), 1, nil
+}
+
+// Reinject drops the packets that were not diverted, there is no other
+// network to hand them to.
+func (d *Device) Reinject(b []byte, diverted []bool) error {
+	return nil
+}
+
+func (d *Device) WritePackets(b []byte, n int) error {
+	for i := 0; i < n; i++ {
+		l := device.PacketLen(b)
+		if _, err := d.Device.Write(b[:l]); err != nil {
+			return err
+		}
+		b = b[l:]
+	}
+	return nil
+}
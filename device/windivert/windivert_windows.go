@@ -0,0 +1,213 @@
+package windivert
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/MissGod1/PProxy/common"
+	"github.com/MissGod1/PProxy/device"
+	divert "github.com/imgk/shadow/device/windivert"
+)
+
+const (
+	// %v is one "and remoteAddr != server" per proxy server
+	Filter1 = "outbound and !loopback and (tcp or udp) and (event == CONNECT or event == CLOSE)%v"
+	Filter2 = "ifIdx == %d and outbound and !loopback and (tcp or udp)%v"
+)
+
+// Device captures packets with two WinDivert handles, one on the socket
+// layer to learn the owning process and one on the network layer.
+type Device struct {
+	hSocket  *divert.Handle
+	hNetwork *divert.Handle
+	address  *divert.Address
+
+	recvAddress []divert.Address
+	sockAddress []divert.Address
+	sendAddress []divert.Address
+	sockBuffer  []byte
+}
+
+func SetParam(hd *divert.Handle) error {
+	if er := hd.SetParam(divert.QueueLength, divert.QueueLengthMax); er != nil {
+		err := fmt.Errorf("set handle parameter queue length error %v", er)
+		return err
+	}
+	if er := hd.SetParam(divert.QueueTime, divert.QueueTimeMax); er != nil {
+		err := fmt.Errorf("set handle parameter queue time error %v", er)
+		return err
+	}
+	if er := hd.SetParam(divert.QueueSize, divert.QueueSizeMax); er != nil {
+		err := fmt.Errorf("set handle parameter queue size error %v", er)
+		return err
+	}
+	return nil
+}
+
+// NewDevice opens the WinDivert handles for all traffic except the one
+// going to the proxy servers. The interface is the one towards the first
+// server.
+func NewDevice(servers ...string) (*Device, error) {
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("no proxy server")
+	}
+	exclude := ""
+	for _, server := range servers {
+		exclude += fmt.Sprintf(" and remoteAddr != %v", server)
+	}
+	iface, subiface, err := common.GetInterfaceIndex(servers[0])
+	if err != nil {
+		return nil, err
+	}
+	h1, err := divert.Open(fmt.Sprintf(Filter1, exclude), divert.LayerSocket, 100, divert.FlagSniff|divert.FlagRecvOnly)
+	if err != nil {
+		err = fmt.Errorf("Open Socket Handle Failed.")
+		return nil, err
+	}
+	h2, err := divert.Open(fmt.Sprintf(Filter2, iface, exclude), divert.LayerNetwork, 101, 0)
+	if err != nil {
+		h1.Close()
+		err = fmt.Errorf("Open Network Handle Falied.")
+		return nil, err
+	}
+	err = SetParam(h1)
+	if err != nil {
+		return nil, err
+	}
+	err = SetParam(h2)
+	if err != nil {
+		return nil, err
+	}
+
+	const f = uint8(0x01<<7) | uint8(0x01<<6) | uint8(0x01<<5)
+
+	d := &Device{
+		hSocket:     h1,
+		hNetwork:    h2,
+		address:     new(divert.Address),
+		recvAddress: make([]divert.Address, divert.BatchMax),
+		sockAddress: make([]divert.Address, divert.BatchMax),
+		sendAddress: make([]divert.Address, divert.BatchMax),
+		sockBuffer:  make([]byte, 1500*divert.BatchMax),
+	}
+	d.address.Network().InterfaceIndex = iface
+	d.address.Network().SubInterfaceIndex = subiface
+	for i := range d.sendAddress {
+		d.sendAddress[i] = *d.address
+		d.sendAddress[i].Flags |= f
+	}
+	return d, nil
+}
+
+func (d *Device) ReadPackets(b []byte) (int, int, error) {
+	nr, nx, err := d.hNetwork.RecvEx(b, d.recvAddress, nil)
+	return int(nr), int(nx), err
+}
+
+func (d *Device) Reinject(b []byte, diverted []bool) error {
+	const f = uint8(0x01<<7) | uint8(0x01<<6) | uint8(0x01<<5) | uint8(0x01<<3)
+
+	bb := b
+	for i := range diverted {
+		l := device.PacketLen(bb)
+		if diverted[i] {
+			d.recvAddress[i].Flags |= f
+
+			if bb[0]>>4 == 6 {
+				bb[7] = 0 // Hop Limit = 0
+			} else {
+				bb[8] = 0 // TTL = 0
+			}
+		}
+		bb = bb[l:]
+	}
+
+	d.hNetwork.Lock()
+	_, err := d.hNetwork.SendEx(b, d.recvAddress[:len(diverted)], nil)
+	d.hNetwork.Unlock()
+	if err != nil && err != divert.ErrHostUnreachable {
+		return err
+	}
+	return nil
+}
+
+func (d *Device) WritePackets(b []byte, n int) error {
+	bb := b
+	for i := 0; i < n; i++ {
+		if bb[0]>>4 == 6 {
+			d.sendAddress[i].SetIPv6()
+		} else {
+			d.sendAddress[i].UnsetIPv6()
+		}
+		bb = bb[device.PacketLen(bb):]
+	}
+
+	d.hNetwork.Lock()
+	_, err := d.hNetwork.SendEx(b, d.sendAddress[:n], nil)
+	d.hNetwork.Unlock()
+	return err
+}
+
+func (d *Device) ReadSockets(s []device.Socket) (int, error) {
+	n := len(s)
+	if n > len(d.sockAddress) {
+		n = len(d.sockAddress)
+	}
+	_, nx, err := d.hSocket.RecvEx(d.sockBuffer, d.sockAddress[:n], nil)
+	if err != nil {
+		return 0, err
+	}
+	for i := 0; i < int(nx); i++ {
+		ConvertToSocket(&d.sockAddress[i], &s[i])
+	}
+	return int(nx), nil
+}
+
+// ConvertToSocket fills s from a socket layer address.
+func ConvertToSocket(address *divert.Address, s *device.Socket) {
+	socket := address.Socket()
+
+	s.Event = device.SocketConnect
+	if address.Event() == divert.EventSocketClose {
+		s.Event = device.SocketClose
+	}
+	s.ProcessID = socket.ProcessID
+	s.Protocol = socket.Protocol
+	s.LocalIP = ConvertToIP(&socket.LocalAddress)
+	s.LocalPort = socket.LocalPort
+	s.RemoteIP = ConvertToIP(&socket.RemoteAddress)
+	s.RemotePort = socket.RemotePort
+}
+
+// ConvertToIP converts a WinDivert address, stored as a little endian IPv6
+// address with IPv4 addresses mapped into it.
+func ConvertToIP(addr *[16]uint8) net.IP {
+	ip := make(net.IP, net.IPv6len)
+	for i := range ip {
+		ip[i] = addr[net.IPv6len-1-i]
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip
+}
+
+func (d *Device) Close() error {
+	if err := d.hSocket.Shutdown(divert.ShutdownBoth); err != nil {
+		return fmt.Errorf("shutdown handle error: %v", err)
+	}
+
+	if err := d.hSocket.Close(); err != nil {
+		return fmt.Errorf("close handle error: %v", err)
+	}
+
+	if err := d.hNetwork.Shutdown(divert.ShutdownBoth); err != nil {
+		return fmt.Errorf("shutdown handle error: %v", err)
+	}
+
+	if err := d.hNetwork.Close(); err != nil {
+		return fmt.Errorf("close handle error: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/MissGod1/PProxy/device"
+	"github.com/MissGod1/PProxy/device/tun"
+	"github.com/eycorsican/go-tun2socks/common/log"
+)
+
+const (
+	DefaultTunName    = "pproxy"
+	DefaultTunAddress = "198.18.0.1/16"
+)
+
+// 没有配置路由时接管所有IPv4流量, 配置了IPv6地址时也接管所有IPv6流量
+var (
+	DefaultTunRoutes  = []string{"0.0.0.0/1", "128.0.0.0/1"}
+	DefaultTunRoutes6 = []string{"::/1", "8000::/1"}
+)
+
+// OpenDevice opens the capture backend of the platform.
+func OpenDevice(servers []*Server, p *Process) (device.Device, error) {
+	name, address, routes := p.Tun.Name, p.Tun.Address, p.Tun.Routes
+	if name == "" {
+		name = DefaultTunName
+	}
+	if address == "" {
+		address = DefaultTunAddress
+	}
+	addresses := []string{address}
+	if p.Tun.Address6 != "" {
+		addresses = append(addresses, p.Tun.Address6)
+	}
+	if len(routes) == 0 {
+		routes = DefaultTunRoutes
+		if p.Tun.Address6 != "" {
+			routes = append(routes, DefaultTunRoutes6...)
+		}
+	}
+
+	dev, err := tun.NewDevice(name, addresses...)
+	if err != nil {
+		return nil, err
+	}
+
+	// 代理服务器的流量不能进入TUN设备
+	for _, s := range servers {
+		// 经过其他服务器连接的服务器不会直接访问
+		if s.Via != "" {
+			continue
+		}
+		ips, err := net.LookupIP(s.Server)
+		if err != nil {
+			dev.Close()
+			return nil, fmt.Errorf("resolve proxy server address error: %v", err)
+		}
+		for _, ip := range ips {
+			if err := dev.Bypass(ip); err != nil {
+				dev.Close()
+				return nil, err
+			}
+		}
+	}
+
+	if err := dev.AddRoutes(routes); err != nil {
+		dev.Close()
+		return nil, fmt.Errorf("add tun routes error: %v", err)
+	}
+	log.Infof("routes %v are steered into %v", routes, dev.Name)
+	return dev, nil
+}
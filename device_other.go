@@ -0,0 +1,15 @@
+//go:build !windows && !linux
+// +build !windows,!linux
+
+package main
+
+import (
+	"errors"
+
+	"github.com/MissGod1/PProxy/device"
+)
+
+// OpenDevice opens the capture backend of the platform.
+func OpenDevice(servers []*Server, p *Process) (device.Device, error) {
+	return nil, errors.New("no capture backend for this platform")
+}
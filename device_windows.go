@@ -0,0 +1,18 @@
+package main
+
+import (
+	"github.com/MissGod1/PProxy/device"
+	"github.com/MissGod1/PProxy/device/windivert"
+)
+
+// OpenDevice opens the capture backend of the platform.
+func OpenDevice(servers []*Server, p *Process) (device.Device, error) {
+	addrs := make([]string, 0, len(servers))
+	for _, s := range servers {
+		// 经过其他服务器连接的服务器不会直接访问
+		if s.Via == "" {
+			addrs = append(addrs, s.Server)
+		}
+	}
+	return windivert.NewDevice(addrs...)
+}
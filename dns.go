@@ -0,0 +1,29 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+
+	"github.com/MissGod1/PProxy/common/dns"
+)
+
+// ruleFakeDns answers with fake addresses except for the domains a rule
+// sends direct. The handlers resolve those through the proxy instead, so
+// the flows that follow use real addresses that can be reached directly.
+type ruleFakeDns struct {
+	dns.FakeDns
+	// app is set before the stack starts
+	app *App
+}
+
+func (f *ruleFakeDns) GenerateFakeResponse(request []byte) ([]byte, error) {
+	msg := &layers.DNS{}
+	if err := msg.DecodeFromBytes(request, gopacket.NilDecodeFeedback); err == nil && len(msg.Questions) > 0 && f.app != nil {
+		if domain := string(msg.Questions[0].Name); f.app.Rules().Direct(domain) {
+			return nil, fmt.Errorf("domain %v is routed direct", domain)
+		}
+	}
+	return f.FakeDns.GenerateFakeResponse(request)
+}
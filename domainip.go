@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// DNS应答的TTL太短时按这个时间保留, 假DNS的TTL只有1秒
+const MinDomainIPTTL = 5 * time.Minute
+
+type domainIP struct {
+	domain string
+	expire int64 // unix nano
+}
+
+// DomainIPTable remembers the domains of the addresses in DNS answers, so
+// domain rules match the flows that follow whichever process opens them.
+// Addresses are stored IPv4-mapped like packet.Key.
+type DomainIPTable struct {
+	sync.RWMutex
+	ips map[[net.IPv6len]byte]domainIP
+}
+
+func NewDomainIPTable() *DomainIPTable {
+	return &DomainIPTable{
+		ips: make(map[[net.IPv6len]byte]domainIP),
+	}
+}
+
+// Add stores ip as an address of domain for ttl, at least MinDomainIPTTL.
+func (t *DomainIPTable) Add(ip net.IP, domain string, ttl time.Duration) {
+	ip = ip.To16()
+	if ip == nil {
+		return
+	}
+	if ttl < MinDomainIPTTL {
+		ttl = MinDomainIPTTL
+	}
+	var k [net.IPv6len]byte
+	copy(k[:], ip)
+
+	t.Lock()
+	t.ips[k] = domainIP{
+		domain: domain,
+		expire: time.Now().Add(ttl).UnixNano(),
+	}
+	t.Unlock()
+}
+
+// Lookup returns the domain ip was answered for.
+func (t *DomainIPTable) Lookup(ip [net.IPv6len]byte) (string, bool) {
+	t.RLock()
+	e, ok := t.ips[ip]
+	t.RUnlock()
+	if !ok || time.Now().UnixNano() > e.expire {
+		return "", false
+	}
+	return e.domain, true
+}
+
+// Expire drops the addresses whose TTL passed and returns how many were
+// dropped.
+func (t *DomainIPTable) Expire(now time.Time) int {
+	n := now.UnixNano()
+	expired := 0
+
+	t.Lock()
+	defer t.Unlock()
+	for k, e := range t.ips {
+		if n > e.expire {
+			delete(t.ips, k)
+			expired++
+		}
+	}
+	return expired
+}
+
+// Len returns the number of addresses.
+func (t *DomainIPTable) Len() int {
+	t.RLock()
+	defer t.RUnlock()
+	return len(t.ips)
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"strings"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// GeoIP finds the country of addresses in a local MaxMind database, e.g.
+// GeoLite2-Country.mmdb.
+type GeoIP struct {
+	reader *maxminddb.Reader
+}
+
+type geoIPRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	RegisteredCountry struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"registered_country"`
+}
+
+// OpenGeoIP reads the database into memory, so it can be replaced on disk
+// and reloaded while the old one is in use.
+func OpenGeoIP(file string) (*GeoIP, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := maxminddb.FromBytes(b)
+	if err != nil {
+		return nil, err
+	}
+	return &GeoIP{reader: reader}, nil
+}
+
+// Country returns the upper case ISO code of the country of ip, or "" if it
+// is not in the database.
+func (g *GeoIP) Country(ip net.IP) string {
+	record := geoIPRecord{}
+	if err := g.reader.Lookup(ip, &record); err != nil {
+		return ""
+	}
+	// 没有国家信息时使用注册的国家, 如一些任播地址
+	if record.Country.ISOCode != "" {
+		return strings.ToUpper(record.Country.ISOCode)
+	}
+	return strings.ToUpper(record.RegisteredCountry.ISOCode)
+}
@@ -3,11 +3,17 @@ module github.com/MissGod1/PProxy
 go 1.14
 
 require (
-	github.com/eycorsican/go-tun2socks v1.16.9
+	github.com/eycorsican/go-tun2socks v1.16.9 // common/lwip 依赖此版本的 lwip 布局
 	github.com/google/gopacket v1.1.18
 	github.com/imgk/shadow v0.0.0-20200807110908-5ffdc22106cb
 	github.com/miekg/dns v1.1.31
+	github.com/oschwald/maxminddb-golang v1.6.0
 	github.com/pmezard/adblock v0.0.0-20171028110701-edfb97ad89cd
 	github.com/shadowsocks/go-shadowsocks2 v0.1.3
-	golang.org/x/net v0.0.0-20200707034311-ab3426394381
+	golang.org/x/crypto v0.13.0
+	golang.org/x/net v0.15.0
+	golang.org/x/sys v0.12.0
+	golang.zx2c4.com/wireguard v0.0.20200321-0.20200731141853-bc3f505efa9f
+	gvisor.dev/gvisor v0.0.0-20230927004350-cbd86285d259
+	lukechampine.com/blake3 v1.1.7
 )
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/eycorsican/go-tun2socks/common/log"
+)
+
+const (
+	DefaultCheckInterval = 30 * time.Second
+	DefaultCheckTimeout  = 5 * time.Second
+	DefaultCheckTarget   = "www.gstatic.com:80"
+	// 延迟相差不到这个值时不切换, 避免来回切换
+	DefaultTolerance = 10 * time.Millisecond
+)
+
+// Strategies of a group.
+const (
+	// StrategyFailover uses the first healthy outbound.
+	StrategyFailover = "failover"
+	// StrategyLatency uses the healthy outbound with the lowest RTT.
+	StrategyLatency = "latency"
+)
+
+type member struct {
+	*Outbound
+	// 只在checkloop中修改
+	healthy bool
+	// 检查耗时的平滑值
+	rtt time.Duration
+}
+
+// group checks its outbounds periodically and fails over to the first
+// healthy one, or switches to the fastest one. Connections that are
+// already open, UDP sessions included, stay on their outbound.
+type group struct {
+	name      string
+	members   []*member
+	latency   bool
+	tcp       bool
+	target    string
+	interval  time.Duration
+	timeout   time.Duration
+	tolerance time.Duration
+
+	current int32
+	// 所有成员都不正常, 只在checkloop中修改
+	down bool
+	done chan struct{}
+	once sync.Once
+}
+
+func newGroup(c *Group, names map[string]*Outbound) (*group, error) {
+	g := &group{
+		name:      c.Name,
+		target:    c.Target,
+		interval:  time.Duration(c.Interval) * time.Second,
+		timeout:   time.Duration(c.Timeout) * time.Second,
+		tolerance: time.Duration(c.Tolerance) * time.Millisecond,
+		done:      make(chan struct{}),
+	}
+	if len(c.Outbounds) == 0 {
+		return nil, fmt.Errorf("no outbound")
+	}
+	for _, name := range c.Outbounds {
+		out, ok := names[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown outbound %v", name)
+		}
+		// 检查之前认为都是正常的
+		g.members = append(g.members, &member{Outbound: out, healthy: true})
+	}
+	switch strings.ToLower(c.Strategy) {
+	case "", StrategyFailover:
+	case StrategyLatency:
+		g.latency = true
+	default:
+		return nil, fmt.Errorf("unknown strategy %v", c.Strategy)
+	}
+	switch strings.ToLower(c.Check) {
+	case "":
+	case "tcp":
+		g.tcp = true
+	default:
+		return nil, fmt.Errorf("unknown check %v", c.Check)
+	}
+	if g.target == "" {
+		g.target = DefaultCheckTarget
+	}
+	if g.interval <= 0 {
+		g.interval = DefaultCheckInterval
+	}
+	if g.timeout <= 0 {
+		g.timeout = DefaultCheckTimeout
+	}
+	if g.tolerance <= 0 {
+		g.tolerance = DefaultTolerance
+	}
+	return g, nil
+}
+
+// Current returns the outbound new connections use.
+func (g *group) Current() *Outbound {
+	return g.members[atomic.LoadInt32(&g.current)].Outbound
+}
+
+// Close stops checking.
+func (g *group) Close() {
+	g.once.Do(func() { close(g.done) })
+}
+
+func (g *group) checkloop() {
+	ticker := time.NewTicker(g.interval)
+	defer ticker.Stop()
+	for {
+		g.check()
+		select {
+		case <-ticker.C:
+		case <-g.done:
+			return
+		}
+	}
+}
+
+// check probes all members at once and selects the next outbound. If none
+// is healthy the current one is kept.
+func (g *group) check() {
+	errs := make([]error, len(g.members))
+	rtts := make([]time.Duration, len(g.members))
+	wg := sync.WaitGroup{}
+	for i, m := range g.members {
+		wg.Add(1)
+		go func(i int, m *member) {
+			defer wg.Done()
+			start := time.Now()
+			errs[i] = m.Check(g.tcp, g.latency, g.target, g.timeout)
+			rtts[i] = time.Since(start)
+		}(i, m)
+	}
+	wg.Wait()
+	g.update(errs, rtts)
+}
+
+// update records the results of a check, the errors and the time each
+// member took, and selects the next outbound.
+func (g *group) update(errs []error, rtts []time.Duration) {
+	for i, m := range g.members {
+		healthy := errs[i] == nil
+		if healthy != m.healthy {
+			if healthy {
+				log.Infof("group %v: outbound %v is up", g.name, m.Name)
+			} else {
+				log.Warnf("group %v: outbound %v is down: %v", g.name, m.Name, errs[i])
+			}
+			m.healthy = healthy
+			// 重新开始计算延迟
+			m.rtt = 0
+		}
+		if healthy {
+			if m.rtt == 0 {
+				m.rtt = rtts[i]
+			} else {
+				m.rtt = (m.rtt*3 + rtts[i]) / 4
+			}
+			log.Debugf("group %v: outbound %v rtt %v", g.name, m.Name, m.rtt)
+		}
+	}
+
+	current := int(atomic.LoadInt32(&g.current))
+	next := g.next(current)
+	if next < 0 {
+		if !g.down {
+			log.Errorf("group %v: no healthy outbound, keep %v", g.name, g.members[current].Name)
+			g.down = true
+		}
+		return
+	}
+	g.down = false
+	if next != current {
+		if g.latency {
+			log.Infof("group %v: switch from %v to %v, rtt %v", g.name, g.members[current].Name, g.members[next].Name, g.members[next].rtt)
+		} else {
+			log.Infof("group %v: switch from %v to %v", g.name, g.members[current].Name, g.members[next].Name)
+		}
+		atomic.StoreInt32(&g.current, int32(next))
+	}
+}
+
+// next returns the member new connections should use, or -1 if none is
+// healthy.
+func (g *group) next(current int) int {
+	next := -1
+	for i, m := range g.members {
+		if !m.healthy {
+			continue
+		}
+		if !g.latency {
+			return i
+		}
+		if next < 0 || m.rtt < g.members[next].rtt {
+			next = i
+		}
+	}
+	// 当前的服务器没有慢多少时不切换
+	if next >= 0 && g.latency && g.members[current].healthy &&
+		g.members[current].rtt <= g.members[next].rtt+g.tolerance {
+		return current
+	}
+	return next
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/eycorsican/go-tun2socks/common/log"
+	"github.com/eycorsican/go-tun2socks/common/log/simple"
+	"github.com/eycorsican/go-tun2socks/core"
+
+	"github.com/MissGod1/PProxy/proxy/dialer"
+)
+
+// fakeServer is an outbound whose check result is set by the test.
+type fakeServer struct {
+	*Outbound
+	down int32
+}
+
+func newFakeServer(name string) *fakeServer {
+	s := &fakeServer{}
+	s.Outbound = &Outbound{
+		Name: name,
+		Probe: func(target string, timeout time.Duration) error {
+			if atomic.LoadInt32(&s.down) != 0 {
+				return errors.New("no response")
+			}
+			return nil
+		},
+	}
+	return s
+}
+
+func (s *fakeServer) set(up bool) {
+	if up {
+		atomic.StoreInt32(&s.down, 0)
+	} else {
+		atomic.StoreInt32(&s.down, 1)
+	}
+}
+
+// recordLogger keeps the messages of the group.
+type recordLogger struct {
+	sync.Mutex
+	lines []string
+}
+
+func (l *recordLogger) add(msg string, args ...interface{}) {
+	l.Lock()
+	l.lines = append(l.lines, fmt.Sprintf(msg, args...))
+	l.Unlock()
+}
+
+// take returns the messages since the last call.
+func (l *recordLogger) take() []string {
+	l.Lock()
+	defer l.Unlock()
+	lines := l.lines
+	l.lines = nil
+	return lines
+}
+
+func (l *recordLogger) SetLevel(level log.LogLevel)            {}
+func (l *recordLogger) Debugf(msg string, args ...interface{}) {}
+func (l *recordLogger) Infof(msg string, args ...interface{})  { l.add(msg, args...) }
+func (l *recordLogger) Warnf(msg string, args ...interface{})  { l.add(msg, args...) }
+func (l *recordLogger) Errorf(msg string, args ...interface{}) { l.add(msg, args...) }
+func (l *recordLogger) Fatalf(msg string, args ...interface{}) { l.add(msg, args...) }
+
+func recordLog(t *testing.T) *recordLogger {
+	l := &recordLogger{}
+	log.RegisterLogger(l)
+	t.Cleanup(func() { log.RegisterLogger(simple.NewSimpleLogger()) })
+	return l
+}
+
+func newTestGroup(t *testing.T, c *Group, servers ...*fakeServer) *group {
+	names := make(map[string]*Outbound)
+	for _, s := range servers {
+		names[s.Name] = s.Outbound
+		c.Outbounds = append(c.Outbounds, s.Name)
+	}
+	g, err := newGroup(c, names)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return g
+}
+
+func TestGroupFailover(t *testing.T) {
+	logs := recordLog(t)
+	a, b, c := newFakeServer("a"), newFakeServer("b"), newFakeServer("c")
+	g := newTestGroup(t, &Group{Name: "g"}, a, b, c)
+
+	steps := []struct {
+		name    string
+		up      [3]bool
+		current string
+		logs    []string
+	}{
+		{"all up", [3]bool{true, true, true}, "a", nil},
+		{"a down", [3]bool{false, true, true}, "b", []string{
+			"group g: outbound a is down: no response",
+			"group g: switch from a to b",
+		}},
+		{"still down", [3]bool{false, true, true}, "b", nil},
+		{"b down", [3]bool{false, false, true}, "c", []string{
+			"group g: outbound b is down: no response",
+			"group g: switch from b to c",
+		}},
+		{"all down", [3]bool{false, false, false}, "c", []string{
+			"group g: outbound c is down: no response",
+			"group g: no healthy outbound, keep c",
+		}},
+		// 都不正常的状态只输出一次
+		{"still all down", [3]bool{false, false, false}, "c", nil},
+		{"b up", [3]bool{false, true, false}, "b", []string{
+			"group g: outbound b is up",
+			"group g: switch from c to b",
+		}},
+		// 恢复后回到第一个正常的服务器
+		{"a up", [3]bool{true, true, false}, "a", []string{
+			"group g: outbound a is up",
+			"group g: switch from b to a",
+		}},
+	}
+	for _, s := range steps {
+		a.set(s.up[0])
+		b.set(s.up[1])
+		c.set(s.up[2])
+		g.check()
+		if got := g.Current().Name; got != s.current {
+			t.Errorf("%v: current %v, want %v", s.name, got, s.current)
+		}
+		if got := logs.take(); strings.Join(got, "\n") != strings.Join(s.logs, "\n") {
+			t.Errorf("%v: logs\n%v\nwant\n%v", s.name, strings.Join(got, "\n"), strings.Join(s.logs, "\n"))
+		}
+	}
+}
+
+func TestGroupConfig(t *testing.T) {
+	a := newFakeServer("a")
+	names := map[string]*Outbound{"a": a.Outbound}
+	for _, c := range []*Group{
+		{Name: "g"},
+		{Name: "g", Outbounds: []string{"b"}},
+		{Name: "g", Outbounds: []string{"a"}, Strategy: "random"},
+		{Name: "g", Outbounds: []string{"a"}, Check: "icmp"},
+	} {
+		if _, err := newGroup(c, names); err == nil {
+			t.Errorf("%+v accepted", c)
+		}
+	}
+
+	g, err := newGroup(&Group{Name: "g", Outbounds: []string{"a"}, Strategy: "Latency", Check: "TCP"}, names)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !g.latency || !g.tcp || g.target != DefaultCheckTarget || g.interval != DefaultCheckInterval ||
+		g.timeout != DefaultCheckTimeout || g.tolerance != DefaultTolerance {
+		t.Fatalf("defaults are not applied: %+v", g)
+	}
+}
+
+// 延迟是平滑后的值, 状态变化后重新计算
+func TestGroupLatencySmoothing(t *testing.T) {
+	recordLog(t)
+	a, b := newFakeServer("a"), newFakeServer("b")
+	g := newTestGroup(t, &Group{Name: "g", Strategy: StrategyLatency}, a, b)
+	ms := time.Millisecond
+
+	g.update(make([]error, 2), []time.Duration{40 * ms, 100 * ms})
+	if g.members[0].rtt != 40*ms || g.members[1].rtt != 100*ms {
+		t.Fatalf("first rtt %v %v", g.members[0].rtt, g.members[1].rtt)
+	}
+	g.update(make([]error, 2), []time.Duration{80 * ms, 20 * ms})
+	if g.members[0].rtt != 50*ms || g.members[1].rtt != 80*ms {
+		t.Fatalf("smoothed rtt %v %v", g.members[0].rtt, g.members[1].rtt)
+	}
+	if g.Current().Name != "a" {
+		t.Fatalf("current %v", g.Current().Name)
+	}
+
+	g.update([]error{errors.New("down"), nil}, []time.Duration{time.Second, 20 * ms})
+	if g.Current().Name != "b" {
+		t.Fatalf("current %v after a is down", g.Current().Name)
+	}
+	// a恢复后的延迟不和之前的值平滑
+	g.update(make([]error, 2), []time.Duration{10 * ms, 100 * ms})
+	if g.members[0].rtt != 10*ms {
+		t.Fatalf("rtt %v after a is up", g.members[0].rtt)
+	}
+	if g.Current().Name != "a" {
+		t.Fatalf("current %v, b is %v", g.Current().Name, g.members[1].rtt)
+	}
+}
+
+// 延迟低不到tolerance时不切换
+func TestGroupLatencyTolerance(t *testing.T) {
+	a, b, c := newFakeServer("a"), newFakeServer("b"), newFakeServer("c")
+	g := newTestGroup(t, &Group{Name: "g", Strategy: StrategyLatency, Tolerance: 10}, a, b, c)
+	ms := time.Millisecond
+
+	cases := []struct {
+		current int
+		rtts    [3]time.Duration
+		healthy [3]bool
+		next    int
+	}{
+		{0, [3]time.Duration{50 * ms, 45 * ms, 60 * ms}, [3]bool{true, true, true}, 0},
+		{0, [3]time.Duration{50 * ms, 40 * ms, 60 * ms}, [3]bool{true, true, true}, 0},
+		{0, [3]time.Duration{50 * ms, 39 * ms, 60 * ms}, [3]bool{true, true, true}, 1},
+		// 切换到最快的, 不是第一个更快的
+		{0, [3]time.Duration{50 * ms, 30 * ms, 20 * ms}, [3]bool{true, true, true}, 2},
+		// 当前的不正常时不管tolerance
+		{0, [3]time.Duration{50 * ms, 45 * ms, 60 * ms}, [3]bool{false, true, true}, 1},
+		{1, [3]time.Duration{10 * ms, 45 * ms, 60 * ms}, [3]bool{false, false, false}, -1},
+	}
+	for i, c := range cases {
+		for j, m := range g.members {
+			m.rtt, m.healthy = c.rtts[j], c.healthy[j]
+		}
+		if next := g.next(c.current); next != c.next {
+			t.Errorf("case %v: next %v, want %v", i, next, c.next)
+		}
+	}
+}
+
+// fakeUDPHandler records which outbound the datagrams are sent to.
+type fakeUDPHandler struct {
+	name string
+	got  chan string
+}
+
+func (h *fakeUDPHandler) Connect(conn core.UDPConn, target *net.UDPAddr) error { return nil }
+
+func (h *fakeUDPHandler) ReceiveTo(conn core.UDPConn, data []byte, addr *net.UDPAddr) error {
+	h.got <- h.name
+	return nil
+}
+
+type fakeStackConn struct {
+	port int
+}
+
+func (c *fakeStackConn) LocalAddr() *net.UDPAddr {
+	return &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: c.port}
+}
+func (c *fakeStackConn) ReceiveTo(data []byte, addr *net.UDPAddr) error        { return nil }
+func (c *fakeStackConn) WriteFrom(data []byte, addr *net.UDPAddr) (int, error) { return len(data), nil }
+func (c *fakeStackConn) Close() error                                          { return nil }
+
+// 组切换后已有的UDP会话继续使用原来的服务器
+func TestGroupUDPPinning(t *testing.T) {
+	recordLog(t)
+	got := make(chan string, 1)
+	a, b := newFakeServer("a"), newFakeServer("b")
+	a.UDP = &fakeUDPHandler{"a", got}
+	b.UDP = &fakeUDPHandler{"b", got}
+	g := newTestGroup(t, &Group{Name: "g", Strategy: StrategyLatency}, a, b)
+	o := &Outbounds{
+		names:  map[string]*Outbound{"a": a.Outbound, "b": b.Outbound},
+		groups: map[string]*group{"g": g},
+		udp:    make(map[core.UDPConn]*udpConn),
+		def:    "g",
+	}
+	ms := time.Millisecond
+	target := &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 27015}
+	send := func(conn core.UDPConn) string {
+		if err := o.ReceiveTo(conn, []byte("ping"), target); err != nil {
+			t.Fatal(err)
+		}
+		return <-got
+	}
+
+	g.update(make([]error, 2), []time.Duration{20 * ms, 100 * ms})
+	old := &fakeStackConn{50000}
+	if err := o.Connect(old, target); err != nil {
+		t.Fatal(err)
+	}
+	if name := send(old); name != "a" {
+		t.Fatalf("session uses %v", name)
+	}
+
+	g.update([]error{errors.New("down"), nil}, []time.Duration{time.Second, 100 * ms})
+	if name := send(old); name != "a" {
+		t.Fatalf("session moved to %v after the switch", name)
+	}
+	conn := &fakeStackConn{50001}
+	if err := o.Connect(conn, target); err != nil {
+		t.Fatal(err)
+	}
+	if name := send(conn); name != "b" {
+		t.Fatalf("new session uses %v", name)
+	}
+
+	// 会话关闭后从表中删除
+	o.udp[old].Close()
+	if err := o.ReceiveTo(old, []byte("ping"), target); err == nil {
+		t.Fatal("closed session is still connected")
+	}
+}
+
+// failover用服务器类型的检查, latency通过Dialer等待应答的第一个字节
+func TestOutboundCheck(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	requests := make(chan struct{}, 4)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			b := make([]byte, 512)
+			if n, _ := c.Read(b); n > 0 {
+				requests <- struct{}{}
+				c.Write([]byte("HTTP/1.1 204 No Content\r\n\r\n"))
+			}
+			c.Close()
+		}
+	}()
+
+	probes := 0
+	out := &Outbound{
+		Probe: func(target string, timeout time.Duration) error {
+			probes++
+			return nil
+		},
+		Dialer: dialer.Direct,
+	}
+	target := l.Addr().String()
+	if err := out.Check(false, false, target, time.Second); err != nil || probes != 1 {
+		t.Fatalf("failover check: %v, %v probes", err, probes)
+	}
+	if err := out.Check(false, true, target, time.Second); err != nil || probes != 1 {
+		t.Fatalf("latency check: %v, %v probes", err, probes)
+	}
+	select {
+	case <-requests:
+	case <-time.After(time.Second):
+		t.Fatal("latency check sent no request")
+	}
+
+	// 没有Probe时通过Dialer连接目标
+	out = &Outbound{Dialer: dialer.Direct}
+	if err := out.Check(false, false, target, time.Second); err != nil {
+		t.Fatal(err)
+	}
+}
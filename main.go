@@ -1,10 +1,15 @@
 package main
 
 import (
+	"crypto/tls"
 	"encoding/json"
 	"flag"
+	"fmt"
 	"github.com/MissGod1/PProxy/common/dns"
 	"github.com/MissGod1/PProxy/common/dns/fakedns"
+	stack "github.com/MissGod1/PProxy/common/lwip"
+	"github.com/MissGod1/PProxy/device"
+	"github.com/MissGod1/PProxy/proxy/dialer"
 	"github.com/eycorsican/go-tun2socks/common/log"
 	_ "github.com/eycorsican/go-tun2socks/common/log/simple"
 	"github.com/eycorsican/go-tun2socks/core"
@@ -13,70 +18,193 @@ import (
 	"os/signal"
 	"strings"
 	"syscall"
+	"time"
 
-	"github.com/MissGod1/PProxy/common"
 )
 
 // 服务配置
 type Server struct {
+	// 规则中用名字选择服务器
+	Name       string `json:"name"`
 	Type       string `json:"type"`
 	Server     string `json:"server"`
 	ServerPort uint16 `json:"server_port"`
+	Username   string `json:"username"` // socks5的用户名, 密码也用password
 	Password   string `json:"password"`
 	Method     string `json:"method"`
 
+	// 允许不安全的流加密方式, 如aes-256-cfb
+	LegacyCipher bool `json:"legacy_cipher"`
+
 	Plugin     string `json:"plugin"`
 	PluginOpts string `json:"plugin_opts"`
+
+	// wireguard的密钥是base64编码, address是本端在隧道中的地址, dns是隧道中的DNS服务器,
+	// listen_port是本端的UDP端口, 默认随机
+	PrivateKey   string `json:"private_key"`
+	PublicKey    string `json:"public_key"`
+	PresharedKey string `json:"preshared_key"`
+	Address      string `json:"address"`
+	DNS          string `json:"dns"`
+	MTU          int    `json:"mtu"`
+	ListenPort   uint16 `json:"listen_port"`
+
+	// 连接服务器时使用TLS, sni默认是服务器地址
+	TLS      bool   `json:"tls"`
+	SNI      string `json:"sni"`
+	Insecure bool   `json:"insecure"`
+
+	// 通过这个名字的服务器连接本服务器
+	Via string `json:"via"`
+	// UDP使用这个名字的服务器, 用于不支持UDP的服务器
+	UDPFallback string `json:"udp_fallback"`
+}
+
+// TLSConfig returns the TLS config for connecting to the server.
+func (s *Server) TLSConfig() *tls.Config {
+	sni := s.SNI
+	if sni == "" {
+		sni = s.Server
+	}
+	return &tls.Config{
+		ServerName:         sni,
+		InsecureSkipVerify: s.Insecure,
+	}
+}
+
+// 服务器组, 定时检查成员并选择新连接使用的服务器
+type Group struct {
+	Name      string   `json:"name"`
+	Outbounds []string `json:"outbounds"`
+	// "failover"使用第一个正常的服务器, "latency"使用延迟最低的服务器
+	Strategy string `json:"strategy"`
+	// 检查方式, 默认按服务器类型检查, "tcp"只检查能否连接
+	Check string `json:"check"`
+	// 通过代理访问的检查目标
+	Target string `json:"target"`
+	// 秒
+	Interval int `json:"interval"`
+	Timeout  int `json:"timeout"`
+	// 毫秒, latency时延迟低这么多才切换
+	Tolerance int `json:"tolerance"`
+}
+
+// 多个服务器的配置
+type Servers struct {
+	Outbounds []*Server `json:"outbounds"`
+	Groups    []*Group  `json:"groups"`
+	// 没有指定outbound的流量使用的服务器或组, 默认是第一个服务器
+	Default string `json:"default"`
 }
 
 // 进程配置
 type Process struct {
-	Processes []string `json:"processes"`
-	Whitelist []string `json:"whitelist"`
+	// 按顺序匹配的规则, processes和whitelist是排在最后的代理规则
+	Rules     []Rule        `json:"rules"`
+	Processes []ProcessRule `json:"processes"`
+	Whitelist []string      `json:"whitelist"`
+	// include代理processes中的进程, exclude代理processes以外的所有进程
+	Mode string `json:"mode"`
+	// 规则中geoip使用的MaxMind数据库
+	GeoIPDB string `json:"geoip_db"`
+	// 进程名和路径不区分大小写
+	IgnoreCase bool `json:"ignore_case"`
+	// 匹配进程启动的子进程也走代理
+	Children bool `json:"children"`
+
+	// 会话超时(秒), 0使用默认值
+	UDPTimeout int `json:"udp_timeout"`
+	TCPTimeout int `json:"tcp_timeout"`
+
+	Tun Tun `json:"tun"`
+}
+
+// TUN设备配置, 只在Linux下使用
+type Tun struct {
+	Name     string   `json:"name"`
+	Address  string   `json:"address"`
+	Address6 string   `json:"address6"`
+	Routes   []string `json:"routes"`
 }
 
-var server *Server
 var process *Process
-var plugin *common.Plugin
 var fakeDns dns.FakeDns
 
-var createrhandler = make(map[string]func())
+// 是否输出debug日志, 用来跳过热路径上的格式化
+var debug bool
+
+// forward为nil时直接连接服务器
+var createrhandler = make(map[string]func(s *Server, forward dialer.Dialer) (*Outbound, error))
 
-func RegisterHandler(key string, creater func()) {
+func RegisterHandler(key string, creater func(s *Server, forward dialer.Dialer) (*Outbound, error)) {
 	createrhandler[key] = creater
 }
 
-func GetServer(file string) *Server {
+// GetServers reads the server config file. It is either one server or a
+// list of named servers in outbounds.
+func GetServers(file string) *Servers {
 	data, err := ioutil.ReadFile(file)
 	if err != nil {
 		panic("Open Server Configure File Error!")
 	}
+	c := &Servers{}
+	err = json.Unmarshal(data, c)
+	if err != nil {
+		panic("Server Configure File Have some issue!")
+	}
+	if len(c.Outbounds) > 0 {
+		for i, s := range c.Outbounds {
+			if s.Name == "" {
+				log.Fatalf("outbound %v has no name", i+1)
+			}
+		}
+		return c
+	}
+
 	s := Server{}
 	err = json.Unmarshal(data, &s)
 	if err != nil {
 		panic("Server Configure File Have some issue!")
 	}
-	return &s
+	if s.Name == "" {
+		s.Name = DefaultOutbound
+	}
+	return &Servers{Outbounds: []*Server{&s}}
 }
 
 func GetProcess(file string) *Process {
+	p, err := LoadProcess(file)
+	if err != nil {
+		panic(err)
+	}
+	return p
+}
+
+// LoadProcess reads the process config file.
+func LoadProcess(file string) (*Process, error) {
 	data, err := ioutil.ReadFile(file)
 	if err != nil {
-		panic("Open Server Configure File Error!")
+		return nil, fmt.Errorf("open process config file error: %v", err)
 	}
 
 	p := Process{}
 	err = json.Unmarshal(data, &p)
 	if err != nil {
-		panic("Server Configure File Have some issue!")
+		return nil, fmt.Errorf("process config file %v error: %v", file, err)
 	}
-	return &p
+	return &p, nil
 }
 
 func main() {
 	sconfig := flag.String("sconfig", "", "server configure file")
 	pconfig := flag.String("pconfig", "", "process configure file")
 	logLevel := flag.String("log", "info", "log level")
+	replay := flag.String("replay", "", "replay outbound packets from pcap file instead of capturing")
+	record := flag.String("record", "", "record packets written by the stack to pcap file, used with -replay")
+	pace := flag.Bool("pace", false, "replay packets with the timing of the capture")
+	events := flag.String("events", "", "socket events of the replay as JSON lines, used with -replay")
+	linger := flag.Duration("linger", 3*time.Second, "time to wait for the stack after the replay ends")
+	api := flag.String("api", "", "serve the session table as JSON on this address, e.g. 127.0.0.1:9090")
 
 	flag.Parse()
 	if *sconfig == "" || *pconfig == "" {
@@ -88,6 +216,7 @@ func main() {
 		log.SetLevel(log.INFO)
 	case "debug":
 		log.SetLevel(log.DEBUG)
+		debug = true
 	case "warn":
 		log.SetLevel(log.WARN)
 	case "none":
@@ -98,27 +227,55 @@ func main() {
 		log.SetLevel(log.INFO)
 	}
 
-	server = GetServer(*sconfig)
+	servers := GetServers(*sconfig)
 	process = GetProcess(*pconfig)
-	fakeDns = fakedns.NewSimpleFakeDns()
-	if creater, found := createrhandler[server.Type]; found {
-		creater()
+	dnsRules := &ruleFakeDns{FakeDns: fakedns.NewSimpleFakeDns()}
+	fakeDns = dnsRules
+	outbounds, err := NewOutbounds(servers)
+	if err != nil {
+		log.Fatalf("create outbounds failed: %v", err)
+	}
+	var dev device.Device
+	if *replay != "" {
+		dev, err = OpenReplay(*replay, *record, *events, *pace)
 	} else {
-		panic("Unsupported proxy type.")
+		dev, err = OpenDevice(servers.Outbounds, process)
 	}
-	app, err := NewApp(server, process)
 	if err != nil {
-		panic("App Run Failed.")
+		log.Fatalf("open capture device failed: %v", err)
+	}
+	app, err := NewApp(dev, process, outbounds)
+	if err != nil {
+		log.Fatalf("app run failed: %v", err)
+	}
+	dnsRules.app = app
+	core.RegisterTCPConnHandler(outbounds)
+	core.RegisterUDPConnHandler(outbounds)
+	if *replay == "" {
+		WatchProcess(*pconfig, app, DefaultWatchInterval)
+	}
+	if *api != "" {
+		ServeAPI(*api, app)
 	}
 	core.RegisterOutputFn(app.Write)
 	lwip := core.NewLWIPStack()
-	_, _ = app.WriteTo(lwip)
+	if err := stack.EnableIPv6UDP(); err != nil {
+		log.Warnf("ipv6 udp is not available: %v", err)
+	}
+	_, err = app.WriteTo(lwip)
+	if *replay != "" {
+		log.Infof("replay finished: %v", err)
+		time.Sleep(*linger)
+		passed, diverted, recorded := dev.(*ReplayDevice).Stats()
+		log.Infof("packets passed: %v, diverted: %v, recorded: %v", passed, diverted, recorded)
+		outbounds.Close()
+		app.Close()
+		return
+	}
 
 	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
 	<-sigCh
-	if plugin != nil {
-		plugin.KillPlugin()
-	}
+	outbounds.Close()
 	app.Close()
 }
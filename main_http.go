@@ -0,0 +1,30 @@
+package main
+
+import (
+	"crypto/tls"
+	"github.com/MissGod1/PProxy/proxy/dialer"
+	"github.com/MissGod1/PProxy/proxy/http"
+	"golang.org/x/net/proxy"
+	"time"
+)
+
+func init()  {
+	RegisterHandler("http", func(s *Server, forward dialer.Dialer) (*Outbound, error) {
+		var auth *proxy.Auth
+		if s.Username != "" {
+			auth = &proxy.Auth{User: s.Username, Password: s.Password}
+		}
+		var tlsConfig *tls.Config
+		if s.TLS {
+			tlsConfig = s.TLSConfig()
+		}
+
+		d := http.NewDialer(s.Server, s.ServerPort, auth, tlsConfig, forward)
+		return &Outbound{
+			TCP: dialer.NewTCPHandler(d, fakeDns),
+			// 只处理DNS查询, 其他UDP用udp_fallback
+			UDP: dialer.NewUDPHandler(d, 5*time.Second, fakeDns),
+			Dialer: d,
+		}, nil
+	})
+}
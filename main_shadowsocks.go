@@ -1,31 +1,48 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"github.com/MissGod1/PProxy/common"
+	"github.com/MissGod1/PProxy/proxy/dialer"
 	"github.com/MissGod1/PProxy/proxy/shadowsocks"
-	"github.com/eycorsican/go-tun2socks/common/log"
-	"github.com/eycorsican/go-tun2socks/core"
+	"net"
+	"strconv"
 	"time"
 )
 
 func init()  {
-	RegisterHandler("shadowsocks", func() {
-		//_, err := net.ResolveIPAddr("tcp", server.Server)
-		//if err != nil {
-		//	log.Fatalf("invalid proxy server address: %v", err)
-		//}
-		if server.Plugin != "" {
-			plugin = common.NewPlugin()
-			localAddr, err := plugin.StartPlugin(server.Plugin, server.PluginOpts, fmt.Sprintf("%v:%v", server.Server, server.ServerPort), false)
+	RegisterHandler("shadowsocks", func(s *Server, forward dialer.Dialer) (*Outbound, error) {
+		out := &Outbound{}
+		addr := net.JoinHostPort(s.Server, strconv.Itoa(int(s.ServerPort)))
+		ciph, err := shadowsocks.PickCipher(s.Method, s.Password, s.LegacyCipher)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cipher: %v", err)
+		}
+		if s.Plugin != "" {
+			// 插件自己连接服务器
+			if forward != nil {
+				return nil, errors.New("plugin can not be used with via")
+			}
+			out.plugin = common.NewPlugin()
+			localAddr, err := out.plugin.StartPlugin(s.Plugin, s.PluginOpts, fmt.Sprintf("%v:%v", s.Server, s.ServerPort), false)
 			if err != nil {
-				log.Fatalf("start plugin failed.")
+				return nil, fmt.Errorf("start plugin failed: %v", err)
+			}
+			out.TCP = shadowsocks.NewTCPHandler(localAddr, ciph, fakeDns, nil)
+			out.Probe = func(target string, timeout time.Duration) error {
+				return shadowsocks.Probe(localAddr, ciph, nil, target, timeout)
+			}
+			out.Dialer = shadowsocks.NewDialer(localAddr, ciph, nil)
+		} else {
+			out.TCP = shadowsocks.NewTCPHandler(addr, ciph, fakeDns, forward)
+			out.Probe = func(target string, timeout time.Duration) error {
+				return shadowsocks.Probe(addr, ciph, forward, target, timeout)
 			}
-			core.RegisterTCPConnHandler(shadowsocks.NewTCPHandler(localAddr, server.Method, server.Password, fakeDns))
-		}else {
-			core.RegisterTCPConnHandler(shadowsocks.NewTCPHandler(core.ParseTCPAddr(server.Server, server.ServerPort).String(), server.Method, server.Password, fakeDns))
+			out.Dialer = shadowsocks.NewDialer(addr, ciph, forward)
 		}
 
-		core.RegisterUDPConnHandler(shadowsocks.NewUDPHandler(core.ParseUDPAddr(server.Server, server.ServerPort).String(), server.Method, server.Password, 1*time.Second, fakeDns))
+		out.UDP = shadowsocks.NewUDPHandler(addr, ciph, 1*time.Second, fakeDns, forward)
+		return out, nil
 	})
-}
\ No newline at end of file
+}
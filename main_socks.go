@@ -2,24 +2,36 @@ package main
 
 import (
 	"fmt"
+	"github.com/MissGod1/PProxy/proxy/dialer"
 	"github.com/MissGod1/PProxy/proxy/socks"
-	"github.com/eycorsican/go-tun2socks/common/log"
-	"github.com/eycorsican/go-tun2socks/core"
+	"golang.org/x/net/proxy"
 	"net"
 	"time"
 )
 
 func init()  {
-	RegisterHandler("socks5", func() {
-		// Verify proxy server address.
-		_, err := net.ResolveTCPAddr("tcp",fmt.Sprintf("%v:%v", server.Server, server.ServerPort))
-		if err != nil {
-			log.Fatalf("invalid proxy server address: %v", err)
+	RegisterHandler("socks5", func(s *Server, forward dialer.Dialer) (*Outbound, error) {
+		// Verify proxy server address, it is resolved by the previous hop when chained.
+		if forward == nil {
+			_, err := net.ResolveTCPAddr("tcp",fmt.Sprintf("%v:%v", s.Server, s.ServerPort))
+			if err != nil {
+				return nil, fmt.Errorf("invalid proxy server address: %v", err)
+			}
 		}
-		//proxyHost := proxyAddr.IP.String()
-		//proxyPort := uint16(proxyAddr.Port)
 
-		core.RegisterTCPConnHandler(socks.NewTCPHandler(server.Server, server.ServerPort, fakeDns))
-		core.RegisterUDPConnHandler(socks.NewUDPHandler(server.Server, server.ServerPort, 1*time.Second, fakeDns))
+		// 配置了用户名时使用用户名/密码认证
+		var auth *proxy.Auth
+		if s.Username != "" {
+			auth = &proxy.Auth{User: s.Username, Password: s.Password}
+		}
+
+		return &Outbound{
+			TCP: socks.NewTCPHandler(s.Server, s.ServerPort, auth, fakeDns, forward),
+			UDP: socks.NewUDPHandler(s.Server, s.ServerPort, auth, 1*time.Second, fakeDns, forward),
+			Probe: func(target string, timeout time.Duration) error {
+				return socks.Probe(s.Server, s.ServerPort, auth, forward, timeout)
+			},
+			Dialer: socks.NewDialer(s.Server, s.ServerPort, auth, forward),
+		}, nil
 	})
 }
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"fmt"
+	"github.com/MissGod1/PProxy/proxy/dialer"
+	"github.com/MissGod1/PProxy/proxy/socks"
+	"net"
+	"time"
+)
+
+func init()  {
+	RegisterHandler("socks4", func(s *Server, forward dialer.Dialer) (*Outbound, error) {
+		// Verify proxy server address, it is resolved by the previous hop when chained.
+		if forward == nil {
+			_, err := net.ResolveTCPAddr("tcp",fmt.Sprintf("%v:%v", s.Server, s.ServerPort))
+			if err != nil {
+				return nil, fmt.Errorf("invalid proxy server address: %v", err)
+			}
+		}
+
+		// socks4只有用户ID, 没有密码
+		d := socks.NewSOCKS4Dialer(s.Server, s.ServerPort, s.Username, forward)
+		return &Outbound{
+			TCP: dialer.NewTCPHandler(d, fakeDns),
+			// 只处理DNS查询, 其他UDP用udp_fallback
+			UDP: dialer.NewUDPHandler(d, 5*time.Second, fakeDns),
+			Dialer: d,
+		}, nil
+	})
+}
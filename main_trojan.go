@@ -0,0 +1,19 @@
+package main
+
+import (
+	"github.com/MissGod1/PProxy/proxy/dialer"
+	"github.com/MissGod1/PProxy/proxy/trojan"
+	"time"
+)
+
+func init()  {
+	RegisterHandler("trojan", func(s *Server, forward dialer.Dialer) (*Outbound, error) {
+		// trojan总是使用TLS
+		d := trojan.NewDialer(s.Server, s.ServerPort, s.Password, s.TLSConfig(), forward)
+		return &Outbound{
+			TCP: dialer.NewTCPHandler(d, fakeDns),
+			UDP: dialer.NewUDPHandler(d, 5*time.Second, fakeDns),
+			Dialer: d,
+		}, nil
+	})
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"errors"
+	"github.com/MissGod1/PProxy/proxy/dialer"
+	"github.com/MissGod1/PProxy/proxy/wireguard"
+	"net"
+	"strconv"
+	"time"
+)
+
+func init()  {
+	RegisterHandler("wireguard", func(s *Server, forward dialer.Dialer) (*Outbound, error) {
+		// WireGuard自己发送UDP到对端
+		if forward != nil {
+			return nil, errors.New("wireguard can not be used with via")
+		}
+		addr := net.ParseIP(s.Address)
+		if addr == nil {
+			return nil, errors.New("invalid address " + s.Address)
+		}
+		var dns net.IP
+		if s.DNS != "" {
+			if dns = net.ParseIP(s.DNS); dns == nil {
+				return nil, errors.New("invalid dns " + s.DNS)
+			}
+		}
+		d, err := wireguard.NewDevice(&wireguard.Config{
+			PrivateKey:   s.PrivateKey,
+			PublicKey:    s.PublicKey,
+			PresharedKey: s.PresharedKey,
+			Endpoint:     net.JoinHostPort(s.Server, strconv.Itoa(int(s.ServerPort))),
+			Address:      addr,
+			DNS:          dns,
+			MTU:          s.MTU,
+			ListenPort:   s.ListenPort,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return &Outbound{
+			TCP:    dialer.NewTCPHandler(d, fakeDns),
+			UDP:    dialer.NewUDPHandler(d, 5*time.Second, fakeDns),
+			Dialer: d,
+			closer: d,
+		}, nil
+	})
+}
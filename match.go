@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// ProcessRule selects processes. An entry of `processes` is either a
+// string, which is the Name pattern, or an object with these fields. All
+// given patterns must match.
+//
+// A pattern starting with "re:" is a regular expression, a pattern with
+// '*', '?' or '[' is a glob where '*' does not cross a path separator and
+// '**' does, anything else is compared literally. Name patterns containing
+// a path separator, or '/' for regular expressions, match the full
+// executable path instead of the name.
+// Paths are compared with '/' as the separator on all platforms.
+type ProcessRule struct {
+	Name string `json:"name"`
+	// Cmdline matches the command line. A literal only needs to be part of
+	// it.
+	Cmdline    string `json:"cmdline"`
+	IgnoreCase bool   `json:"ignore_case"`
+}
+
+func (r *ProcessRule) UnmarshalJSON(b []byte) error {
+	if len(b) > 0 && b[0] == '"' {
+		*r = ProcessRule{}
+		return json.Unmarshal(b, &r.Name)
+	}
+	type rule ProcessRule
+	return json.Unmarshal(b, (*rule)(r))
+}
+
+type pattern interface {
+	match(s string) bool
+}
+
+type literal struct {
+	s        string
+	fold     bool
+	contains bool
+}
+
+func (p *literal) match(s string) bool {
+	if p.fold {
+		s = strings.ToLower(s)
+	}
+	if p.contains {
+		return strings.Contains(s, p.s)
+	}
+	return s == p.s
+}
+
+type regex struct {
+	*regexp.Regexp
+}
+
+func (p regex) match(s string) bool {
+	return p.MatchString(s)
+}
+
+type processRule struct {
+	name    pattern
+	path    pattern
+	cmdline pattern
+}
+
+// ProcessMatcher decides which processes are proxied.
+type ProcessMatcher struct {
+	// 只有名字的规则直接查表
+	names     map[string]bool
+	foldNames map[string]bool
+	rules     []processRule
+}
+
+func NewProcessMatcher(rules []ProcessRule, ignoreCase bool) (*ProcessMatcher, error) {
+	m := &ProcessMatcher{
+		names:     make(map[string]bool),
+		foldNames: make(map[string]bool),
+	}
+	for _, r := range rules {
+		fold := ignoreCase || r.IgnoreCase
+		if r.Name == "" && r.Cmdline == "" {
+			return nil, fmt.Errorf("empty process rule")
+		}
+		if r.Cmdline == "" && !isPath(r.Name) && !isPattern(r.Name) {
+			if fold {
+				m.foldNames[strings.ToLower(r.Name)] = true
+			} else {
+				m.names[r.Name] = true
+			}
+			continue
+		}
+
+		rule := processRule{}
+		if r.Name != "" {
+			p, err := compilePattern(r.Name, fold, false)
+			if err != nil {
+				return nil, fmt.Errorf("process rule %v error: %v", r.Name, err)
+			}
+			if isPath(r.Name) {
+				rule.path = p
+			} else {
+				rule.name = p
+			}
+		}
+		if r.Cmdline != "" {
+			p, err := compilePattern(r.Cmdline, fold, true)
+			if err != nil {
+				return nil, fmt.Errorf("process rule %v error: %v", r.Cmdline, err)
+			}
+			rule.cmdline = p
+		}
+		m.rules = append(m.rules, rule)
+	}
+	return m, nil
+}
+
+// Match reports whether the process is selected by any rule.
+func (m *ProcessMatcher) Match(p *Proc) bool {
+	if m.names[p.Name] || m.foldNames[strings.ToLower(p.Name)] {
+		return true
+	}
+	path := strings.ReplaceAll(p.Path, `\`, "/")
+	for _, r := range m.rules {
+		if r.name != nil && !r.name.match(p.Name) {
+			continue
+		}
+		if r.path != nil && !r.path.match(path) {
+			continue
+		}
+		if r.cmdline != nil && !r.cmdline.match(p.Cmdline) {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+func isPath(s string) bool {
+	// 正则表达式中的'\'是转义
+	if strings.HasPrefix(s, "re:") {
+		return strings.Contains(s, "/")
+	}
+	return strings.ContainsAny(s, `/\`)
+}
+
+func isPattern(s string) bool {
+	return strings.HasPrefix(s, "re:") || strings.ContainsAny(s, "*?[")
+}
+
+// compilePattern compiles a pattern for executable names and paths, or for
+// the command line, where globs match across '/' and literals only need to
+// be contained.
+func compilePattern(s string, fold, cmdline bool) (pattern, error) {
+	var expr string
+	switch {
+	case strings.HasPrefix(s, "re:"):
+		expr = s[3:]
+	case strings.ContainsAny(s, "*?["):
+		if !cmdline {
+			s = strings.ReplaceAll(s, `\`, "/")
+		}
+		expr = globToRegexp(s, !cmdline)
+	default:
+		if !cmdline {
+			s = strings.ReplaceAll(s, `\`, "/")
+		}
+		if fold {
+			s = strings.ToLower(s)
+		}
+		return &literal{s: s, fold: fold, contains: cmdline}, nil
+	}
+	if fold {
+		expr = "(?i)" + expr
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, err
+	}
+	return regex{re}, nil
+}
+
+// globToRegexp translates a glob into an anchored regular expression. With
+// sep, '*' and '?' do not match '/'.
+func globToRegexp(glob string, sep bool) string {
+	one := "."
+	if sep {
+		one = "[^/]"
+	}
+
+	var b strings.Builder
+	b.WriteByte('^')
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			if i+1 < len(glob) && glob[i+1] == '*' {
+				b.WriteString(".*")
+				i++
+			} else {
+				b.WriteString(one + "*")
+			}
+		case '?':
+			b.WriteString(one)
+		case '[':
+			j := strings.IndexByte(glob[i+1:], ']')
+			if j < 0 {
+				b.WriteString(`\[`)
+				continue
+			}
+			class := glob[i+1 : i+1+j]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + class + "]")
+			i += j + 1
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteByte('$')
+	return b.String()
+}
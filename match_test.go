@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestGlobToRegexp(t *testing.T) {
+	cases := []struct {
+		glob string
+		sep  bool
+		want string
+	}{
+		{"*.exe", true, `^[^/]*\.exe$`},
+		{"*.exe", false, `^.*\.exe$`},
+		{"a?c", true, `^a[^/]c$`},
+		{"**/game/*", true, `^.*/game/[^/]*$`},
+		{"[abc]x", true, `^[abc]x$`},
+		{"[!abc]x", true, `^[^abc]x$`},
+		{"[x", true, `^\[x$`},
+		{"a+b(c).exe", true, `^a\+b\(c\)\.exe$`},
+	}
+	for _, c := range cases {
+		if got := globToRegexp(c.glob, c.sep); got != c.want {
+			t.Errorf("globToRegexp(%q, %v) = %q, want %q", c.glob, c.sep, got, c.want)
+		}
+	}
+}
+
+func TestProcessMatcher(t *testing.T) {
+	game := &Proc{
+		Name:    "Game.exe",
+		Path:    `C:\Games\Steam\steamapps\common\Game\Game.exe`,
+		Cmdline: `"C:\Games\Game.exe" -server eu --port=27015`,
+	}
+	cases := []struct {
+		rule       ProcessRule
+		ignoreCase bool
+		want       bool
+	}{
+		// 名字
+		{ProcessRule{Name: "Game.exe"}, false, true},
+		{ProcessRule{Name: "game.exe"}, false, false},
+		{ProcessRule{Name: "game.exe"}, true, true},
+		{ProcessRule{Name: "game.exe", IgnoreCase: true}, false, true},
+		{ProcessRule{Name: "Game"}, false, false},
+		// 名字的glob是锚定的, 不匹配路径
+		{ProcessRule{Name: "G*.exe"}, false, true},
+		{ProcessRule{Name: "g*.exe"}, false, false},
+		{ProcessRule{Name: "g*.exe"}, true, true},
+		{ProcessRule{Name: "Gam?.exe"}, false, true},
+		{ProcessRule{Name: "G?.exe"}, false, false},
+		{ProcessRule{Name: "[FG]ame.exe"}, false, true},
+		{ProcessRule{Name: "[!G]ame.exe"}, false, false},
+		{ProcessRule{Name: "*ame"}, false, false},
+		// 路径用'/'或'\'都可以, '*'不跨目录, '**'跨目录
+		{ProcessRule{Name: `C:\Games\Steam\steamapps\common\Game\Game.exe`}, false, true},
+		{ProcessRule{Name: "C:/Games/Steam/steamapps/common/Game/Game.exe"}, false, true},
+		{ProcessRule{Name: "c:/games/steam/steamapps/common/game/game.exe"}, true, true},
+		{ProcessRule{Name: "C:/Games/Steam/steamapps/common/Game"}, false, false},
+		{ProcessRule{Name: "C:/Games/*/Game.exe"}, false, false},
+		{ProcessRule{Name: "C:/Games/**/Game.exe"}, false, true},
+		{ProcessRule{Name: `C:\Games\**\Game.exe`}, false, true},
+		{ProcessRule{Name: "C:/Games/Steam/steamapps/common/*/Game.exe"}, false, true},
+		{ProcessRule{Name: "**/game.exe"}, true, true},
+		// 正则表达式, 有'/'时匹配路径
+		{ProcessRule{Name: `re:^Game\.(exe|bin)$`}, false, true},
+		{ProcessRule{Name: `re:^game\.exe$`}, false, false},
+		{ProcessRule{Name: `re:^game\.exe$`}, true, true},
+		{ProcessRule{Name: `re:/steamapps/common/[^/]+/Game\.exe$`}, false, true},
+		{ProcessRule{Name: `re:[`}, false, false},
+		// 命令行的字面量只要包含, glob可以跨'/'
+		{ProcessRule{Cmdline: "-server eu"}, false, true},
+		{ProcessRule{Cmdline: "-SERVER EU"}, false, false},
+		{ProcessRule{Cmdline: "-SERVER EU"}, true, true},
+		{ProcessRule{Cmdline: "*--port=27*"}, false, true},
+		{ProcessRule{Cmdline: "--port=27*"}, false, false},
+		{ProcessRule{Cmdline: `re:--port=\d+`}, false, true},
+		// 所有给出的模式都要匹配
+		{ProcessRule{Name: "Game.exe", Cmdline: "-server eu"}, false, true},
+		{ProcessRule{Name: "Game.exe", Cmdline: "-server us"}, false, false},
+	}
+	for _, c := range cases {
+		m, err := NewProcessMatcher([]ProcessRule{c.rule}, c.ignoreCase)
+		if err != nil {
+			if c.want {
+				t.Errorf("%+v: %v", c.rule, err)
+			}
+			continue
+		}
+		if got := m.Match(game); got != c.want {
+			t.Errorf("%+v ignore case %v: match %v, want %v", c.rule, c.ignoreCase, got, c.want)
+		}
+	}
+}
+
+func TestProcessMatcherEmpty(t *testing.T) {
+	if _, err := NewProcessMatcher([]ProcessRule{{}}, false); err == nil {
+		t.Fatal("empty rule accepted")
+	}
+}
+
+func TestProcessRuleJSON(t *testing.T) {
+	var rules []ProcessRule
+	if err := json.Unmarshal([]byte(`["curl", {"name": "*.exe", "cmdline": "-x", "ignore_case": true}]`), &rules); err != nil {
+		t.Fatal(err)
+	}
+	want := []ProcessRule{{Name: "curl"}, {Name: "*.exe", Cmdline: "-x", IgnoreCase: true}}
+	if len(rules) != len(want) || rules[0] != want[0] || rules[1] != want[1] {
+		t.Fatalf("%+v", rules)
+	}
+}
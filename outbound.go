@@ -0,0 +1,345 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/eycorsican/go-tun2socks/common/log"
+	"github.com/eycorsican/go-tun2socks/core"
+
+	"github.com/MissGod1/PProxy/common"
+	"github.com/MissGod1/PProxy/common/packet"
+	"github.com/MissGod1/PProxy/proxy/dialer"
+)
+
+// 只有一个服务器的配置文件中服务器的名字
+const DefaultOutbound = "default"
+
+// Outbound is a named upstream proxy.
+type Outbound struct {
+	Name string
+	TCP  core.TCPConnHandler
+	UDP  core.UDPConnHandler
+	// Probe checks that the server works by the protocol of the type, like
+	// a SOCKS5 handshake or a shadowsocks round trip. Outbounds without one
+	// connect to the target through the Dialer.
+	Probe func(target string, timeout time.Duration) error
+	// Dialer connects through the server, for outbounds that go through
+	// this one and for the checks. Nil if the type can not be chained.
+	Dialer dialer.Dialer
+
+	// addr is the host:port of the server
+	addr string
+	// forward reaches the server, nil is direct
+	forward dialer.Dialer
+	plugin  *common.Plugin
+	// closer is closed with the outbound, like a userspace WireGuard peer
+	closer io.Closer
+}
+
+// Check probes the outbound for a group. Failover groups use Probe, or
+// connect to target through the Dialer. Latency groups wait for the first
+// byte of a response from target, so that all types are timed the same
+// way. With tcp, or without Probe and Dialer, it only connects to the
+// server.
+func (o *Outbound) Check(tcp, latency bool, target string, timeout time.Duration) error {
+	if !tcp && latency && o.Dialer != nil {
+		return dialer.Probe(o.Dialer, target, timeout)
+	}
+	if !tcp && o.Probe != nil {
+		return o.Probe(target, timeout)
+	}
+	if !tcp && o.Dialer != nil {
+		c, err := dialer.DialTimeout(o.Dialer, "tcp", target, timeout)
+		if err != nil {
+			return err
+		}
+		return c.Close()
+	}
+	forward := o.forward
+	if forward == nil {
+		forward = dialer.Direct
+	}
+	c, err := dialer.DialTimeout(forward, "tcp", o.addr, timeout)
+	if err != nil {
+		return err
+	}
+	return c.Close()
+}
+
+// Close stops the plugin of the outbound.
+func (o *Outbound) Close() {
+	if o.plugin != nil {
+		o.plugin.KillPlugin()
+	}
+	if o.closer != nil {
+		o.closer.Close()
+	}
+}
+
+// Outbounds hands the connections of the stack to the outbound chosen for
+// their session. Connections without one, like DNS queries, use the
+// default outbound. A group name selects the current outbound of the group.
+type Outbounds struct {
+	sync.Mutex
+	list   []*Outbound
+	names  map[string]*Outbound
+	groups map[string]*group
+	def    string
+	// UDP的数据包只有第一个带目标地址, 记住每个连接用的出口
+	udp map[core.UDPConn]*udpConn
+
+	// route returns the outbound name of the session with key
+	route func(key packet.Key) string
+}
+
+// NewOutbounds creates the handlers of the servers and starts checking the
+// groups.
+func NewOutbounds(servers *Servers) (*Outbounds, error) {
+	o := &Outbounds{
+		names:  make(map[string]*Outbound),
+		groups: make(map[string]*group),
+		udp:    make(map[core.UDPConn]*udpConn),
+	}
+	configs := make(map[string]*Server)
+	for _, s := range servers.Outbounds {
+		if _, ok := configs[s.Name]; ok {
+			return nil, fmt.Errorf("duplicate outbound %v", s.Name)
+		}
+		configs[s.Name] = s
+	}
+	for _, s := range servers.Outbounds {
+		out, err := o.create(s, configs, nil)
+		if err != nil {
+			o.Close()
+			return nil, err
+		}
+		o.list = append(o.list, out)
+	}
+	if len(o.list) == 0 {
+		return nil, fmt.Errorf("no outbound")
+	}
+
+	for _, c := range servers.Groups {
+		if o.Has(c.Name) {
+			o.Close()
+			return nil, fmt.Errorf("duplicate outbound %v", c.Name)
+		}
+		g, err := newGroup(c, o.names)
+		if err != nil {
+			o.Close()
+			return nil, fmt.Errorf("group %v: %v", c.Name, err)
+		}
+		o.groups[c.Name] = g
+	}
+	o.def = servers.Default
+	if o.def == "" {
+		o.def = o.list[0].Name
+	} else if !o.Has(o.def) {
+		o.Close()
+		return nil, fmt.Errorf("unknown default outbound %v", o.def)
+	}
+	for _, g := range o.groups {
+		go g.checkloop()
+	}
+	return o, nil
+}
+
+// create creates the outbound of s after the outbound it goes through.
+// chain holds the outbounds waiting for it.
+func (o *Outbounds) create(s *Server, configs map[string]*Server, chain []string) (*Outbound, error) {
+	if out, ok := o.names[s.Name]; ok {
+		return out, nil
+	}
+	for _, name := range chain {
+		if name == s.Name {
+			return nil, fmt.Errorf("outbound %v: loop in via or udp_fallback", s.Name)
+		}
+	}
+
+	var forward dialer.Dialer
+	if s.Via != "" {
+		c, ok := configs[s.Via]
+		if !ok {
+			return nil, fmt.Errorf("outbound %v: unknown via %v", s.Name, s.Via)
+		}
+		hop, err := o.create(c, configs, append(chain, s.Name))
+		if err != nil {
+			return nil, err
+		}
+		if hop.Dialer == nil {
+			return nil, fmt.Errorf("outbound %v: can not go through %v", s.Name, s.Via)
+		}
+		forward = hop.Dialer
+	}
+
+	creater, ok := createrhandler[s.Type]
+	if !ok {
+		return nil, fmt.Errorf("outbound %v: unsupported proxy type %v", s.Name, s.Type)
+	}
+	out, err := creater(s, forward)
+	if err != nil {
+		return nil, fmt.Errorf("outbound %v: %v", s.Name, err)
+	}
+	out.Name = s.Name
+	out.addr = net.JoinHostPort(s.Server, strconv.Itoa(int(s.ServerPort)))
+	out.forward = forward
+	if s.UDPFallback != "" {
+		c, ok := configs[s.UDPFallback]
+		if !ok {
+			out.Close()
+			return nil, fmt.Errorf("outbound %v: unknown udp_fallback %v", s.Name, s.UDPFallback)
+		}
+		fallback, err := o.create(c, configs, append(chain, s.Name))
+		if err != nil {
+			out.Close()
+			return nil, err
+		}
+		out.UDP = fallback.UDP
+	}
+	o.names[s.Name] = out
+	if s.Via != "" {
+		log.Infof("outbound %v: %v %v:%v via %v", s.Name, s.Type, s.Server, s.ServerPort, s.Via)
+	} else {
+		log.Infof("outbound %v: %v %v:%v", s.Name, s.Type, s.Server, s.ServerPort)
+	}
+	return out, nil
+}
+
+// Has reports whether there is an outbound or group with name.
+func (o *Outbounds) Has(name string) bool {
+	if _, ok := o.names[name]; ok {
+		return true
+	}
+	_, ok := o.groups[name]
+	return ok
+}
+
+// PIDs returns the pids of the running plugins.
+func (o *Outbounds) PIDs() []uint32 {
+	var pids []uint32
+	for _, out := range o.names {
+		if out.plugin == nil {
+			continue
+		}
+		if pid := out.plugin.PID(); pid != 0 {
+			pids = append(pids, pid)
+		}
+	}
+	return pids
+}
+
+// Close stops checking the groups and stops the plugins of all outbounds.
+func (o *Outbounds) Close() {
+	for _, g := range o.groups {
+		g.Close()
+	}
+	for _, out := range o.names {
+		out.Close()
+	}
+}
+
+// lookup returns the outbound with name or the current outbound of the
+// group with name.
+func (o *Outbounds) lookup(name string) (*Outbound, bool) {
+	if out, ok := o.names[name]; ok {
+		return out, true
+	}
+	if g, ok := o.groups[name]; ok {
+		return g.Current(), true
+	}
+	return nil, false
+}
+
+func (o *Outbounds) defaultOutbound() *Outbound {
+	out, _ := o.lookup(o.def)
+	return out
+}
+
+func (o *Outbounds) get(protocol uint8, local net.Addr, target net.Addr) *Outbound {
+	if o.route == nil {
+		return o.defaultOutbound()
+	}
+	var key packet.Key
+	switch l := local.(type) {
+	case *net.TCPAddr:
+		t, ok := target.(*net.TCPAddr)
+		if !ok {
+			return o.defaultOutbound()
+		}
+		key = packet.NewKey(protocol, l.IP, uint16(l.Port), t.IP, uint16(t.Port))
+	case *net.UDPAddr:
+		t, ok := target.(*net.UDPAddr)
+		if !ok || t == nil {
+			return o.defaultOutbound()
+		}
+		key = packet.NewKey(protocol, l.IP, uint16(l.Port), t.IP, uint16(t.Port))
+	default:
+		return o.defaultOutbound()
+	}
+	name := o.route(key)
+	if name == "" {
+		return o.defaultOutbound()
+	}
+	if out, ok := o.lookup(name); ok {
+		return out
+	}
+	log.Warnf("unknown outbound %v for %v, use %v", name, key, o.def)
+	return o.defaultOutbound()
+}
+
+// Handle implements core.TCPConnHandler.
+func (o *Outbounds) Handle(conn net.Conn, target *net.TCPAddr) error {
+	return o.get(packet.ProtocolTCP, conn.LocalAddr(), target).TCP.Handle(conn, target)
+}
+
+// udpConn is handed to the handler of the outbound in place of the
+// connection of the stack, and removes it from the outbounds once the
+// handler closes it. The handlers key their state by the connection, so
+// every call gets the same udpConn.
+type udpConn struct {
+	core.UDPConn
+	o   *Outbounds
+	out *Outbound
+}
+
+func (c *udpConn) Close() error {
+	c.o.Lock()
+	delete(c.o.udp, c.UDPConn)
+	c.o.Unlock()
+	return c.UDPConn.Close()
+}
+
+// Connect implements core.UDPConnHandler.
+func (o *Outbounds) Connect(conn core.UDPConn, target *net.UDPAddr) error {
+	c := &udpConn{
+		UDPConn: conn,
+		o:       o,
+		out:     o.get(packet.ProtocolUDP, conn.LocalAddr(), target),
+	}
+	o.Lock()
+	o.udp[conn] = c
+	o.Unlock()
+	if err := c.out.UDP.Connect(c, target); err != nil {
+		o.Lock()
+		delete(o.udp, conn)
+		o.Unlock()
+		return err
+	}
+	return nil
+}
+
+// ReceiveTo implements core.UDPConnHandler.
+func (o *Outbounds) ReceiveTo(conn core.UDPConn, data []byte, addr *net.UDPAddr) error {
+	o.Lock()
+	c, ok := o.udp[conn]
+	o.Unlock()
+	if !ok {
+		return fmt.Errorf("udp connection %v is not connected", conn.LocalAddr())
+	}
+	return c.out.UDP.ReceiveTo(c, data, addr)
+}
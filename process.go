@@ -0,0 +1,170 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/eycorsican/go-tun2socks/common/log"
+)
+
+// Proc is a running process.
+type Proc struct {
+	PID uint32
+	// PPID is the pid of the process that started this one.
+	PPID uint32
+	Name string
+	// Path is the full path of the executable, Cmdline the command line.
+	// Both are empty if they can not be queried.
+	Path    string
+	Cmdline string
+	// Start is the creation time of the process. Together with the pid it
+	// identifies a process, pids are reused once a process exits.
+	Start int64
+}
+
+// ProcessLookup queries the processes of the system.
+type ProcessLookup interface {
+	// StartTime returns the creation time of the process, or an error if
+	// there is no process with this pid.
+	StartTime(pid uint32) (int64, error)
+	// Query returns the process with this pid.
+	Query(pid uint32) (*Proc, error)
+}
+
+// ProcEntry is a cached process. Parent is the process that started it,
+// only looked up when children are matched.
+type ProcEntry struct {
+	Proc
+	Parent *ProcEntry
+}
+
+// PidCache remembers the processes behind pids. Entries are verified
+// against the start time of the process, so a reused pid is looked up
+// again instead of inheriting the old process.
+type PidCache struct {
+	sync.Mutex
+	lookup   ProcessLookup
+	children bool
+	entries  map[uint32]*ProcEntry
+	// 每次Reload加一, 查询期间发生Reload时不保存旧的结果
+	gen uint64
+}
+
+// 向上查找父进程的最大层数
+const maxParentDepth = 32
+
+func NewPidCache(lookup ProcessLookup, children bool) *PidCache {
+	return &PidCache{
+		lookup:   lookup,
+		children: children,
+		entries:  make(map[uint32]*ProcEntry),
+	}
+}
+
+// Lookup returns the process with pid, or nil if there is none.
+func (c *PidCache) Lookup(pid uint32) *ProcEntry {
+	return c.entry(pid, 0)
+}
+
+// entry returns the entry of pid, looking up the process and its parents
+// if it is not cached.
+func (c *PidCache) entry(pid uint32, depth int) *ProcEntry {
+	start, err := c.lookup.StartTime(pid)
+	if err != nil {
+		c.Lock()
+		delete(c.entries, pid)
+		c.Unlock()
+		return nil
+	}
+
+	c.Lock()
+	e, ok := c.entries[pid]
+	children, gen := c.children, c.gen
+	if ok && e.Start == start {
+		c.Unlock()
+		return e
+	}
+	c.Unlock()
+
+	proc, err := c.lookup.Query(pid)
+	if err != nil || proc.Name == "" {
+		return nil
+	}
+	if ok {
+		log.Debugf("Program: pid %v is reused by %v", pid, proc.Name)
+	} else {
+		log.Debugf("Program: %v", proc.Name)
+	}
+	e = &ProcEntry{Proc: *proc}
+	if children && depth < maxParentDepth && proc.PPID != 0 && proc.PPID != pid {
+		// 父进程的pid可能已经被复用, 父进程一定比子进程先启动
+		if parent := c.entry(proc.PPID, depth+1); parent != nil && parent.Start <= proc.Start {
+			e.Parent = parent
+		}
+	}
+
+	c.Lock()
+	if c.gen == gen {
+		c.entries[pid] = e
+	}
+	c.Unlock()
+	return e
+}
+
+// Sweep drops the entries of processes that exited and returns how many
+// were dropped.
+func (c *PidCache) Sweep() int {
+	c.Lock()
+	pids := make([]uint32, 0, len(c.entries))
+	for pid := range c.entries {
+		pids = append(pids, pid)
+	}
+	c.Unlock()
+
+	n := 0
+	for _, pid := range pids {
+		start, err := c.lookup.StartTime(pid)
+		c.Lock()
+		if e, ok := c.entries[pid]; ok && (err != nil || e.Start != start) {
+			delete(c.entries, pid)
+			n++
+		}
+		c.Unlock()
+	}
+	return n
+}
+
+// Reload changes the children setting. The entries are dropped so the
+// parents are looked up again.
+func (c *PidCache) Reload(children bool) {
+	c.Lock()
+	if c.children != children {
+		c.children = children
+		c.gen++
+		c.entries = make(map[uint32]*ProcEntry)
+	}
+	c.Unlock()
+}
+
+// Len returns the number of cached pids.
+func (c *PidCache) Len() int {
+	c.Lock()
+	defer c.Unlock()
+	return len(c.entries)
+}
+
+func (c *PidCache) sweeploop(interval time.Duration, done chan struct{}) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			if n := c.Sweep(); n > 0 {
+				log.Debugf("%v exited processes dropped, %v left", n, c.Len())
+			}
+		case <-done:
+			return
+		}
+	}
+}
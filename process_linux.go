@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// systemLookup queries the processes through procfs.
+type systemLookup struct{}
+
+func (systemLookup) StartTime(pid uint32) (int64, error) {
+	_, start, err := stat(pid)
+	return start, err
+}
+
+// stat returns the parent pid and the start time of the process.
+func stat(pid uint32) (uint32, int64, error) {
+	b, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0, 0, err
+	}
+	// comm可能包含空格和括号, 从最后一个')'之后开始解析
+	i := bytes.LastIndexByte(b, ')')
+	if i < 0 {
+		return 0, 0, fmt.Errorf("invalid stat of process %v", pid)
+	}
+	// 第3个字段是state, 第4个字段是ppid, 第22个字段是starttime
+	fields := bytes.Fields(b[i+1:])
+	if len(fields) < 20 {
+		return 0, 0, fmt.Errorf("invalid stat of process %v", pid)
+	}
+	if fields[0][0] == 'Z' || fields[0][0] == 'X' {
+		return 0, 0, fmt.Errorf("process %v exited", pid)
+	}
+	ppid, err := strconv.ParseUint(string(fields[1]), 10, 32)
+	if err != nil {
+		return 0, 0, err
+	}
+	start, err := strconv.ParseInt(string(fields[19]), 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	return uint32(ppid), start, nil
+}
+
+func (systemLookup) Query(pid uint32) (*Proc, error) {
+	ppid, start, err := stat(pid)
+	if err != nil {
+		return nil, err
+	}
+	path, _ := os.Readlink(fmt.Sprintf("/proc/%d/exe", pid))
+	name := filepath.Base(path)
+	if path == "" {
+		// 没有权限读取其他用户进程的exe时使用comm, 最长15个字符
+		b, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/comm", pid))
+		if err != nil {
+			return nil, err
+		}
+		name = string(bytes.TrimSpace(b))
+	}
+	// 参数之间用'\0'分隔
+	cmdline, _ := ioutil.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+	cmdline = bytes.ReplaceAll(bytes.TrimRight(cmdline, "\x00"), []byte{0}, []byte{' '})
+	return &Proc{
+		PID:     pid,
+		PPID:    ppid,
+		Name:    name,
+		Path:    path,
+		Cmdline: string(cmdline),
+		Start:   start,
+	}, nil
+}
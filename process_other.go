@@ -0,0 +1,21 @@
+//go:build !windows && !linux
+// +build !windows,!linux
+
+package main
+
+import (
+	"errors"
+)
+
+var errProcessLookup = errors.New("process lookup is not supported on this platform")
+
+// systemLookup finds no processes.
+type systemLookup struct{}
+
+func (systemLookup) StartTime(pid uint32) (int64, error) {
+	return 0, errProcessLookup
+}
+
+func (systemLookup) Query(pid uint32) (*Proc, error) {
+	return nil, errProcessLookup
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"testing"
+)
+
+// fakeLookup is a process table for tests.
+type fakeLookup struct {
+	sync.Mutex
+	procs   map[uint32]*Proc
+	queries int
+}
+
+func newFakeLookup(procs ...Proc) *fakeLookup {
+	l := &fakeLookup{procs: make(map[uint32]*Proc)}
+	for i := range procs {
+		l.Set(procs[i])
+	}
+	return l
+}
+
+// Set starts a process, replacing the one with the same pid.
+func (l *fakeLookup) Set(p Proc) {
+	l.Lock()
+	l.procs[p.PID] = &p
+	l.Unlock()
+}
+
+// Exit ends the process.
+func (l *fakeLookup) Exit(pid uint32) {
+	l.Lock()
+	delete(l.procs, pid)
+	l.Unlock()
+}
+
+// Queries returns how many times Query was called.
+func (l *fakeLookup) Queries() int {
+	l.Lock()
+	defer l.Unlock()
+	return l.queries
+}
+
+func (l *fakeLookup) StartTime(pid uint32) (int64, error) {
+	l.Lock()
+	defer l.Unlock()
+	if p, ok := l.procs[pid]; ok {
+		return p.Start, nil
+	}
+	return 0, errors.New("no such process")
+}
+
+func (l *fakeLookup) Query(pid uint32) (*Proc, error) {
+	l.Lock()
+	defer l.Unlock()
+	l.queries++
+	if p, ok := l.procs[pid]; ok {
+		c := *p
+		return &c, nil
+	}
+	return nil, errors.New("no such process")
+}
+
+func TestPidCacheLookup(t *testing.T) {
+	lookup := newFakeLookup(Proc{PID: 42, Name: "curl", Start: 1})
+	c := NewPidCache(lookup, false)
+
+	for i := 0; i < 3; i++ {
+		if e := c.Lookup(42); e == nil || e.Name != "curl" {
+			t.Fatalf("lookup %v: %+v", i, e)
+		}
+	}
+	if n := lookup.Queries(); n != 1 {
+		t.Errorf("%v queries, want 1", n)
+	}
+	if e := c.Lookup(43); e != nil {
+		t.Errorf("unknown pid: %+v", e)
+	}
+}
+
+// pid被复用后启动时间不同, 重新查询而不是沿用旧的进程
+func TestPidCacheReuse(t *testing.T) {
+	lookup := newFakeLookup(Proc{PID: 42, Name: "curl", Start: 1})
+	c := NewPidCache(lookup, false)
+	if e := c.Lookup(42); e == nil || e.Name != "curl" {
+		t.Fatalf("lookup: %+v", e)
+	}
+
+	lookup.Set(Proc{PID: 42, Name: "other", Start: 2})
+	if e := c.Lookup(42); e == nil || e.Name != "other" || e.Start != 2 {
+		t.Fatalf("lookup of the reused pid: %+v", e)
+	}
+	if n := lookup.Queries(); n != 2 {
+		t.Errorf("%v queries, want 2", n)
+	}
+
+	// 清理时也丢掉被复用的pid的旧记录
+	c.Lookup(42)
+	lookup.Set(Proc{PID: 42, Name: "third", Start: 3})
+	if n := c.Sweep(); n != 1 {
+		t.Errorf("sweep dropped %v, want 1", n)
+	}
+}
+
+func TestPidCacheExit(t *testing.T) {
+	lookup := newFakeLookup(
+		Proc{PID: 42, Name: "curl", Start: 1},
+		Proc{PID: 43, Name: "other", Start: 1},
+	)
+	c := NewPidCache(lookup, false)
+	c.Lookup(42)
+	c.Lookup(43)
+
+	if n := c.Sweep(); n != 0 {
+		t.Fatalf("sweep dropped %v running processes", n)
+	}
+	lookup.Exit(42)
+	if n := c.Sweep(); n != 1 {
+		t.Fatalf("sweep dropped %v, want 1", n)
+	}
+	if c.Len() != 1 {
+		t.Errorf("%v entries, want 1", c.Len())
+	}
+	if e := c.Lookup(42); e != nil {
+		t.Errorf("exited process: %+v", e)
+	}
+}
+
+// 父进程的pid被复用时不当作父进程
+func TestPidCacheChildren(t *testing.T) {
+	lookup := newFakeLookup(
+		Proc{PID: 10, Name: "launcher", Start: 1},
+		Proc{PID: 42, PPID: 10, Name: "game", Start: 2},
+	)
+	c := NewPidCache(lookup, true)
+	if e := c.Lookup(42); e == nil || e.Parent == nil || e.Parent.Name != "launcher" {
+		t.Fatalf("lookup: %+v", e)
+	}
+
+	lookup.Set(Proc{PID: 10, Name: "other", Start: 3})
+	lookup.Set(Proc{PID: 43, PPID: 10, Name: "game", Start: 2})
+	if e := c.Lookup(43); e == nil || e.Parent != nil {
+		t.Fatalf("child of a reused pid: %+v", e)
+	}
+}
+
+// 用-race运行, 查询匹配和清理同时进行
+func TestPidCacheConcurrent(t *testing.T) {
+	lookup := newFakeLookup()
+	for pid := uint32(1); pid <= 16; pid++ {
+		lookup.Set(Proc{PID: pid, PPID: pid - 1, Name: "p", Start: 1})
+	}
+	c := NewPidCache(lookup, true)
+	rules, err := NewRuleSet(&Process{Processes: []ProcessRule{{Name: "p"}}, Children: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 500; i++ {
+				pid := uint32((i+g)%16 + 1)
+				e := c.Lookup(pid)
+				if e != nil && e.PID != pid {
+					t.Errorf("lookup %v returned %v", pid, e.PID)
+					return
+				}
+				rules.Match(&Flow{Proc: e})
+			}
+		}(g)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 500; i++ {
+			pid := uint32(i%16 + 1)
+			if i%2 == 0 {
+				lookup.Exit(pid)
+			} else {
+				lookup.Set(Proc{PID: pid, PPID: pid - 1, Name: "p", Start: int64(i)})
+			}
+		}
+	}()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			c.Sweep()
+			if i%10 == 0 {
+				c.Reload(i%20 == 0)
+			}
+		}
+	}()
+	wg.Wait()
+
+	// 最后一次清理后只剩下还在运行且没有被复用的进程
+	c.Sweep()
+	c.Lock()
+	defer c.Unlock()
+	for pid, e := range c.entries {
+		start, err := lookup.StartTime(pid)
+		if err != nil || start != e.Start {
+			t.Errorf("stale entry of pid %v", pid)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"unsafe"
+
+	shadow "github.com/imgk/shadow/utils"
+	"golang.org/x/sys/windows"
+)
+
+// systemLookup queries the processes through the process handles.
+type systemLookup struct{}
+
+func (systemLookup) StartTime(pid uint32) (int64, error) {
+	h, err := windows.OpenProcess(windows.PROCESS_QUERY_LIMITED_INFORMATION, false, pid)
+	if err != nil {
+		return 0, fmt.Errorf("open process error: %v", err)
+	}
+	defer windows.CloseHandle(h)
+
+	return startTime(h)
+}
+
+func (systemLookup) Query(pid uint32) (*Proc, error) {
+	h, err := windows.OpenProcess(windows.PROCESS_QUERY_LIMITED_INFORMATION, false, pid)
+	if err != nil {
+		return nil, fmt.Errorf("open process error: %v", err)
+	}
+	defer windows.CloseHandle(h)
+
+	start, err := startTime(h)
+	if err != nil {
+		return nil, err
+	}
+	path, err := shadow.QueryFullProcessImageName(h, 0)
+	if err != nil {
+		return nil, fmt.Errorf("query full process name error: %v", err)
+	}
+	ppid, err := queryParent(h)
+	if err != nil {
+		return nil, err
+	}
+	// 命令行只用于匹配, 查询失败时留空
+	cmdline, _ := queryCmdline(h)
+	return &Proc{
+		PID:     pid,
+		PPID:    ppid,
+		Name:    filepath.Base(path),
+		Path:    path,
+		Cmdline: cmdline,
+		Start:   start,
+	}, nil
+}
+
+var (
+	ntdll                     = windows.NewLazySystemDLL("ntdll.dll")
+	ntQueryInformationProcess = ntdll.NewProc("NtQueryInformationProcess")
+)
+
+const (
+	processBasicInformation = 0
+	// Windows 8.1 and later
+	processCommandLineInformation = 60
+)
+
+// PROCESS_BASIC_INFORMATION, the fields before PebBaseAddress and
+// AffinityMask are padded to pointer size.
+type processBasicInfo struct {
+	ExitStatus                   uintptr
+	PebBaseAddress               uintptr
+	AffinityMask                 uintptr
+	BasePriority                 uintptr
+	UniqueProcessID              uintptr
+	InheritedFromUniqueProcessID uintptr
+}
+
+type unicodeString struct {
+	Length        uint16
+	MaximumLength uint16
+	Buffer        *uint16
+}
+
+// queryParent returns the pid of the process that created the process.
+func queryParent(h windows.Handle) (uint32, error) {
+	if err := ntQueryInformationProcess.Find(); err != nil {
+		return 0, err
+	}
+	info := processBasicInfo{}
+	ret, _, _ := ntQueryInformationProcess.Call(
+		uintptr(h),
+		processBasicInformation,
+		uintptr(unsafe.Pointer(&info)),
+		unsafe.Sizeof(info),
+		0,
+	)
+	if ret != 0 {
+		return 0, fmt.Errorf("query process parent error: %#x", ret)
+	}
+	return uint32(info.InheritedFromUniqueProcessID), nil
+}
+
+// queryCmdline returns the command line of the process.
+func queryCmdline(h windows.Handle) (string, error) {
+	if err := ntQueryInformationProcess.Find(); err != nil {
+		return "", err
+	}
+	// UNICODE_STRING followed by the string
+	b := make([]byte, 4096)
+	for {
+		n := uint32(0)
+		ret, _, _ := ntQueryInformationProcess.Call(
+			uintptr(h),
+			processCommandLineInformation,
+			uintptr(unsafe.Pointer(&b[0])),
+			uintptr(len(b)),
+			uintptr(unsafe.Pointer(&n)),
+		)
+		// STATUS_INFO_LENGTH_MISMATCH
+		if ret == 0xc0000004 && int(n) > len(b) {
+			b = make([]byte, n)
+			continue
+		}
+		if ret != 0 {
+			return "", fmt.Errorf("query process command line error: %#x", ret)
+		}
+		break
+	}
+	s := (*unicodeString)(unsafe.Pointer(&b[0]))
+	if s.Length == 0 {
+		return "", nil
+	}
+	return windows.UTF16ToString((*[1 << 20]uint16)(unsafe.Pointer(s.Buffer))[: s.Length/2 : s.Length/2]), nil
+}
+
+func startTime(h windows.Handle) (int64, error) {
+	var creation, exit, kernel, user windows.Filetime
+	if err := windows.GetProcessTimes(h, &creation, &exit, &kernel, &user); err != nil {
+		return 0, fmt.Errorf("get process times error: %v", err)
+	}
+	// 进程已退出, 只是句柄还没有全部关闭
+	if exit.Nanoseconds() != 0 {
+		return 0, fmt.Errorf("process exited at %v", exit.Nanoseconds())
+	}
+	return creation.Nanoseconds(), nil
+}
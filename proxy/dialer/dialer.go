@@ -0,0 +1,100 @@
+// Package dialer lets the outbound handlers reach their server through
+// another proxy, so outbounds can be chained.
+package dialer
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+)
+
+// Dialer reaches addresses directly or through a proxy.
+type Dialer interface {
+	// Dial connects to address, a host:port.
+	Dial(network, address string) (net.Conn, error)
+	// ListenPacket returns a packet connection that sends to and receives
+	// from the addresses given to WriteTo and returned by ReadFrom. WriteTo
+	// takes any net.Addr whose String is a host:port, like Addr.
+	ListenPacket() (net.PacketConn, error)
+}
+
+// ContextDialer is implemented by dialers that can give up a connection
+// attempt themselves, DialTimeout cancels them instead of leaving the
+// attempt running.
+type ContextDialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// Addr is a host:port address that is resolved by the last hop.
+type Addr string
+
+func (a Addr) Network() string { return "udp" }
+
+func (a Addr) String() string { return string(a) }
+
+// Direct connects without a proxy.
+var Direct Dialer = direct{}
+
+type direct struct{}
+
+func (direct) Dial(network, address string) (net.Conn, error) {
+	return net.Dial(network, address)
+}
+
+func (direct) ListenPacket() (net.PacketConn, error) {
+	pc, err := net.ListenPacket("udp", "")
+	if err != nil {
+		return nil, err
+	}
+	return &directPacketConn{pc}, nil
+}
+
+// DialTimeout is Dial that gives up after timeout.
+func DialTimeout(d Dialer, network, address string, timeout time.Duration) (net.Conn, error) {
+	if _, ok := d.(direct); ok {
+		return net.DialTimeout(network, address, timeout)
+	}
+	if cd, ok := d.(ContextDialer); ok {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		return cd.DialContext(ctx, network, address)
+	}
+
+	type result struct {
+		c   net.Conn
+		err error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		c, err := d.Dial(network, address)
+		ch <- result{c, err}
+	}()
+	select {
+	case r := <-ch:
+		return r.c, r.err
+	case <-time.After(timeout):
+		// 超时后连上的连接直接关闭
+		go func() {
+			if r := <-ch; r.c != nil {
+				r.c.Close()
+			}
+		}()
+		return nil, fmt.Errorf("dial %v timeout", address)
+	}
+}
+
+type directPacketConn struct {
+	net.PacketConn
+}
+
+func (c *directPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if _, ok := addr.(*net.UDPAddr); !ok {
+		a, err := net.ResolveUDPAddr("udp", addr.String())
+		if err != nil {
+			return 0, err
+		}
+		addr = a
+	}
+	return c.PacketConn.WriteTo(b, addr)
+}
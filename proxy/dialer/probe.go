@@ -0,0 +1,35 @@
+package dialer
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// Probe sends an HTTP request to target, a host:port, through d and waits
+// for the first byte of the response. Latency groups check every type of
+// proxy this way, so the time it takes can be compared.
+func Probe(d Dialer, target string, timeout time.Duration) error {
+	host, _, err := net.SplitHostPort(target)
+	if err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(timeout)
+	c, err := DialTimeout(d, "tcp", target, timeout)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	c.SetDeadline(deadline)
+
+	req := fmt.Sprintf("HEAD / HTTP/1.1\r\nHost: %v\r\nConnection: close\r\n\r\n", host)
+	if _, err := c.Write([]byte(req)); err != nil {
+		return err
+	}
+	b := make([]byte, 1)
+	if _, err := c.Read(b); err != nil {
+		return fmt.Errorf("no response from %v: %v", target, err)
+	}
+	return nil
+}
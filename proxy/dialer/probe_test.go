@@ -0,0 +1,43 @@
+package dialer
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestProbe(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for i := 0; ; i++ {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			// 第一个连接应答, 第二个连接不应答直接关闭
+			if i == 0 {
+				r := bufio.NewReader(c)
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil || line == "\r\n" {
+						break
+					}
+				}
+				c.Write([]byte("HTTP/1.1 204 No Content\r\n\r\n"))
+			}
+			c.Close()
+		}
+	}()
+
+	if err := Probe(Direct, l.Addr().String(), time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := Probe(Direct, l.Addr().String(), time.Second); err == nil {
+		t.Fatal("probe succeeded without a response")
+	}
+}
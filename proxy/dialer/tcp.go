@@ -0,0 +1,54 @@
+package dialer
+
+import (
+	"io"
+	"net"
+	"strconv"
+
+	"github.com/eycorsican/go-tun2socks/common/log"
+	"github.com/eycorsican/go-tun2socks/core"
+
+	"github.com/MissGod1/PProxy/common/dns"
+)
+
+type tcpHandler struct {
+	dialer  Dialer
+	fakeDns dns.FakeDns
+}
+
+// NewTCPHandler creates a handler that connects through d. Fake IPs are
+// replaced with their domain, which is resolved by the last hop.
+func NewTCPHandler(d Dialer, fakeDns dns.FakeDns) core.TCPConnHandler {
+	return &tcpHandler{
+		dialer:  d,
+		fakeDns: fakeDns,
+	}
+}
+
+func (h *tcpHandler) Handle(conn net.Conn, target *net.TCPAddr) error {
+	// Replace with a domain name if target address IP is a fake IP.
+	targetHost := target.IP.String()
+	if h.fakeDns != nil && h.fakeDns.IsFakeIP(target.IP) {
+		targetHost = h.fakeDns.QueryDomain(target.IP)
+	}
+	dest := net.JoinHostPort(targetHost, strconv.Itoa(target.Port))
+
+	rc, err := h.dialer.Dial("tcp", dest)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		io.Copy(rc, conn)
+		rc.Close()
+		conn.Close()
+	}()
+	go func() {
+		io.Copy(conn, rc)
+		rc.Close()
+		conn.Close()
+	}()
+
+	log.Infof("new proxy connection to %v", dest)
+	return nil
+}
@@ -0,0 +1,184 @@
+package dialer
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/eycorsican/go-tun2socks/common/log"
+	"github.com/eycorsican/go-tun2socks/core"
+
+	"github.com/MissGod1/PProxy/common/dns"
+)
+
+// 最大的UDP数据报
+const maxPacketSize = 65535
+
+type udpHandler struct {
+	sync.Mutex
+
+	dialer  Dialer
+	fakeDns dns.FakeDns
+	timeout time.Duration
+	conns   map[core.UDPConn]net.PacketConn
+}
+
+// NewUDPHandler creates a handler that sends UDP over a packet connection
+// from d. If d can not carry UDP, only DNS queries are handled: they get
+// fake answers, or are sent over TCP through d if the domain needs a real
+// one.
+func NewUDPHandler(d Dialer, timeout time.Duration, fakeDns dns.FakeDns) core.UDPConnHandler {
+	return &udpHandler{
+		dialer:  d,
+		fakeDns: fakeDns,
+		timeout: timeout,
+		conns:   make(map[core.UDPConn]net.PacketConn, 8),
+	}
+}
+
+func (h *udpHandler) fetchUDPInput(conn core.UDPConn, input net.PacketConn) {
+	buf := core.NewBytes(maxPacketSize)
+
+	defer func() {
+		h.Close(conn)
+		core.FreeBytes(buf)
+	}()
+
+	for {
+		input.SetDeadline(time.Now().Add(h.timeout))
+		n, addr, err := input.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		resolvedAddr, err := net.ResolveUDPAddr("udp", addr.String())
+		if err != nil {
+			continue
+		}
+		if _, err := conn.WriteFrom(buf[:n], resolvedAddr); err != nil {
+			log.Warnf("write local failed: %v", err)
+			return
+		}
+	}
+}
+
+func (h *udpHandler) Connect(conn core.UDPConn, target *net.UDPAddr) error {
+	// DNS查询等到ReceiveTo再决定怎么回答
+	if target != nil && target.Port == dns.COMMON_DNS_PORT {
+		return nil
+	}
+	return h.connectInternal(conn, target)
+}
+
+func (h *udpHandler) connectInternal(conn core.UDPConn, target *net.UDPAddr) error {
+	pc, err := h.dialer.ListenPacket()
+	if err != nil {
+		return err
+	}
+
+	h.Lock()
+	h.conns[conn] = pc
+	h.Unlock()
+	go h.fetchUDPInput(conn, pc)
+	if target != nil {
+		log.Infof("new proxy connection to %v", target)
+	}
+	return nil
+}
+
+func (h *udpHandler) ReceiveTo(conn core.UDPConn, data []byte, addr *net.UDPAddr) error {
+	h.Lock()
+	pc, ok := h.conns[conn]
+	h.Unlock()
+
+	if addr.Port == dns.COMMON_DNS_PORT && !ok {
+		if h.fakeDns != nil {
+			if resp, err := h.fakeDns.GenerateFakeResponse(data); err == nil {
+				defer h.Close(conn)
+				if _, err := conn.WriteFrom(resp, addr); err != nil {
+					return fmt.Errorf("write dns answer failed: %v", err)
+				}
+				return nil
+			}
+		}
+		// FIXME This will block the lwip thread, need to optimize.
+		if err := h.connectInternal(conn, addr); err != nil {
+			// 不支持UDP时通过TCP查询, 不要阻塞lwip的线程
+			query := append([]byte(nil), data...)
+			go h.exchange(conn, query, addr)
+			return nil
+		}
+		h.Lock()
+		pc, ok = h.conns[conn]
+		h.Unlock()
+	}
+
+	if !ok {
+		h.Close(conn)
+		return fmt.Errorf("proxy connection %v->%v does not exists", conn.LocalAddr(), addr)
+	}
+
+	// Replace with a domain name if target address IP is a fake IP.
+	targetHost := addr.IP.String()
+	if h.fakeDns != nil && h.fakeDns.IsFakeIP(addr.IP) {
+		targetHost = h.fakeDns.QueryDomain(addr.IP)
+	}
+	dest := net.JoinHostPort(targetHost, strconv.Itoa(addr.Port))
+	if _, err := pc.WriteTo(data, Addr(dest)); err != nil {
+		h.Close(conn)
+		return fmt.Errorf("write remote failed: %v", err)
+	}
+	return nil
+}
+
+// exchange sends the query over TCP (RFC 1035 section 4.2.2) and writes
+// the answer back.
+func (h *udpHandler) exchange(conn core.UDPConn, query []byte, addr *net.UDPAddr) {
+	defer h.Close(conn)
+
+	resp, err := func() ([]byte, error) {
+		c, err := DialTimeout(h.dialer, "tcp", addr.String(), h.timeout)
+		if err != nil {
+			return nil, err
+		}
+		defer c.Close()
+		c.SetDeadline(time.Now().Add(h.timeout))
+
+		b := make([]byte, 2+len(query))
+		binary.BigEndian.PutUint16(b, uint16(len(query)))
+		copy(b[2:], query)
+		if _, err := c.Write(b); err != nil {
+			return nil, err
+		}
+		if _, err := io.ReadFull(c, b[:2]); err != nil {
+			return nil, err
+		}
+		resp := make([]byte, binary.BigEndian.Uint16(b))
+		if _, err := io.ReadFull(c, resp); err != nil {
+			return nil, err
+		}
+		return resp, nil
+	}()
+	if err != nil {
+		log.Warnf("dns query to %v failed: %v", addr, err)
+		return
+	}
+	if _, err := conn.WriteFrom(resp, addr); err != nil {
+		log.Warnf("write dns answer failed: %v", err)
+	}
+}
+
+func (h *udpHandler) Close(conn core.UDPConn) {
+	conn.Close()
+
+	h.Lock()
+	defer h.Unlock()
+
+	if pc, ok := h.conns[conn]; ok {
+		pc.Close()
+		delete(h.conns, conn)
+	}
+}
@@ -0,0 +1,143 @@
+package dialer
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// fakeUDPConn is the stack side of a UDP session.
+type fakeUDPConn struct {
+	written chan []byte
+	closed  chan struct{}
+}
+
+func newFakeUDPConn() *fakeUDPConn {
+	return &fakeUDPConn{written: make(chan []byte, 4), closed: make(chan struct{})}
+}
+
+func (c *fakeUDPConn) LocalAddr() *net.UDPAddr {
+	return &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 50000}
+}
+
+func (c *fakeUDPConn) ReceiveTo(data []byte, addr *net.UDPAddr) error { return nil }
+
+func (c *fakeUDPConn) WriteFrom(data []byte, addr *net.UDPAddr) (int, error) {
+	c.written <- append([]byte(nil), data...)
+	return len(data), nil
+}
+
+func (c *fakeUDPConn) Close() error {
+	select {
+	case <-c.closed:
+	default:
+		close(c.closed)
+	}
+	return nil
+}
+
+func (c *fakeUDPConn) read(t *testing.T) []byte {
+	select {
+	case b := <-c.written:
+		return b
+	case <-time.After(3 * time.Second):
+		t.Fatal("no answer")
+		return nil
+	}
+}
+
+func TestUDPHandlerRelay(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	go func() {
+		b := make([]byte, 64)
+		for {
+			n, addr, err := pc.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			pc.WriteTo(b[:n], addr)
+		}
+	}()
+
+	h := NewUDPHandler(Direct, time.Second, nil)
+	conn := newFakeUDPConn()
+	target := pc.LocalAddr().(*net.UDPAddr)
+	if err := h.Connect(conn, target); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.ReceiveTo(conn, []byte("ping"), target); err != nil {
+		t.Fatal(err)
+	}
+	if b := conn.read(t); string(b) != "ping" {
+		t.Fatalf("answer %q", b)
+	}
+}
+
+// tcpOnly sends every TCP connection to server and can not carry UDP.
+type tcpOnly struct {
+	server string
+}
+
+func (d tcpOnly) Dial(network, address string) (net.Conn, error) {
+	return net.Dial("tcp", d.server)
+}
+
+func (d tcpOnly) ListenPacket() (net.PacketConn, error) {
+	return nil, errors.New("no udp")
+}
+
+// 不支持UDP时DNS查询通过TCP发送, 其他UDP被拒绝
+func TestUDPHandlerDNSOverTCP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		b := make([]byte, 2)
+		if _, err := io.ReadFull(c, b); err != nil {
+			return
+		}
+		query := make([]byte, binary.BigEndian.Uint16(b))
+		if _, err := io.ReadFull(c, query); err != nil {
+			return
+		}
+		answer := append(query, " answer"...)
+		binary.BigEndian.PutUint16(b, uint16(len(answer)))
+		c.Write(append(b, answer...))
+	}()
+
+	h := NewUDPHandler(tcpOnly{l.Addr().String()}, time.Second, nil)
+	conn := newFakeUDPConn()
+	server := &net.UDPAddr{IP: net.IPv4(8, 8, 8, 8), Port: 53}
+	if err := h.Connect(conn, server); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.ReceiveTo(conn, []byte("query"), server); err != nil {
+		t.Fatal(err)
+	}
+	if b := conn.read(t); string(b) != "query answer" {
+		t.Fatalf("answer %q", b)
+	}
+	select {
+	case <-conn.closed:
+	case <-time.After(3 * time.Second):
+		t.Fatal("session is not closed after the answer")
+	}
+
+	if err := h.Connect(newFakeUDPConn(), &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 443}); err == nil {
+		t.Fatal("udp accepted")
+	}
+}
@@ -0,0 +1,119 @@
+// Package http tunnels TCP through an HTTP/1.1 CONNECT proxy.
+package http
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/proxy"
+
+	"github.com/MissGod1/PProxy/proxy/dialer"
+)
+
+type httpDialer struct {
+	server  string
+	auth    *proxy.Auth
+	tls     *tls.Config
+	forward dialer.Dialer
+}
+
+// NewDialer returns a dialer that connects with CONNECT requests to the
+// proxy, which is reached through forward, or directly if forward is nil.
+// auth is sent with Basic authentication and tlsConfig enables TLS to the
+// proxy, both may be nil.
+func NewDialer(proxyHost string, proxyPort uint16, auth *proxy.Auth, tlsConfig *tls.Config, forward dialer.Dialer) dialer.Dialer {
+	if forward == nil {
+		forward = dialer.Direct
+	}
+	return &httpDialer{
+		server:  net.JoinHostPort(proxyHost, strconv.Itoa(int(proxyPort))),
+		auth:    auth,
+		tls:     tlsConfig,
+		forward: forward,
+	}
+}
+
+func (d *httpDialer) Dial(network, address string) (net.Conn, error) {
+	if network != "tcp" {
+		return nil, fmt.Errorf("network %v is not supported", network)
+	}
+	c, err := d.forward.Dial("tcp", d.server)
+	if err != nil {
+		return nil, err
+	}
+	if d.tls != nil {
+		tc := tls.Client(c, d.tls)
+		if err := tc.Handshake(); err != nil {
+			c.Close()
+			return nil, fmt.Errorf("tls handshake with proxy failed: %v", err)
+		}
+		c = tc
+	}
+	rc, err := d.connect(c, address)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	return rc, nil
+}
+
+func (d *httpDialer) connect(c net.Conn, address string) (net.Conn, error) {
+	req := "CONNECT " + address + " HTTP/1.1\r\nHost: " + address + "\r\n"
+	if d.auth != nil {
+		cred := base64.StdEncoding.EncodeToString([]byte(d.auth.User + ":" + d.auth.Password))
+		req += "Proxy-Authorization: Basic " + cred + "\r\n"
+	}
+	req += "\r\n"
+	if _, err := c.Write([]byte(req)); err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(c)
+	tp := textproto.NewReader(br)
+	line, err := tp.ReadLine()
+	if err != nil {
+		return nil, fmt.Errorf("read proxy response failed: %v", err)
+	}
+	// HTTP/1.1 200 Connection established
+	f := strings.SplitN(line, " ", 3)
+	if len(f) < 2 || !strings.HasPrefix(f[0], "HTTP/") {
+		return nil, fmt.Errorf("malformed proxy response %q", line)
+	}
+	if _, err := tp.ReadMIMEHeader(); err != nil {
+		return nil, fmt.Errorf("read proxy response failed: %v", err)
+	}
+	switch f[1] {
+	case "200":
+	case "407":
+		return nil, errors.New("proxy authentication required")
+	default:
+		return nil, fmt.Errorf("proxy refused %v: %v", address, strings.Join(f[1:], " "))
+	}
+
+	if br.Buffered() > 0 {
+		return &conn{Conn: c, r: br}, nil
+	}
+	return c, nil
+}
+
+// ListenPacket fails, CONNECT only carries TCP.
+func (d *httpDialer) ListenPacket() (net.PacketConn, error) {
+	return nil, errors.New("http proxy does not support udp")
+}
+
+// conn reads what was buffered with the response first.
+type conn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *conn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
@@ -0,0 +1,145 @@
+package http
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/MissGod1/PProxy/proxy/dialer"
+	"golang.org/x/net/proxy"
+)
+
+// connectHandler is a CONNECT proxy for user:secret that echoes the tunnel.
+// The target decides the answer, "forbidden" gets 403 and "garbage" a
+// malformed status line.
+func connectHandler(t *testing.T, requests chan<- *http.Request) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests <- r
+		if r.Method != http.MethodConnect {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		want := "Basic " + base64.StdEncoding.EncodeToString([]byte("user:secret"))
+		if r.Header.Get("Proxy-Authorization") != want {
+			w.Header().Set("Proxy-Authenticate", `Basic realm="proxy"`)
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+		if strings.HasPrefix(r.Host, "forbidden") {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		c, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer c.Close()
+		if strings.HasPrefix(r.Host, "garbage") {
+			c.Write([]byte("garbage\r\n\r\n"))
+			return
+		}
+		// 和应答一起发送的数据也要能读到
+		c.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\nhello"))
+		io.Copy(c, c)
+	})
+}
+
+func serverAddr(t *testing.T, srv *httptest.Server) (string, uint16) {
+	host, port, err := net.SplitHostPort(srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, _ := strconv.Atoi(port)
+	return host, uint16(p)
+}
+
+func testDialer(t *testing.T, d dialer.Dialer, requests chan *http.Request) {
+	c, err := d.Dial("tcp", "example.com:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	r := <-requests
+	if r.Method != http.MethodConnect || r.Host != "example.com:443" {
+		t.Fatalf("request %v %v", r.Method, r.Host)
+	}
+	// 凭据只放在Proxy-Authorization里
+	if r.Header.Get("Authorization") != "" {
+		t.Fatal("credentials sent as Authorization")
+	}
+
+	b := make([]byte, 5)
+	if _, err := io.ReadFull(c, b); err != nil || string(b) != "hello" {
+		t.Fatalf("buffered data %q %v", b, err)
+	}
+	c.Write([]byte("ping"))
+	b = b[:4]
+	if _, err := io.ReadFull(c, b); err != nil || string(b) != "ping" {
+		t.Fatalf("echo %q %v", b, err)
+	}
+}
+
+func TestDialer(t *testing.T) {
+	requests := make(chan *http.Request, 1)
+	srv := httptest.NewServer(connectHandler(t, requests))
+	defer srv.Close()
+	host, port := serverAddr(t, srv)
+	auth := &proxy.Auth{User: "user", Password: "secret"}
+
+	testDialer(t, NewDialer(host, port, auth, nil, nil), requests)
+
+	cases := []struct {
+		name   string
+		auth   *proxy.Auth
+		target string
+		err    string
+	}{
+		{"no credentials", nil, "example.com:443", "proxy authentication required"},
+		{"wrong credentials", &proxy.Auth{User: "user", Password: "wrong"}, "example.com:443", "proxy authentication required"},
+		{"refused", auth, "forbidden.example.com:443", "403"},
+		{"malformed", auth, "garbage.example.com:443", "malformed"},
+	}
+	for _, c := range cases {
+		_, err := NewDialer(host, port, c.auth, nil, nil).Dial("tcp", c.target)
+		r := <-requests
+		if c.auth == nil && r.Header.Get("Proxy-Authorization") != "" {
+			t.Errorf("%v: credentials sent", c.name)
+		}
+		if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%v: error %v, want %q", c.name, err, c.err)
+		}
+	}
+
+	d := NewDialer(host, port, auth, nil, nil)
+	if _, err := d.Dial("udp", "example.com:53"); err == nil {
+		t.Error("udp dialed")
+	}
+	if _, err := d.ListenPacket(); err == nil {
+		t.Error("udp listened")
+	}
+}
+
+func TestDialerTLS(t *testing.T) {
+	requests := make(chan *http.Request, 1)
+	srv := httptest.NewTLSServer(connectHandler(t, requests))
+	defer srv.Close()
+	host, port := serverAddr(t, srv)
+	auth := &proxy.Auth{User: "user", Password: "secret"}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(srv.Certificate())
+	testDialer(t, NewDialer(host, port, auth, &tls.Config{RootCAs: pool, ServerName: "example.com"}, nil), requests)
+
+	// 证书不匹配时失败
+	if _, err := NewDialer(host, port, auth, &tls.Config{RootCAs: pool, ServerName: "other.org"}, nil).Dial("tcp", "example.com:443"); err == nil {
+		t.Fatal("wrong server name accepted")
+	}
+}
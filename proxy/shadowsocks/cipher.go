@@ -0,0 +1,36 @@
+package shadowsocks
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	sscore "github.com/shadowsocks/go-shadowsocks2/core"
+)
+
+// Cipher wraps the connections to the server.
+type Cipher interface {
+	StreamConn(net.Conn) net.Conn
+	PacketConn(net.PacketConn) net.PacketConn
+}
+
+// PickCipher returns the cipher for method: the AEAD ciphers of
+// go-shadowsocks2, the Shadowsocks 2022 ones, and with legacy the stream
+// ciphers, which have no integrity protection.
+func PickCipher(method, password string, legacy bool) (Cipher, error) {
+	name := strings.ToLower(method)
+	if keySize, ok := ciphers2022[name]; ok {
+		return newCipher2022(name, password, keySize)
+	}
+	if _, ok := streamCiphers[name]; ok {
+		if !legacy {
+			return nil, fmt.Errorf("stream cipher %v needs legacy_cipher", method)
+		}
+		return newStreamCipher(name, password)
+	}
+	ciph, err := sscore.PickCipher(method, []byte{}, password)
+	if err == sscore.ErrCipherNotSupported {
+		return nil, fmt.Errorf("unknown method %v", method)
+	}
+	return ciph, err
+}
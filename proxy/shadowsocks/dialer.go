@@ -0,0 +1,89 @@
+package shadowsocks
+
+import (
+	"errors"
+	"net"
+
+	sssocks "github.com/shadowsocks/go-shadowsocks2/socks"
+
+	"github.com/MissGod1/PProxy/proxy/dialer"
+)
+
+type ssDialer struct {
+	cipher  Cipher
+	server  string
+	forward dialer.Dialer
+}
+
+// NewDialer returns a dialer that connects through the shadowsocks server,
+// which is reached through forward, or directly if forward is nil.
+func NewDialer(server string, ciph Cipher, forward dialer.Dialer) dialer.Dialer {
+	if forward == nil {
+		forward = dialer.Direct
+	}
+	return &ssDialer{
+		cipher:  ciph,
+		server:  server,
+		forward: forward,
+	}
+}
+
+func (d *ssDialer) Dial(network, address string) (net.Conn, error) {
+	tgt := sssocks.ParseAddr(address)
+	if tgt == nil {
+		return nil, errors.New("invalid address " + address)
+	}
+	rc, err := d.forward.Dial("tcp", d.server)
+	if err != nil {
+		return nil, err
+	}
+	rc = d.cipher.StreamConn(rc)
+	if _, err := rc.Write(tgt); err != nil {
+		rc.Close()
+		return nil, err
+	}
+	return rc, nil
+}
+
+func (d *ssDialer) ListenPacket() (net.PacketConn, error) {
+	pc, err := d.forward.ListenPacket()
+	if err != nil {
+		return nil, err
+	}
+	return &packetConn{
+		PacketConn: d.cipher.PacketConn(pc),
+		server:     dialer.Addr(d.server),
+	}, nil
+}
+
+// packetConn puts the target address in front of every datagram.
+type packetConn struct {
+	net.PacketConn
+	server net.Addr
+}
+
+func (c *packetConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	tgt := sssocks.ParseAddr(addr.String())
+	if tgt == nil {
+		return 0, errors.New("invalid address " + addr.String())
+	}
+	if _, err := c.PacketConn.WriteTo(append(tgt, b...), c.server); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *packetConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	buf := make([]byte, len(b)+sssocks.MaxAddrLen)
+	for {
+		n, _, err := c.PacketConn.ReadFrom(buf)
+		if err != nil {
+			return 0, nil, err
+		}
+		addr := sssocks.SplitAddr(buf[:n])
+		if addr == nil {
+			continue
+		}
+		return copy(b, buf[len(addr):n]), dialer.Addr(addr.String()), nil
+	}
+}
@@ -0,0 +1,47 @@
+package shadowsocks
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	sssocks "github.com/shadowsocks/go-shadowsocks2/socks"
+
+	"github.com/MissGod1/PProxy/proxy/dialer"
+)
+
+// Probe sends an HTTP request to target, a host:port, through the
+// shadowsocks server, reached through forward, and waits for the first byte
+// of the response. A wrong password only shows up this way, the server
+// closes the connection.
+func Probe(server string, ciph Cipher, forward dialer.Dialer, target string, timeout time.Duration) error {
+	host, _, err := net.SplitHostPort(target)
+	if err != nil {
+		return err
+	}
+	tgt := sssocks.ParseAddr(target)
+	if tgt == nil {
+		return fmt.Errorf("invalid target %v", target)
+	}
+
+	if forward == nil {
+		forward = dialer.Direct
+	}
+	rc, err := dialer.DialTimeout(forward, "tcp", server, timeout)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	rc.SetDeadline(time.Now().Add(timeout))
+	rc = ciph.StreamConn(rc)
+
+	req := fmt.Sprintf("HEAD / HTTP/1.1\r\nHost: %v\r\nConnection: close\r\n\r\n", host)
+	if _, err := rc.Write(append(tgt, req...)); err != nil {
+		return err
+	}
+	b := make([]byte, 1)
+	if _, err := rc.Read(b); err != nil {
+		return fmt.Errorf("no response from %v: %v", target, err)
+	}
+	return nil
+}
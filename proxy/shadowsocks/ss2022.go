@@ -0,0 +1,178 @@
+package shadowsocks
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"lukechampine.com/blake3"
+)
+
+// Shadowsocks 2022 (SIP022) ciphers and their key sizes. The password is
+// the base64 encoded key.
+var ciphers2022 = map[string]int{
+	"2022-blake3-aes-128-gcm":       16,
+	"2022-blake3-aes-256-gcm":       32,
+	"2022-blake3-chacha20-poly1305": 32,
+}
+
+const (
+	subkeyContext = "shadowsocks 2022 session subkey"
+
+	headerTypeClient = 0
+	headerTypeServer = 1
+
+	// 时间戳相差超过这个值的包被丢弃
+	maxTimeDiff = 30 * time.Second
+	// 2022的数据块比原来的AEAD大
+	maxPayload2022 = 0xFFFF
+	// 没有数据跟着请求头时加上的随机填充
+	maxPadding = 900
+)
+
+var errTimestamp = errors.New("shadowsocks 2022: bad timestamp")
+
+type cipher2022 struct {
+	psk    []byte
+	chacha bool
+	// 加密UDP包头
+	block cipher.Block
+}
+
+func newCipher2022(method, password string, keySize int) (*cipher2022, error) {
+	if strings.Contains(password, ":") {
+		return nil, errors.New("shadowsocks 2022: identity headers are not supported")
+	}
+	psk, err := base64.StdEncoding.DecodeString(password)
+	if err != nil {
+		return nil, fmt.Errorf("shadowsocks 2022: password is not base64: %v", err)
+	}
+	if len(psk) != keySize {
+		return nil, fmt.Errorf("shadowsocks 2022: %v needs a %v byte key", method, keySize)
+	}
+	c := &cipher2022{psk: psk}
+	if strings.HasSuffix(method, "chacha20-poly1305") {
+		c.chacha = true
+	} else if c.block, err = aes.NewCipher(psk); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// subkey derives the session key from the salt or session ID.
+func (c *cipher2022) subkey(salt []byte) []byte {
+	material := make([]byte, 0, len(c.psk)+len(salt))
+	material = append(material, c.psk...)
+	material = append(material, salt...)
+	key := make([]byte, len(c.psk))
+	blake3.DeriveKey(key, subkeyContext, material)
+	return key
+}
+
+func (c *cipher2022) aead(key []byte) (cipher.AEAD, error) {
+	if c.chacha {
+		return chacha20poly1305.New(key)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func checkTimestamp(b []byte) error {
+	ts := time.Unix(int64(binary.BigEndian.Uint64(b)), 0)
+	if d := time.Since(ts); d > maxTimeDiff || d < -maxTimeDiff {
+		return errTimestamp
+	}
+	return nil
+}
+
+func putTimestamp(b []byte) {
+	binary.BigEndian.PutUint64(b, uint64(time.Now().Unix()))
+}
+
+func randomPadding() int {
+	b := make([]byte, 2)
+	rand.Read(b)
+	return 1 + int(binary.BigEndian.Uint16(b))%maxPadding
+}
+
+// saltPool remembers the salts seen in the last minute, a repeated salt is
+// a replayed response.
+type saltPool struct {
+	sync.Mutex
+	salts map[string]time.Time
+	clean time.Time
+}
+
+var responseSalts = &saltPool{salts: make(map[string]time.Time)}
+
+// add returns false if salt was already seen.
+func (p *saltPool) add(salt []byte) bool {
+	now := time.Now()
+	p.Lock()
+	defer p.Unlock()
+	if now.After(p.clean) {
+		for s, expire := range p.salts {
+			if now.After(expire) {
+				delete(p.salts, s)
+			}
+		}
+		p.clean = now.Add(maxTimeDiff)
+	}
+	if expire, ok := p.salts[string(salt)]; ok && now.Before(expire) {
+		return false
+	}
+	p.salts[string(salt)] = now.Add(2 * maxTimeDiff)
+	return true
+}
+
+// increment increments the little-endian nonce.
+func increment(b []byte) {
+	for i := range b {
+		b[i]++
+		if b[i] != 0 {
+			return
+		}
+	}
+}
+
+type aeadStream struct {
+	cipher.AEAD
+	nonce []byte
+}
+
+func newAEADStream(aead cipher.AEAD) *aeadStream {
+	return &aeadStream{AEAD: aead, nonce: make([]byte, aead.NonceSize())}
+}
+
+func (s *aeadStream) seal(dst, b []byte) []byte {
+	dst = s.Seal(dst, s.nonce, b, nil)
+	increment(s.nonce)
+	return dst
+}
+
+func (s *aeadStream) open(b []byte) ([]byte, error) {
+	b, err := s.Open(b[:0], s.nonce, b, nil)
+	increment(s.nonce)
+	return b, err
+}
+
+// readChunk reads and opens a sealed chunk of n bytes.
+func (s *aeadStream) readChunk(r io.Reader, n int) ([]byte, error) {
+	b := make([]byte, n+s.Overhead())
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	return s.open(b)
+}
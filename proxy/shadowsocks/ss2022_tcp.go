@@ -0,0 +1,183 @@
+package shadowsocks
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+
+	sssocks "github.com/shadowsocks/go-shadowsocks2/socks"
+)
+
+// StreamConn wraps conn like the other ciphers. The first write must start
+// with the target address, it is sent in the request header.
+func (c *cipher2022) StreamConn(conn net.Conn) net.Conn {
+	return &streamConn2022{Conn: conn, cipher: c}
+}
+
+type streamConn2022 struct {
+	net.Conn
+	cipher *cipher2022
+
+	wmu sync.Mutex
+	w   *aeadStream
+
+	// 请求的salt, 应答头中要带回来. 写数据时可能阻塞, 不能用wmu
+	smu         sync.Mutex
+	requestSalt []byte
+
+	rmu sync.Mutex
+	r   *aeadStream
+	buf []byte
+}
+
+func (c *streamConn2022) Write(b []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	payload := b
+	if c.w == nil {
+		addr := sssocks.SplitAddr(b)
+		if addr == nil {
+			return 0, errors.New("shadowsocks 2022: first write is not an address")
+		}
+		payload = b[len(addr):]
+		// 可变长度的头最长0xFFFF, 剩下的数据按普通的数据块发送
+		n := len(payload)
+		if max := maxPayload2022 - len(addr) - 2; n > max {
+			n = max
+		}
+		if err := c.writeHeader(addr, payload[:n]); err != nil {
+			return 0, err
+		}
+		payload = payload[n:]
+	}
+
+	for len(payload) > 0 {
+		n := len(payload)
+		if n > maxPayload2022 {
+			n = maxPayload2022
+		}
+		buf := make([]byte, 0, 2+n+2*c.w.Overhead())
+		buf = c.w.seal(buf, []byte{byte(n >> 8), byte(n)})
+		buf = c.w.seal(buf, payload[:n])
+		if _, err := c.Conn.Write(buf); err != nil {
+			return len(b) - len(payload), err
+		}
+		payload = payload[n:]
+	}
+	return len(b), nil
+}
+
+// writeHeader sends salt, fixed-length header and variable-length header.
+func (c *streamConn2022) writeHeader(addr, payload []byte) error {
+	salt := make([]byte, len(c.cipher.psk))
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+	aead, err := c.cipher.aead(c.cipher.subkey(salt))
+	if err != nil {
+		return err
+	}
+	w := newAEADStream(aead)
+
+	padding := 0
+	if len(payload) == 0 {
+		padding = randomPadding()
+	}
+	// ATYP ADDR PORT | padding length | padding | initial payload
+	varHeader := make([]byte, 0, len(addr)+2+padding+len(payload))
+	varHeader = append(varHeader, addr...)
+	varHeader = append(varHeader, byte(padding>>8), byte(padding))
+	varHeader = append(varHeader, make([]byte, padding)...)
+	rand.Read(varHeader[len(addr)+2:])
+	varHeader = append(varHeader, payload...)
+
+	// type | timestamp | length
+	fixed := make([]byte, 1+8+2)
+	fixed[0] = headerTypeClient
+	putTimestamp(fixed[1:])
+	binary.BigEndian.PutUint16(fixed[9:], uint16(len(varHeader)))
+
+	buf := make([]byte, 0, len(salt)+len(fixed)+len(varHeader)+2*aead.Overhead())
+	buf = append(buf, salt...)
+	buf = w.seal(buf, fixed)
+	buf = w.seal(buf, varHeader)
+	c.smu.Lock()
+	c.requestSalt = salt
+	c.smu.Unlock()
+	if _, err := c.Conn.Write(buf); err != nil {
+		return err
+	}
+	c.w = w
+	return nil
+}
+
+func (c *streamConn2022) Read(b []byte) (int, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+
+	for len(c.buf) == 0 {
+		var err error
+		if c.r == nil {
+			c.buf, err = c.readHeader()
+		} else {
+			c.buf, err = c.readChunk()
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	n := copy(b, c.buf)
+	c.buf = c.buf[n:]
+	return n, nil
+}
+
+// readHeader reads the response header and returns the first payload.
+func (c *streamConn2022) readHeader() ([]byte, error) {
+	salt := make([]byte, len(c.cipher.psk))
+	if _, err := io.ReadFull(c.Conn, salt); err != nil {
+		return nil, err
+	}
+	aead, err := c.cipher.aead(c.cipher.subkey(salt))
+	if err != nil {
+		return nil, err
+	}
+	r := newAEADStream(aead)
+
+	// type | timestamp | request salt | length
+	fixed, err := r.readChunk(c.Conn, 1+8+len(salt)+2)
+	if err != nil {
+		return nil, err
+	}
+	if fixed[0] != headerTypeServer {
+		return nil, errors.New("shadowsocks 2022: bad header type")
+	}
+	if !responseSalts.add(salt) {
+		return nil, errors.New("shadowsocks 2022: repeated salt")
+	}
+	if err := checkTimestamp(fixed[1:]); err != nil {
+		return nil, err
+	}
+	c.smu.Lock()
+	requestSalt := c.requestSalt
+	c.smu.Unlock()
+	if !bytes.Equal(fixed[9:9+len(salt)], requestSalt) {
+		return nil, errors.New("shadowsocks 2022: request salt mismatch")
+	}
+	n := int(binary.BigEndian.Uint16(fixed[9+len(salt):]))
+
+	c.r = r
+	return r.readChunk(c.Conn, n)
+}
+
+func (c *streamConn2022) readChunk() ([]byte, error) {
+	b, err := c.r.readChunk(c.Conn, 2)
+	if err != nil {
+		return nil, err
+	}
+	return c.r.readChunk(c.Conn, int(binary.BigEndian.Uint16(b)))
+}
@@ -0,0 +1,405 @@
+package shadowsocks
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	sssocks "github.com/shadowsocks/go-shadowsocks2/socks"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+func newTestCipher(t *testing.T, method string) *cipher2022 {
+	key := make([]byte, ciphers2022[method])
+	rand.Read(key)
+	c, err := newCipher2022(method, base64.StdEncoding.EncodeToString(key), len(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+var methods2022 = []string{
+	"2022-blake3-aes-128-gcm",
+	"2022-blake3-aes-256-gcm",
+	"2022-blake3-chacha20-poly1305",
+}
+
+// testServer is the server side of a 2022 TCP connection.
+type testServer struct {
+	conn   net.Conn
+	cipher *cipher2022
+	r, w   *aeadStream
+	salt   []byte
+}
+
+// readRequest reads the request header and returns the address and the
+// initial payload.
+func (s *testServer) readRequest() (addr, payload []byte, padding int, err error) {
+	s.salt = make([]byte, len(s.cipher.psk))
+	if _, err = io.ReadFull(s.conn, s.salt); err != nil {
+		return
+	}
+	aead, err := s.cipher.aead(s.cipher.subkey(s.salt))
+	if err != nil {
+		return
+	}
+	s.r = newAEADStream(aead)
+	fixed, err := s.r.readChunk(s.conn, 1+8+2)
+	if err != nil {
+		return
+	}
+	if fixed[0] != headerTypeClient {
+		err = errors.New("bad header type")
+		return
+	}
+	if err = checkTimestamp(fixed[1:]); err != nil {
+		return
+	}
+	varHeader, err := s.r.readChunk(s.conn, int(binary.BigEndian.Uint16(fixed[9:])))
+	if err != nil {
+		return
+	}
+	addr = sssocks.SplitAddr(varHeader)
+	if addr == nil {
+		err = errors.New("bad address")
+		return
+	}
+	varHeader = varHeader[len(addr):]
+	padding = int(binary.BigEndian.Uint16(varHeader))
+	payload = varHeader[2+padding:]
+	return
+}
+
+func (s *testServer) readChunk() ([]byte, error) {
+	b, err := s.r.readChunk(s.conn, 2)
+	if err != nil {
+		return nil, err
+	}
+	return s.r.readChunk(s.conn, int(binary.BigEndian.Uint16(b)))
+}
+
+// writeResponse sends the response header with the first payload, the
+// request salt in the header is requestSalt.
+func (s *testServer) writeResponse(typ byte, requestSalt, payload []byte) error {
+	salt := make([]byte, len(s.cipher.psk))
+	rand.Read(salt)
+	aead, err := s.cipher.aead(s.cipher.subkey(salt))
+	if err != nil {
+		return err
+	}
+	s.w = newAEADStream(aead)
+
+	fixed := make([]byte, 1+8+len(salt)+2)
+	fixed[0] = typ
+	putTimestamp(fixed[1:])
+	copy(fixed[9:], requestSalt)
+	binary.BigEndian.PutUint16(fixed[9+len(salt):], uint16(len(payload)))
+
+	buf := append([]byte(nil), salt...)
+	buf = s.w.seal(buf, fixed)
+	buf = s.w.seal(buf, payload)
+	_, err = s.conn.Write(buf)
+	return err
+}
+
+func (s *testServer) writeChunk(payload []byte) error {
+	buf := s.w.seal(nil, []byte{byte(len(payload) >> 8), byte(len(payload))})
+	buf = s.w.seal(buf, payload)
+	_, err := s.conn.Write(buf)
+	return err
+}
+
+func TestStreamConn2022(t *testing.T) {
+	for _, method := range methods2022 {
+		t.Run(method, func(t *testing.T) {
+			ciph := newTestCipher(t, method)
+			c1, c2 := net.Pipe()
+			defer c1.Close()
+			defer c2.Close()
+			client := ciph.StreamConn(c1)
+			server := &testServer{conn: c2, cipher: ciph}
+
+			target := sssocks.ParseAddr("example.com:443")
+			request := bytes.Repeat([]byte("q"), maxPayload2022+100)
+			response := bytes.Repeat([]byte("r"), 2*maxPayload2022)
+			errc := make(chan error, 1)
+			go func() {
+				errc <- func() error {
+					addr, payload, _, err := server.readRequest()
+					if err != nil {
+						return err
+					}
+					if !bytes.Equal(addr, target) {
+						return errors.New("address mismatch")
+					}
+					// 头里放不下的部分作为普通数据块
+					for len(payload) < len(request) {
+						b, err := server.readChunk()
+						if err != nil {
+							return err
+						}
+						payload = append(payload, b...)
+					}
+					if !bytes.Equal(payload, request) {
+						return errors.New("request mismatch")
+					}
+					if err := server.writeResponse(headerTypeServer, server.salt, response[:maxPayload2022]); err != nil {
+						return err
+					}
+					return server.writeChunk(response[maxPayload2022:])
+				}()
+			}()
+
+			if _, err := client.Write(append(append([]byte(nil), target...), request...)); err != nil {
+				t.Fatal(err)
+			}
+			b := make([]byte, len(response))
+			if _, err := io.ReadFull(client, b); err != nil {
+				t.Fatal(err)
+			}
+			if err := <-errc; err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(b, response) {
+				t.Fatal("response mismatch")
+			}
+		})
+	}
+}
+
+// 只有地址没有数据时请求头带随机填充
+func TestStreamConn2022Padding(t *testing.T) {
+	ciph := newTestCipher(t, methods2022[0])
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	client := ciph.StreamConn(c1)
+	server := &testServer{conn: c2, cipher: ciph}
+
+	go client.Write(sssocks.ParseAddr("1.2.3.4:80"))
+	_, payload, padding, err := server.readRequest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if padding < 1 || padding > maxPadding || len(payload) != 0 {
+		t.Fatalf("padding %v, payload %v", padding, len(payload))
+	}
+}
+
+func TestStreamConn2022BadResponse(t *testing.T) {
+	cases := []struct {
+		name  string
+		typ   byte
+		wrong bool
+	}{
+		{"type", headerTypeClient, false},
+		{"request salt", headerTypeServer, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ciph := newTestCipher(t, methods2022[0])
+			c1, c2 := net.Pipe()
+			defer c1.Close()
+			defer c2.Close()
+			client := ciph.StreamConn(c1)
+			server := &testServer{conn: c2, cipher: ciph}
+
+			go func() {
+				if _, _, _, err := server.readRequest(); err != nil {
+					return
+				}
+				salt := server.salt
+				if c.wrong {
+					salt = make([]byte, len(salt))
+				}
+				server.writeResponse(c.typ, salt, []byte("x"))
+			}()
+			if _, err := client.Write(sssocks.ParseAddr("1.2.3.4:80")); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := client.Read(make([]byte, 1)); err == nil {
+				t.Fatal("bad response accepted")
+			}
+		})
+	}
+}
+
+// fakePacketConn keeps the written packets.
+type fakePacketConn struct {
+	net.PacketConn
+	written [][]byte
+}
+
+func (c *fakePacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.written = append(c.written, append([]byte(nil), b...))
+	return len(b), nil
+}
+
+// openClientPacket decrypts a packet written by the client like the
+// server does and returns the client session ID and the body.
+func openClientPacket(t *testing.T, c *cipher2022, b []byte) (uint64, []byte) {
+	var header, body []byte
+	if c.chacha {
+		aead, err := chacha20poly1305.NewX(c.psk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		plain, err := aead.Open(nil, b[:aead.NonceSize()], b[aead.NonceSize():], nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		header, body = plain[:16], plain[16:]
+	} else {
+		header = make([]byte, 16)
+		c.block.Decrypt(header, b[:16])
+		aead, err := c.aead(c.subkey(header[:8]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err = aead.Open(nil, header[4:16], b[16:], nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if body[0] != headerTypeClient {
+		t.Fatalf("header type %v", body[0])
+	}
+	if err := checkTimestamp(body[1:]); err != nil {
+		t.Fatal(err)
+	}
+	padding := int(binary.BigEndian.Uint16(body[9:]))
+	return binary.BigEndian.Uint64(header), body[11+padding:]
+}
+
+// sealServerPacket builds a packet of the server session for the client
+// session.
+func sealServerPacket(t *testing.T, c *cipher2022, session, packetID, client uint64, ts time.Time, payload []byte) []byte {
+	header := make([]byte, 16)
+	binary.BigEndian.PutUint64(header, session)
+	binary.BigEndian.PutUint64(header[8:], packetID)
+	body := make([]byte, 1+8+8+2, 1+8+8+2+len(payload))
+	body[0] = headerTypeServer
+	binary.BigEndian.PutUint64(body[1:], uint64(ts.Unix()))
+	binary.BigEndian.PutUint64(body[9:], client)
+	body = append(body, payload...)
+
+	if c.chacha {
+		aead, err := chacha20poly1305.NewX(c.psk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, aead.NonceSize())
+		rand.Read(buf)
+		return aead.Seal(buf, buf, append(header, body...), nil)
+	}
+	aead, err := c.aead(c.subkey(header[:8]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 16)
+	c.block.Encrypt(buf, header)
+	return aead.Seal(buf, header[4:16], body, nil)
+}
+
+func TestPacketConn2022(t *testing.T) {
+	// AES加密单独的包头, chacha用XChaCha加密整个包
+	for _, method := range []string{methods2022[0], methods2022[2]} {
+		t.Run(method, func(t *testing.T) {
+			ciph := newTestCipher(t, method)
+			fake := &fakePacketConn{}
+			pc := ciph.PacketConn(fake).(*packetConn2022)
+
+			datagram := append(sssocks.ParseAddr("8.8.8.8:53"), "query"...)
+			for i := 0; i < 2; i++ {
+				if _, err := pc.WriteTo(datagram, nil); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, b := range fake.written {
+				session, body := openClientPacket(t, ciph, b)
+				if session != pc.sessionID || !bytes.Equal(body, datagram) {
+					t.Fatalf("session %v, body %q", session, body)
+				}
+			}
+
+			reply := append(sssocks.ParseAddr("8.8.8.8:53"), "answer"...)
+			b := sealServerPacket(t, ciph, 7, 0, pc.sessionID, time.Now(), reply)
+			payload, err := pc.open(append([]byte(nil), b...))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(payload, reply) {
+				t.Fatalf("payload %q", payload)
+			}
+			if _, err := pc.open(b); err == nil {
+				t.Fatal("replayed packet accepted")
+			}
+		})
+	}
+}
+
+func TestPacketConn2022Reject(t *testing.T) {
+	for _, method := range []string{methods2022[0], methods2022[2]} {
+		t.Run(method, func(t *testing.T) {
+			ciph := newTestCipher(t, method)
+			pc := ciph.PacketConn(&fakePacketConn{}).(*packetConn2022)
+			reply := append(sssocks.ParseAddr("8.8.8.8:53"), "answer"...)
+
+			cases := []struct {
+				name   string
+				client uint64
+				ts     time.Time
+			}{
+				{"old timestamp", pc.sessionID, time.Now().Add(-2 * maxTimeDiff)},
+				{"future timestamp", pc.sessionID, time.Now().Add(2 * maxTimeDiff)},
+				{"other session", pc.sessionID + 1, time.Now()},
+			}
+			for i, c := range cases {
+				b := sealServerPacket(t, ciph, 7, uint64(i), c.client, c.ts, reply)
+				if _, err := pc.open(b); err == nil {
+					t.Errorf("%v accepted", c.name)
+				}
+			}
+			// 被拒绝的包不占用窗口
+			b := sealServerPacket(t, ciph, 7, 0, pc.sessionID, time.Now(), reply)
+			if _, err := pc.open(b); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestWindow(t *testing.T) {
+	var w window
+	steps := []struct {
+		id uint64
+		ok bool
+	}{
+		{5, true},
+		{5, false}, // 重复
+		{3, true},  // 乱序
+		{3, false},
+		{6, true},
+		{69, true}, // 前进63, 6还在窗口里
+		{6, false}, // 窗口的最后一位
+		{5, false}, // 超出窗口
+		{69, false},
+		{200, true}, // 前进超过64, 窗口清空
+		{137, true},
+		{136, false}, // 刚好超出窗口
+		{199, true},
+		{199, false},
+	}
+	for i, s := range steps {
+		if ok := w.check(s.id); ok != s.ok {
+			t.Fatalf("step %v: check(%v) = %v, want %v", i, s.id, ok, s.ok)
+		}
+	}
+}
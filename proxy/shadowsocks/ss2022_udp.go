@@ -0,0 +1,224 @@
+package shadowsocks
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	sssocks "github.com/shadowsocks/go-shadowsocks2/socks"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// PacketConn wraps pc like the other ciphers, the datagrams are the target
+// address followed by the payload. Every PacketConn is one client session.
+func (c *cipher2022) PacketConn(pc net.PacketConn) net.PacketConn {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return &packetConn2022{
+		PacketConn: pc,
+		cipher:     c,
+		sessionID:  binary.BigEndian.Uint64(b),
+		servers:    make(map[uint64]*serverSession),
+	}
+}
+
+type serverSession struct {
+	aead     cipher.AEAD
+	window   window
+	lastSeen time.Time
+}
+
+type packetConn2022 struct {
+	net.PacketConn
+	cipher *cipher2022
+
+	wmu       sync.Mutex
+	sessionID uint64
+	packetID  uint64
+	aead      cipher.AEAD
+
+	rmu sync.Mutex
+	// 服务器重启后会换一个会话
+	servers map[uint64]*serverSession
+}
+
+func (c *packetConn2022) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	// session ID | packet ID
+	header := make([]byte, 16)
+	binary.BigEndian.PutUint64(header, c.sessionID)
+	binary.BigEndian.PutUint64(header[8:], c.packetID)
+	c.packetID++
+
+	// type | timestamp | padding length | ATYP ADDR PORT | payload
+	body := make([]byte, 1+8+2, 1+8+2+len(b))
+	body[0] = headerTypeClient
+	putTimestamp(body[1:])
+	body = append(body, b...)
+
+	var buf []byte
+	if c.cipher.chacha {
+		aead, err := chacha20poly1305.NewX(c.cipher.psk)
+		if err != nil {
+			return 0, err
+		}
+		buf = make([]byte, aead.NonceSize(), aead.NonceSize()+len(header)+len(body)+aead.Overhead())
+		rand.Read(buf)
+		buf = aead.Seal(buf, buf[:aead.NonceSize()], append(header, body...), nil)
+	} else {
+		if c.aead == nil {
+			aead, err := c.cipher.aead(c.cipher.subkey(header[:8]))
+			if err != nil {
+				return 0, err
+			}
+			c.aead = aead
+		}
+		buf = make([]byte, len(header), len(header)+len(body)+c.aead.Overhead())
+		buf = c.aead.Seal(buf, header[4:16], body, nil)
+		c.cipher.block.Encrypt(buf[:16], header)
+	}
+	if _, err := c.PacketConn.WriteTo(buf, addr); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *packetConn2022) ReadFrom(b []byte) (int, net.Addr, error) {
+	buf := make([]byte, maxPayload2022)
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(buf)
+		if err != nil {
+			return 0, nil, err
+		}
+		payload, err := c.open(buf[:n])
+		if err != nil {
+			// 丢弃无法解密和重放的包
+			continue
+		}
+		return copy(b, payload), addr, nil
+	}
+}
+
+// open decrypts a packet from the server and returns the address and the
+// payload.
+func (c *packetConn2022) open(b []byte) ([]byte, error) {
+	var header, body []byte
+	if c.cipher.chacha {
+		aead, err := chacha20poly1305.NewX(c.cipher.psk)
+		if err != nil {
+			return nil, err
+		}
+		if len(b) < aead.NonceSize()+16+aead.Overhead() {
+			return nil, errors.New("shadowsocks 2022: short packet")
+		}
+		plain, err := aead.Open(nil, b[:aead.NonceSize()], b[aead.NonceSize():], nil)
+		if err != nil || len(plain) < 16 {
+			return nil, errors.New("shadowsocks 2022: bad packet")
+		}
+		header, body = plain[:16], plain[16:]
+	} else {
+		if len(b) < 16 {
+			return nil, errors.New("shadowsocks 2022: short packet")
+		}
+		header = make([]byte, 16)
+		c.cipher.block.Decrypt(header, b[:16])
+		body = b[16:]
+	}
+	sessionID := binary.BigEndian.Uint64(header)
+	packetID := binary.BigEndian.Uint64(header[8:])
+
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	s, ok := c.servers[sessionID]
+	if !ok {
+		s = &serverSession{}
+		if !c.cipher.chacha {
+			aead, err := c.cipher.aead(c.cipher.subkey(header[:8]))
+			if err != nil {
+				return nil, err
+			}
+			s.aead = aead
+		}
+	}
+	if s.aead != nil {
+		var err error
+		body, err = s.aead.Open(body[:0], header[4:16], body, nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// type | timestamp | client session ID | padding length | padding
+	if len(body) < 1+8+8+2 {
+		return nil, errors.New("shadowsocks 2022: short packet")
+	}
+	if body[0] != headerTypeServer {
+		return nil, errors.New("shadowsocks 2022: bad header type")
+	}
+	if err := checkTimestamp(body[1:]); err != nil {
+		return nil, err
+	}
+	if binary.BigEndian.Uint64(body[9:]) != c.sessionID {
+		return nil, errors.New("shadowsocks 2022: session mismatch")
+	}
+	padding := int(binary.BigEndian.Uint16(body[17:]))
+	body = body[19:]
+	if len(body) < padding {
+		return nil, errors.New("shadowsocks 2022: short packet")
+	}
+	body = body[padding:]
+	if sssocks.SplitAddr(body) == nil {
+		return nil, errors.New("shadowsocks 2022: bad address")
+	}
+	if !s.window.check(packetID) {
+		return nil, errors.New("shadowsocks 2022: replayed packet")
+	}
+
+	now := time.Now()
+	if !ok {
+		for id, old := range c.servers {
+			if now.Sub(old.lastSeen) > 2*maxTimeDiff {
+				delete(c.servers, id)
+			}
+		}
+		c.servers[sessionID] = s
+	}
+	s.lastSeen = now
+	return body, nil
+}
+
+const windowSize = 64
+
+// window is a sliding window of the packet IDs already received.
+type window struct {
+	init bool
+	last uint64
+	bits uint64
+}
+
+// check marks id as received, it returns false if it was already or is too
+// old to tell.
+func (w *window) check(id uint64) bool {
+	if !w.init || id > w.last {
+		if !w.init || id-w.last >= windowSize {
+			w.bits = 1
+		} else {
+			w.bits = w.bits<<(id-w.last) | 1
+		}
+		w.init = true
+		w.last = id
+		return true
+	}
+	off := w.last - id
+	if off >= windowSize || w.bits&(1<<off) != 0 {
+		return false
+	}
+	w.bits |= 1 << off
+	return true
+}
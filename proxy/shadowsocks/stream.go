@@ -0,0 +1,189 @@
+package shadowsocks
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/md5"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"sync"
+
+	"golang.org/x/crypto/chacha20"
+)
+
+// Legacy stream ciphers with their key and IV sizes.
+var streamCiphers = map[string]struct {
+	keySize, ivSize int
+	new             func(key, iv []byte, decrypt bool) (cipher.Stream, error)
+}{
+	"aes-128-ctr":   {16, 16, aesCTR},
+	"aes-192-ctr":   {24, 16, aesCTR},
+	"aes-256-ctr":   {32, 16, aesCTR},
+	"aes-128-cfb":   {16, 16, aesCFB},
+	"aes-192-cfb":   {24, 16, aesCFB},
+	"aes-256-cfb":   {32, 16, aesCFB},
+	"chacha20-ietf": {32, 12, chacha},
+	"xchacha20":     {32, 24, chacha},
+}
+
+func aesCTR(key, iv []byte, decrypt bool) (cipher.Stream, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewCTR(block, iv), nil
+}
+
+func aesCFB(key, iv []byte, decrypt bool) (cipher.Stream, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if decrypt {
+		return cipher.NewCFBDecrypter(block, iv), nil
+	}
+	return cipher.NewCFBEncrypter(block, iv), nil
+}
+
+func chacha(key, iv []byte, decrypt bool) (cipher.Stream, error) {
+	return chacha20.NewUnauthenticatedCipher(key, iv)
+}
+
+// kdf is EVP_BytesToKey with MD5 like the original shadowsocks.
+func kdf(password string, keyLen int) []byte {
+	var b, prev []byte
+	h := md5.New()
+	for len(b) < keyLen {
+		h.Write(prev)
+		h.Write([]byte(password))
+		b = h.Sum(b)
+		prev = b[len(b)-h.Size():]
+		h.Reset()
+	}
+	return b[:keyLen]
+}
+
+type streamCipher struct {
+	key    []byte
+	ivSize int
+	new    func(key, iv []byte, decrypt bool) (cipher.Stream, error)
+}
+
+func newStreamCipher(method, password string) (*streamCipher, error) {
+	c := streamCiphers[method]
+	return &streamCipher{
+		key:    kdf(password, c.keySize),
+		ivSize: c.ivSize,
+		new:    c.new,
+	}, nil
+}
+
+// StreamConn sends a random IV before the encrypted stream in each
+// direction.
+func (c *streamCipher) StreamConn(conn net.Conn) net.Conn {
+	return &streamConn{Conn: conn, cipher: c}
+}
+
+// PacketConn puts a random IV before every encrypted datagram.
+func (c *streamCipher) PacketConn(pc net.PacketConn) net.PacketConn {
+	return &streamPacketConn{PacketConn: pc, cipher: c}
+}
+
+type streamConn struct {
+	net.Conn
+	cipher *streamCipher
+
+	wmu sync.Mutex
+	w   cipher.Stream
+	rmu sync.Mutex
+	r   cipher.Stream
+}
+
+func (c *streamConn) Write(b []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	var buf []byte
+	if c.w == nil {
+		iv := make([]byte, c.cipher.ivSize)
+		if _, err := rand.Read(iv); err != nil {
+			return 0, err
+		}
+		w, err := c.cipher.new(c.cipher.key, iv, false)
+		if err != nil {
+			return 0, err
+		}
+		c.w = w
+		buf = iv
+	}
+	n := len(buf)
+	buf = append(buf, b...)
+	c.w.XORKeyStream(buf[n:], buf[n:])
+	if _, err := c.Conn.Write(buf); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *streamConn) Read(b []byte) (int, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+
+	if c.r == nil {
+		iv := make([]byte, c.cipher.ivSize)
+		if _, err := io.ReadFull(c.Conn, iv); err != nil {
+			return 0, err
+		}
+		r, err := c.cipher.new(c.cipher.key, iv, true)
+		if err != nil {
+			return 0, err
+		}
+		c.r = r
+	}
+	n, err := c.Conn.Read(b)
+	c.r.XORKeyStream(b[:n], b[:n])
+	return n, err
+}
+
+type streamPacketConn struct {
+	net.PacketConn
+	cipher *streamCipher
+}
+
+func (c *streamPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	buf := make([]byte, c.cipher.ivSize+len(b))
+	iv := buf[:c.cipher.ivSize]
+	if _, err := rand.Read(iv); err != nil {
+		return 0, err
+	}
+	s, err := c.cipher.new(c.cipher.key, iv, false)
+	if err != nil {
+		return 0, err
+	}
+	s.XORKeyStream(buf[len(iv):], b)
+	if _, err := c.PacketConn.WriteTo(buf, addr); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *streamPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	buf := make([]byte, c.cipher.ivSize+len(b))
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(buf)
+		if err != nil {
+			return 0, nil, err
+		}
+		if n < c.cipher.ivSize {
+			continue
+		}
+		s, err := c.cipher.new(c.cipher.key, buf[:c.cipher.ivSize], true)
+		if err != nil {
+			return 0, nil, errors.New("shadowsocks: bad iv")
+		}
+		s.XORKeyStream(b, buf[c.cipher.ivSize:n])
+		return n - c.cipher.ivSize, addr, nil
+	}
+}
@@ -0,0 +1,208 @@
+package shadowsocks
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+func unhex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// 和openssl enc -nosalt -md md5 -P得到的key一样
+func TestKDF(t *testing.T) {
+	cases := []struct {
+		password string
+		keyLen   int
+		key      string
+	}{
+		{"password", 16, "5f4dcc3b5aa765d61d8327deb882cf99"},
+		{"password", 32, "5f4dcc3b5aa765d61d8327deb882cf992b95990a9151374abd8ff8c5a7a0fe08"},
+		{"shadowsocks", 24, "d210b068815fd83ccce65e5fe82f905c7bd39705b9454e57"},
+	}
+	for _, c := range cases {
+		if got := hex.EncodeToString(kdf(c.password, c.keyLen)); got != c.key {
+			t.Errorf("kdf(%q, %v) = %v, want %v", c.password, c.keyLen, got, c.key)
+		}
+	}
+}
+
+const (
+	vectorKey   = "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+	vectorPlain = "The quick brown fox jumps over the lazy dog."
+)
+
+// 密文由openssl enc用同样的key和iv生成, chacha20的iv前4字节是计数器
+var streamVectors = []struct {
+	method string
+	iv     string
+	cipher string
+}{
+	{"aes-256-cfb", "f0f1f2f3f4f5f6f7f8f9fafbfcfdfeff", "c668a8ad52e3e9a8314984262f450d34bde46567508dd25ad3930ca26727c2cefa6fd3972af6f01f3f64a4ad"},
+	{"aes-256-ctr", "f0f1f2f3f4f5f6f7f8f9fafbfcfdfeff", "c668a8ad52e3e9a8314984262f450d34ac3003609b5f59b11d873a572f05a6faf109013775628cb81cea473e"},
+	{"chacha20-ietf", "000102030405060708090a0b", "44529431b0fe3dfe5204edc21217acbaf3bea3a8b2e79ac4dc50f529b108be3fbd9aba09ecaf5550ef807821"},
+}
+
+func TestStreamCipherVectors(t *testing.T) {
+	key := unhex(t, vectorKey)
+	for _, v := range streamVectors {
+		c := streamCiphers[v.method]
+		iv, want := unhex(t, v.iv), unhex(t, v.cipher)
+		if len(iv) != c.ivSize {
+			t.Fatalf("%v: iv size %v", v.method, c.ivSize)
+		}
+
+		s, err := c.new(key[:c.keySize], iv, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := []byte(vectorPlain)
+		s.XORKeyStream(got, got)
+		if !bytes.Equal(got, want) {
+			t.Errorf("%v: encrypted %x, want %x", v.method, got, want)
+		}
+
+		// 分成不对齐的几段解密, 结果要和一次解密相同
+		s, err = c.new(key[:c.keySize], iv, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		plain := append([]byte(nil), want...)
+		for _, b := range [][]byte{plain[:3], plain[3:20], plain[20:]} {
+			s.XORKeyStream(b, b)
+		}
+		if string(plain) != vectorPlain {
+			t.Errorf("%v: decrypted %q", v.method, plain)
+		}
+	}
+}
+
+// 每个方向先发IV, 之后是加密的数据流
+func TestStreamConn(t *testing.T) {
+	for method, m := range streamCiphers {
+		ciph, err := newStreamCipher(method, "password")
+		if err != nil {
+			t.Fatal(err)
+		}
+		key := kdf("password", m.keySize)
+		c1, c2 := net.Pipe()
+		client := ciph.StreamConn(c1)
+
+		errc := make(chan error, 1)
+		go func() {
+			errc <- func() error {
+				for _, s := range []string{"hello ", "world"} {
+					if _, err := client.Write([]byte(s)); err != nil {
+						return err
+					}
+				}
+				return nil
+			}()
+		}()
+		wire := make([]byte, m.ivSize+len("hello world"))
+		if _, err := io.ReadFull(c2, wire); err != nil {
+			t.Fatal(err)
+		}
+		if err := <-errc; err != nil {
+			t.Fatal(err)
+		}
+		s, err := m.new(key, wire[:m.ivSize], true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		plain := wire[m.ivSize:]
+		s.XORKeyStream(plain, plain)
+		if string(plain) != "hello world" {
+			t.Fatalf("%v: server got %q", method, plain)
+		}
+
+		iv := bytes.Repeat([]byte{7}, m.ivSize)
+		s, err = m.new(key, iv, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response := []byte("response")
+		s.XORKeyStream(response, response)
+		go func() {
+			c2.Write(append(iv, response...))
+			c2.Close()
+		}()
+		b, err := ioutil.ReadAll(client)
+		if err != nil || string(b) != "response" {
+			t.Fatalf("%v: client got %q %v", method, b, err)
+		}
+		client.Close()
+	}
+}
+
+// queuePacketConn returns the queued packets and keeps the written ones.
+type queuePacketConn struct {
+	fakePacketConn
+	queue [][]byte
+}
+
+func (c *queuePacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	if len(c.queue) == 0 {
+		return 0, nil, io.EOF
+	}
+	n := copy(b, c.queue[0])
+	c.queue = c.queue[1:]
+	return n, &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 8388}, nil
+}
+
+func TestStreamPacketConn(t *testing.T) {
+	for method, m := range streamCiphers {
+		ciph, err := newStreamCipher(method, "password")
+		if err != nil {
+			t.Fatal(err)
+		}
+		key := kdf("password", m.keySize)
+		pc := &queuePacketConn{}
+		client := ciph.PacketConn(pc)
+
+		for i := 0; i < 2; i++ {
+			if _, err := client.WriteTo([]byte("query"), nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if len(pc.written) != 2 || bytes.Equal(pc.written[0][:m.ivSize], pc.written[1][:m.ivSize]) {
+			t.Fatalf("%v: every packet needs its own iv", method)
+		}
+		for _, b := range pc.written {
+			if len(b) != m.ivSize+len("query") {
+				t.Fatalf("%v: packet size %v", method, len(b))
+			}
+			s, err := m.new(key, b[:m.ivSize], true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			s.XORKeyStream(b[m.ivSize:], b[m.ivSize:])
+			if string(b[m.ivSize:]) != "query" {
+				t.Fatalf("%v: server got %q", method, b[m.ivSize:])
+			}
+		}
+
+		// 比IV短的包被丢掉
+		iv := bytes.Repeat([]byte{7}, m.ivSize)
+		s, err := m.new(key, iv, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		answer := []byte("answer")
+		s.XORKeyStream(answer, answer)
+		pc.queue = [][]byte{iv[:m.ivSize-1], append(iv, answer...)}
+		b := make([]byte, 64)
+		n, addr, err := client.ReadFrom(b)
+		if err != nil || string(b[:n]) != "answer" || addr.String() != "1.2.3.4:8388" {
+			t.Fatalf("%v: client got %q %v %v", method, b[:n], addr, err)
+		}
+	}
+}
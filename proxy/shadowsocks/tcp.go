@@ -7,18 +7,19 @@ import (
 	"net"
 	"strconv"
 
-	sscore "github.com/shadowsocks/go-shadowsocks2/core"
 	sssocks "github.com/shadowsocks/go-shadowsocks2/socks"
 
 	"github.com/MissGod1/PProxy/common/dns"
+	"github.com/MissGod1/PProxy/proxy/dialer"
 	"github.com/eycorsican/go-tun2socks/common/log"
 	"github.com/eycorsican/go-tun2socks/core"
 )
 
 type tcpHandler struct {
-	cipher  sscore.Cipher
+	cipher  Cipher
 	server  string
 	fakeDns dns.FakeDns
+	forward dialer.Dialer
 }
 
 func (h *tcpHandler) handleInput(conn net.Conn, input io.ReadCloser) {
@@ -37,15 +38,17 @@ func (h *tcpHandler) handleOutput(conn net.Conn, output io.WriteCloser) {
 	io.Copy(output, conn)
 }
 
-func NewTCPHandler(server, cipher, password string, fakeDns dns.FakeDns) core.TCPConnHandler {
-	ciph, err := sscore.PickCipher(cipher, []byte{}, password)
-	if err != nil {
-		log.Errorf("failed to pick a cipher: %v", err)
+// NewTCPHandler creates a handler that reaches the server through forward,
+// or directly if forward is nil.
+func NewTCPHandler(server string, ciph Cipher, fakeDns dns.FakeDns, forward dialer.Dialer) core.TCPConnHandler {
+	if forward == nil {
+		forward = dialer.Direct
 	}
 	return &tcpHandler{
 		cipher:  ciph,
 		server:  server,
 		fakeDns: fakeDns,
+		forward: forward,
 	}
 }
 
@@ -55,7 +58,7 @@ func (h *tcpHandler) Handle(conn net.Conn, target *net.TCPAddr) error {
 	}
 
 	// Connect the relay server.
-	rc, err := net.Dial("tcp", h.server)
+	rc, err := h.forward.Dial("tcp", h.server)
 	if err != nil {
 		return errors.New(fmt.Sprintf("dial remote server failed: %v", err))
 	}
@@ -8,10 +8,10 @@ import (
 	"sync"
 	"time"
 
-	sscore "github.com/shadowsocks/go-shadowsocks2/core"
 	sssocks "github.com/shadowsocks/go-shadowsocks2/socks"
 
 	"github.com/MissGod1/PProxy/common/dns"
+	"github.com/MissGod1/PProxy/proxy/dialer"
 	"github.com/eycorsican/go-tun2socks/common/log"
 	"github.com/eycorsican/go-tun2socks/core"
 )
@@ -19,22 +19,25 @@ import (
 type udpHandler struct {
 	sync.Mutex
 
-	cipher     sscore.Cipher
+	cipher     Cipher
 	remoteAddr net.Addr
 	conns      map[core.UDPConn]net.PacketConn
 	fakeDns    dns.FakeDns
 	timeout    time.Duration
+	forward    dialer.Dialer
 }
 
-func NewUDPHandler(server, cipher, password string, timeout time.Duration, fakeDns dns.FakeDns) core.UDPConnHandler {
-	ciph, err := sscore.PickCipher(cipher, []byte{}, password)
-	if err != nil {
-		log.Errorf("failed to pick a cipher: %v", err)
-	}
-
-	remoteAddr, err := net.ResolveUDPAddr("udp", server)
-	if err != nil {
-		log.Errorf("failed to resolve udp address: %v", err)
+// NewUDPHandler creates a handler that reaches the server through forward,
+// or directly if forward is nil.
+func NewUDPHandler(server string, ciph Cipher, timeout time.Duration, fakeDns dns.FakeDns, forward dialer.Dialer) core.UDPConnHandler {
+	var remoteAddr net.Addr = dialer.Addr(server)
+	if forward == nil {
+		forward = dialer.Direct
+		addr, err := net.ResolveUDPAddr("udp", server)
+		if err != nil {
+			log.Errorf("failed to resolve udp address: %v", err)
+		}
+		remoteAddr = addr
 	}
 
 	return &udpHandler{
@@ -43,6 +46,7 @@ func NewUDPHandler(server, cipher, password string, timeout time.Duration, fakeD
 		conns:      make(map[core.UDPConn]net.PacketConn, 16),
 		fakeDns:    fakeDns,
 		timeout:    timeout,
+		forward:    forward,
 	}
 }
 
@@ -77,7 +81,7 @@ func (h *udpHandler) fetchUDPInput(conn core.UDPConn, input net.PacketConn) {
 }
 
 func (h *udpHandler) Connect(conn core.UDPConn, target *net.UDPAddr) error {
-	pc, err := net.ListenPacket("udp", "")
+	pc, err := h.forward.ListenPacket()
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,206 @@
+package socks
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+
+	"golang.org/x/net/proxy"
+
+	"github.com/MissGod1/PProxy/proxy/dialer"
+)
+
+// SOCKS authentication methods as defined in RFC 1928 section 3.
+const (
+	socks5AuthNone     = 0
+	socks5AuthPassword = 2
+	socks5AuthNoAccept = 0xff
+)
+
+// handshake negotiates the method on c, offering username/password
+// authentication (RFC 1929) if auth is given.
+func handshake(c net.Conn, auth *proxy.Auth) error {
+	// send VER, NMETHODS, METHODS
+	methods := []byte{5, 1, socks5AuthNone}
+	if auth != nil {
+		methods = []byte{5, 2, socks5AuthNone, socks5AuthPassword}
+	}
+	if _, err := c.Write(methods); err != nil {
+		return err
+	}
+
+	// read VER METHOD
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(c, buf); err != nil {
+		return err
+	}
+	if buf[0] != 5 {
+		return fmt.Errorf("unexpected socks version %v", buf[0])
+	}
+	switch buf[1] {
+	case socks5AuthNone:
+		return nil
+	case socks5AuthPassword:
+		if auth == nil {
+			return errors.New("socks server requires username/password authentication")
+		}
+	case socks5AuthNoAccept:
+		return errors.New("no acceptable authentication method")
+	default:
+		return fmt.Errorf("unsupported authentication method %v", buf[1])
+	}
+
+	if len(auth.User) == 0 || len(auth.User) > 255 || len(auth.Password) > 255 {
+		return errors.New("invalid username/password")
+	}
+	// send VER ULEN UNAME PLEN PASSWD
+	b := []byte{1, byte(len(auth.User))}
+	b = append(b, auth.User...)
+	b = append(b, byte(len(auth.Password)))
+	b = append(b, auth.Password...)
+	if _, err := c.Write(b); err != nil {
+		return err
+	}
+	// read VER STATUS
+	if _, err := io.ReadFull(c, buf); err != nil {
+		return err
+	}
+	if buf[1] != 0 {
+		return errors.New("username/password authentication failed")
+	}
+	return nil
+}
+
+// associate sends UDP ASSOCIATE for dest on c and returns the relay
+// address. An empty dest lets the server accept any client address.
+func associate(c net.Conn, auth *proxy.Auth, dest string) (Addr, error) {
+	if err := handshake(c, auth); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, MaxAddrLen)
+	if len(dest) != 0 {
+		targetAddr := ParseAddr(dest)
+		// write VER CMD RSV ATYP DST.ADDR DST.PORT
+		c.Write(append([]byte{5, socks5UDPAssociate, 0}, targetAddr...))
+	} else {
+		c.Write(append([]byte{5, socks5UDPAssociate, 0}, []byte{1, 0, 0, 0, 0, 0, 0}...))
+	}
+
+	// read VER REP RSV ATYP BND.ADDR BND.PORT
+	if _, err := io.ReadFull(c, buf[:3]); err != nil {
+		return nil, err
+	}
+
+	rep := buf[1]
+	if rep != 0 {
+		return nil, errors.New("SOCKS handshake failed")
+	}
+
+	return readAddr(c, buf)
+}
+
+type socksDialer struct {
+	server  string
+	auth    *proxy.Auth
+	forward dialer.Dialer
+}
+
+// NewDialer returns a dialer that connects through the SOCKS5 server, which
+// is reached through forward, or directly if forward is nil. auth may be
+// nil.
+func NewDialer(proxyHost string, proxyPort uint16, auth *proxy.Auth, forward dialer.Dialer) dialer.Dialer {
+	if forward == nil {
+		forward = dialer.Direct
+	}
+	return &socksDialer{
+		server:  net.JoinHostPort(proxyHost, strconv.Itoa(int(proxyPort))),
+		auth:    auth,
+		forward: forward,
+	}
+}
+
+func (d *socksDialer) Dial(network, address string) (net.Conn, error) {
+	p, err := proxy.SOCKS5("tcp", d.server, d.auth, d.forward)
+	if err != nil {
+		return nil, err
+	}
+	return p.Dial(network, address)
+}
+
+func (d *socksDialer) ListenPacket() (net.PacketConn, error) {
+	c, err := d.forward.Dial("tcp", d.server)
+	if err != nil {
+		return nil, err
+	}
+	relay, err := associate(c, d.auth, "")
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	pc, err := d.forward.ListenPacket()
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	// 服务器返回的地址是0.0.0.0时用服务器的地址
+	host, port, _ := net.SplitHostPort(relay.String())
+	if ip := net.ParseIP(host); ip != nil && ip.IsUnspecified() {
+		host, _, _ = net.SplitHostPort(d.server)
+	}
+	return &packetConn{
+		PacketConn: pc,
+		ctrl:       c,
+		relay:      dialer.Addr(net.JoinHostPort(host, port)),
+	}, nil
+}
+
+// packetConn sends datagrams through a UDP association. The association
+// lasts as long as the control connection.
+type packetConn struct {
+	net.PacketConn
+	ctrl  net.Conn
+	relay net.Addr
+
+	once sync.Once
+}
+
+func (c *packetConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	tgt := ParseAddr(addr.String())
+	if tgt == nil {
+		return 0, errors.New("invalid address " + addr.String())
+	}
+	buf := append([]byte{0, 0, 0}, tgt...)
+	buf = append(buf, b...)
+	if _, err := c.PacketConn.WriteTo(buf, c.relay); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *packetConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	buf := make([]byte, maxUdpPayloadSize)
+	for {
+		n, _, err := c.PacketConn.ReadFrom(buf)
+		if err != nil {
+			return 0, nil, err
+		}
+		if n < 3 {
+			continue
+		}
+		addr := SplitAddr(buf[3:n])
+		if addr == nil {
+			continue
+		}
+		return copy(b, buf[3+len(addr):n]), dialer.Addr(addr.String()), nil
+	}
+}
+
+func (c *packetConn) Close() error {
+	c.once.Do(func() { c.ctrl.Close() })
+	return c.PacketConn.Close()
+}
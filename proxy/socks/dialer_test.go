@@ -0,0 +1,112 @@
+package socks
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/proxy"
+)
+
+// negotiation is what the server side of the handshake saw.
+type negotiation struct {
+	methods    []byte
+	user, pass string
+	authed     bool
+}
+
+// serveHandshake answers the method selection with method and the
+// username/password request with status.
+func serveHandshake(c net.Conn, method, status byte) negotiation {
+	defer c.Close()
+	var n negotiation
+	b := make([]byte, 2)
+	if _, err := io.ReadFull(c, b); err != nil {
+		return n
+	}
+	n.methods = make([]byte, b[1])
+	if _, err := io.ReadFull(c, n.methods); err != nil {
+		return n
+	}
+	if _, err := c.Write([]byte{5, method}); err != nil || method != socks5AuthPassword {
+		return n
+	}
+
+	if _, err := io.ReadFull(c, b); err != nil || b[0] != 1 {
+		return n
+	}
+	user := make([]byte, b[1])
+	if _, err := io.ReadFull(c, user); err != nil {
+		return n
+	}
+	if _, err := io.ReadFull(c, b[:1]); err != nil {
+		return n
+	}
+	pass := make([]byte, b[0])
+	if _, err := io.ReadFull(c, pass); err != nil {
+		return n
+	}
+	n.user, n.pass, n.authed = string(user), string(pass), true
+	c.Write([]byte{1, status})
+	return n
+}
+
+func TestHandshake(t *testing.T) {
+	long := strings.Repeat("x", 256)
+	cases := []struct {
+		name    string
+		auth    *proxy.Auth
+		method  byte
+		status  byte
+		ok      bool
+		methods []byte
+		authed  bool
+	}{
+		{"no auth", nil, socks5AuthNone, 0, true, []byte{socks5AuthNone}, false},
+		{"auth not required", &proxy.Auth{User: "u", Password: "p"}, socks5AuthNone, 0, true, []byte{socks5AuthNone, socks5AuthPassword}, false},
+		{"auth", &proxy.Auth{User: "user", Password: "secret"}, socks5AuthPassword, 0, true, []byte{socks5AuthNone, socks5AuthPassword}, true},
+		{"empty password", &proxy.Auth{User: "user"}, socks5AuthPassword, 0, true, []byte{socks5AuthNone, socks5AuthPassword}, true},
+		{"wrong credentials", &proxy.Auth{User: "user", Password: "wrong"}, socks5AuthPassword, 1, false, []byte{socks5AuthNone, socks5AuthPassword}, true},
+		{"auth required", nil, socks5AuthPassword, 0, false, []byte{socks5AuthNone}, false},
+		{"no acceptable method", &proxy.Auth{User: "u", Password: "p"}, socks5AuthNoAccept, 0, false, []byte{socks5AuthNone, socks5AuthPassword}, false},
+		{"unsupported method", nil, 0x01, 0, false, []byte{socks5AuthNone}, false},
+		{"long username", &proxy.Auth{User: long, Password: "p"}, socks5AuthPassword, 0, false, []byte{socks5AuthNone, socks5AuthPassword}, false},
+		{"long password", &proxy.Auth{User: "u", Password: long}, socks5AuthPassword, 0, false, []byte{socks5AuthNone, socks5AuthPassword}, false},
+		{"empty username", &proxy.Auth{Password: "p"}, socks5AuthPassword, 0, false, []byte{socks5AuthNone, socks5AuthPassword}, false},
+	}
+	for _, c := range cases {
+		client, server := net.Pipe()
+		done := make(chan negotiation, 1)
+		go func() { done <- serveHandshake(server, c.method, c.status) }()
+
+		err := handshake(client, c.auth)
+		client.Close()
+		n := <-done
+		if (err == nil) != c.ok {
+			t.Errorf("%v: %v", c.name, err)
+		}
+		if !bytes.Equal(n.methods, c.methods) {
+			t.Errorf("%v: offered methods %v, want %v", c.name, n.methods, c.methods)
+		}
+		if n.authed != c.authed {
+			t.Errorf("%v: authenticated %v, want %v", c.name, n.authed, c.authed)
+		}
+		if n.authed && (n.user != c.auth.User || n.pass != c.auth.Password) {
+			t.Errorf("%v: got %q/%q", c.name, n.user, n.pass)
+		}
+	}
+}
+
+func TestHandshakeBadVersion(t *testing.T) {
+	client, server := net.Pipe()
+	go func() {
+		io.ReadFull(server, make([]byte, 3))
+		server.Write([]byte{4, socks5AuthNone})
+		server.Close()
+	}()
+	if err := handshake(client, nil); err == nil {
+		t.Fatal("socks4 reply accepted")
+	}
+}
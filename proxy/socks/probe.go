@@ -0,0 +1,27 @@
+package socks
+
+import (
+	"net"
+	"strconv"
+	"time"
+
+	"golang.org/x/net/proxy"
+
+	"github.com/MissGod1/PProxy/proxy/dialer"
+)
+
+// Probe checks the SOCKS5 server, reached through forward, with a method
+// negotiation and the authentication if auth is given.
+func Probe(proxyHost string, proxyPort uint16, auth *proxy.Auth, forward dialer.Dialer, timeout time.Duration) error {
+	if forward == nil {
+		forward = dialer.Direct
+	}
+	c, err := dialer.DialTimeout(forward, "tcp", net.JoinHostPort(proxyHost, strconv.Itoa(int(proxyPort))), timeout)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(timeout))
+
+	return handshake(c, auth)
+}
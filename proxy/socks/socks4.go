@@ -0,0 +1,115 @@
+package socks
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+
+	"github.com/MissGod1/PProxy/proxy/dialer"
+)
+
+// SOCKS4 reply codes.
+const (
+	socks4Granted  = 0x5a
+	socks4Rejected = 0x5b
+	socks4NoIdentd = 0x5c
+	socks4BadUser  = 0x5d
+)
+
+var errSOCKS4UDP = errors.New("socks4 does not support udp")
+
+type socks4Dialer struct {
+	server  string
+	userID  string
+	forward dialer.Dialer
+}
+
+// NewSOCKS4Dialer returns a dialer that connects with SOCKS4 CONNECT
+// requests to the server, which is reached through forward, or directly if
+// forward is nil. Domain names are sent as SOCKS4a.
+func NewSOCKS4Dialer(proxyHost string, proxyPort uint16, userID string, forward dialer.Dialer) dialer.Dialer {
+	if forward == nil {
+		forward = dialer.Direct
+	}
+	return &socks4Dialer{
+		server:  net.JoinHostPort(proxyHost, strconv.Itoa(int(proxyPort))),
+		userID:  userID,
+		forward: forward,
+	}
+}
+
+// socks4Request builds the CONNECT request for addr.
+func socks4Request(addr Addr, userID string) ([]byte, error) {
+	// VN CD DSTPORT DSTIP USERID NULL [DOMAIN NULL]
+	b := []byte{4, socks5Connect}
+	switch ATYP(addr[0]) {
+	case socks5IP4:
+		b = append(b, addr[1+net.IPv4len:]...)
+		b = append(b, addr[1:1+net.IPv4len]...)
+		b = append(b, userID...)
+		b = append(b, 0)
+	case socks5Domain:
+		// SOCKS4a: 0.0.0.x表示目标是域名
+		b = append(b, addr[len(addr)-2:]...)
+		b = append(b, 0, 0, 0, 1)
+		b = append(b, userID...)
+		b = append(b, 0)
+		b = append(b, addr[2:len(addr)-2]...)
+		b = append(b, 0)
+	default:
+		return nil, errors.New("socks4 does not support ipv6 " + addr.String())
+	}
+	return b, nil
+}
+
+func (d *socks4Dialer) Dial(network, address string) (net.Conn, error) {
+	if network != "tcp" {
+		return nil, fmt.Errorf("network %v is not supported", network)
+	}
+	addr := ParseAddr(address)
+	if addr == nil {
+		return nil, errors.New("invalid address " + address)
+	}
+	req, err := socks4Request(addr, d.userID)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := d.forward.Dial("tcp", d.server)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := c.Write(req); err != nil {
+		c.Close()
+		return nil, err
+	}
+	// read VN CD DSTPORT DSTIP
+	b := make([]byte, 8)
+	if _, err := io.ReadFull(c, b); err != nil {
+		c.Close()
+		return nil, err
+	}
+	if b[0] != 0 {
+		c.Close()
+		return nil, fmt.Errorf("unexpected socks4 reply version %v", b[0])
+	}
+	switch b[1] {
+	case socks4Granted:
+		return c, nil
+	case socks4Rejected:
+		err = fmt.Errorf("socks4 server rejected %v", address)
+	case socks4NoIdentd, socks4BadUser:
+		err = errors.New("socks4 server could not verify the user id")
+	default:
+		err = fmt.Errorf("unexpected socks4 reply %v", b[1])
+	}
+	c.Close()
+	return nil, err
+}
+
+// ListenPacket fails, SOCKS4 only carries TCP.
+func (d *socks4Dialer) ListenPacket() (net.PacketConn, error) {
+	return nil, errSOCKS4UDP
+}
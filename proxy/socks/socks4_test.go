@@ -0,0 +1,140 @@
+package socks
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestSOCKS4Request(t *testing.T) {
+	cases := []struct {
+		address string
+		userID  string
+		want    []byte
+	}{
+		{"1.2.3.4:80", "", []byte{4, 1, 0, 80, 1, 2, 3, 4, 0}},
+		{"1.2.3.4:8080", "user", []byte{4, 1, 0x1f, 0x90, 1, 2, 3, 4, 'u', 's', 'e', 'r', 0}},
+		// SOCKS4a: DSTIP是0.0.0.1, 域名放在USERID之后
+		{"example.com:443", "", append(append([]byte{4, 1, 1, 187, 0, 0, 0, 1, 0}, "example.com"...), 0)},
+		{"example.com:443", "user", append(append([]byte{4, 1, 1, 187, 0, 0, 0, 1, 'u', 's', 'e', 'r', 0}, "example.com"...), 0)},
+	}
+	for _, c := range cases {
+		got, err := socks4Request(ParseAddr(c.address), c.userID)
+		if err != nil || !bytes.Equal(got, c.want) {
+			t.Errorf("%v %q: %v %v, want %v", c.address, c.userID, got, err, c.want)
+		}
+	}
+	if _, err := socks4Request(ParseAddr("[2001:db8::1]:80"), ""); err == nil {
+		t.Error("ipv6 accepted")
+	}
+}
+
+// socks4Server is a forward dialer whose connections end in a SOCKS4
+// server that answers with reply and echoes once the request is granted.
+type socks4Server struct {
+	reply    []byte
+	requests chan []byte
+}
+
+func (s *socks4Server) Dial(network, address string) (net.Conn, error) {
+	c1, c2 := net.Pipe()
+	go func() {
+		defer c2.Close()
+		req, err := readSOCKS4Request(bufio.NewReader(c2))
+		s.requests <- req
+		if err != nil {
+			return
+		}
+		c2.Write(s.reply)
+		if len(s.reply) == 8 && s.reply[1] == socks4Granted {
+			io.Copy(c2, c2)
+		}
+	}()
+	return c1, nil
+}
+
+func (s *socks4Server) ListenPacket() (net.PacketConn, error) {
+	return nil, errors.New("not supported")
+}
+
+// readSOCKS4Request reads the raw request, with the domain of SOCKS4a.
+func readSOCKS4Request(r *bufio.Reader) ([]byte, error) {
+	b := make([]byte, 8)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	user, err := r.ReadBytes(0)
+	if err != nil {
+		return nil, err
+	}
+	b = append(b, user...)
+	if b[4] == 0 && b[5] == 0 && b[6] == 0 && b[7] != 0 {
+		domain, err := r.ReadBytes(0)
+		if err != nil {
+			return nil, err
+		}
+		b = append(b, domain...)
+	}
+	return b, nil
+}
+
+func TestSOCKS4Dial(t *testing.T) {
+	cases := []struct {
+		name    string
+		address string
+		reply   []byte
+		err     string
+	}{
+		{"granted", "1.2.3.4:80", []byte{0, socks4Granted, 0, 0, 0, 0, 0, 0}, ""},
+		{"granted 4a", "example.com:443", []byte{0, socks4Granted, 1, 187, 93, 184, 216, 34}, ""},
+		{"rejected", "1.2.3.4:80", []byte{0, socks4Rejected, 0, 0, 0, 0, 0, 0}, "rejected"},
+		{"no identd", "1.2.3.4:80", []byte{0, socks4NoIdentd, 0, 0, 0, 0, 0, 0}, "user id"},
+		{"bad user", "1.2.3.4:80", []byte{0, socks4BadUser, 0, 0, 0, 0, 0, 0}, "user id"},
+		{"unknown code", "1.2.3.4:80", []byte{0, 0x5e, 0, 0, 0, 0, 0, 0}, "unexpected"},
+		// SOCKS5服务器的应答
+		{"bad version", "1.2.3.4:80", []byte{5, 0, 0, 1, 0, 0, 0, 0}, "version"},
+		{"short reply", "1.2.3.4:80", []byte{0, socks4Granted, 0}, "EOF"},
+	}
+	for _, c := range cases {
+		s := &socks4Server{reply: c.reply, requests: make(chan []byte, 1)}
+		d := NewSOCKS4Dialer("127.0.0.1", 1080, "user", s)
+		conn, err := d.Dial("tcp", c.address)
+		req := <-s.requests
+		want, _ := socks4Request(ParseAddr(c.address), "user")
+		if !bytes.Equal(req, want) {
+			t.Errorf("%v: request %v, want %v", c.name, req, want)
+		}
+		if c.err != "" {
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Errorf("%v: error %v, want %q", c.name, err, c.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: %v", c.name, err)
+			continue
+		}
+		// 应答之后是原始数据
+		go conn.Write([]byte("ping"))
+		b := make([]byte, 4)
+		if _, err := io.ReadFull(conn, b); err != nil || string(b) != "ping" {
+			t.Errorf("%v: echo %q %v", c.name, b, err)
+		}
+		conn.Close()
+	}
+
+	d := NewSOCKS4Dialer("127.0.0.1", 1080, "", &socks4Server{})
+	if _, err := d.Dial("tcp", "[2001:db8::1]:80"); err == nil {
+		t.Error("ipv6 dialed")
+	}
+	if _, err := d.Dial("udp", "1.2.3.4:53"); err == nil {
+		t.Error("udp dialed")
+	}
+	if _, err := d.ListenPacket(); err != errSOCKS4UDP {
+		t.Errorf("ListenPacket: %v", err)
+	}
+}
@@ -2,6 +2,7 @@ package socks
 
 import (
 	"github.com/MissGod1/PProxy/common/dns"
+	"github.com/MissGod1/PProxy/proxy/dialer"
 	"io"
 	"net"
 	"strconv"
@@ -18,15 +19,24 @@ type tcpHandler struct {
 
 	proxyHost string
 	proxyPort uint16
+	auth      *proxy.Auth
 
 	fakeDns dns.FakeDns
+	forward dialer.Dialer
 }
 
-func NewTCPHandler(proxyHost string, proxyPort uint16, fakeDns dns.FakeDns) core.TCPConnHandler {
+// NewTCPHandler creates a handler that reaches the proxy server through
+// forward, or directly if forward is nil. auth may be nil.
+func NewTCPHandler(proxyHost string, proxyPort uint16, auth *proxy.Auth, fakeDns dns.FakeDns, forward dialer.Dialer) core.TCPConnHandler {
+	if forward == nil {
+		forward = dialer.Direct
+	}
 	return &tcpHandler{
 		proxyHost: proxyHost,
 		proxyPort: proxyPort,
+		auth:      auth,
 		fakeDns: fakeDns,
+		forward: forward,
 	}
 }
 
@@ -91,7 +101,7 @@ func (h *tcpHandler) relay(lhs, rhs net.Conn) {
 }
 
 func (h *tcpHandler) Handle(conn net.Conn, target *net.TCPAddr) error {
-	dialer, err := proxy.SOCKS5("tcp", core.ParseTCPAddr(h.proxyHost, h.proxyPort).String(), nil, nil)
+	dialer, err := proxy.SOCKS5("tcp", net.JoinHostPort(h.proxyHost, strconv.Itoa(int(h.proxyPort))), h.auth, h.forward)
 	if err != nil {
 		return err
 	}
@@ -4,12 +4,14 @@ import (
 	"errors"
 	"fmt"
 	"github.com/MissGod1/PProxy/common/dns"
-	"io"
+	"github.com/MissGod1/PProxy/proxy/dialer"
 	"net"
 	"strconv"
 	"sync"
 	"time"
 
+	"golang.org/x/net/proxy"
+
 	"github.com/eycorsican/go-tun2socks/common/log"
 	"github.com/eycorsican/go-tun2socks/core"
 )
@@ -22,22 +24,31 @@ type udpHandler struct {
 
 	proxyHost   string
 	proxyPort   uint16
+	auth        *proxy.Auth
 	udpConns    map[core.UDPConn]net.PacketConn
 	tcpConns    map[core.UDPConn]net.Conn
 	remoteAddrs map[core.UDPConn]*net.UDPAddr // UDP relay server addresses
 	timeout     time.Duration
 	fakeDns dns.FakeDns
+	forward     dialer.Dialer
 }
 
-func NewUDPHandler(proxyHost string, proxyPort uint16, timeout time.Duration, fakeDns dns.FakeDns) core.UDPConnHandler {
+// NewUDPHandler creates a handler that reaches the proxy server through
+// forward, or directly if forward is nil. auth may be nil.
+func NewUDPHandler(proxyHost string, proxyPort uint16, auth *proxy.Auth, timeout time.Duration, fakeDns dns.FakeDns, forward dialer.Dialer) core.UDPConnHandler {
+	if forward == nil {
+		forward = dialer.Direct
+	}
 	return &udpHandler{
 		proxyHost:   proxyHost,
 		proxyPort:   proxyPort,
+		auth:        auth,
 		udpConns:    make(map[core.UDPConn]net.PacketConn, 8),
 		tcpConns:    make(map[core.UDPConn]net.Conn, 8),
 		remoteAddrs: make(map[core.UDPConn]*net.UDPAddr, 8),
 		timeout:     timeout,
 		fakeDns: fakeDns,
+		forward:     forward,
 	}
 }
 
@@ -111,52 +122,26 @@ func (h *udpHandler) Connect(conn core.UDPConn, target *net.UDPAddr) error {
 }
 
 func (h *udpHandler) connectInternal(conn core.UDPConn, dest string) error {
-	c, err := net.DialTimeout("tcp", core.ParseTCPAddr(h.proxyHost, h.proxyPort).String(), 4*time.Second)
+	c, err := dialer.DialTimeout(h.forward, "tcp", net.JoinHostPort(h.proxyHost, strconv.Itoa(int(h.proxyPort))), 4*time.Second)
 	if err != nil {
 		return err
 	}
 
-	// send VER, NMETHODS, METHODS
-	c.Write([]byte{5, 1, 0})
-
-	buf := make([]byte, MaxAddrLen)
-	// read VER METHOD
-	if _, err := io.ReadFull(c, buf[:2]); err != nil {
-		return err
-	}
-
-	if len(dest) != 0 {
-		targetAddr := ParseAddr(dest)
-		// write VER CMD RSV ATYP DST.ADDR DST.PORT
-		c.Write(append([]byte{5, socks5UDPAssociate, 0}, targetAddr...))
-	} else {
-		c.Write(append([]byte{5, socks5UDPAssociate, 0}, []byte{1, 0, 0, 0, 0, 0, 0}...))
-	}
-	
-	// read VER REP RSV ATYP BND.ADDR BND.PORT
-	if _, err := io.ReadFull(c, buf[:3]); err != nil {
-		return err
-	}
-
-	rep := buf[1]
-	if rep != 0 {
-		return errors.New("SOCKS handshake failed")
-	}
-
-	remoteAddr, err := readAddr(c, buf)
+	remoteAddr, err := associate(c, h.auth, dest)
 	if err != nil {
+		c.Close()
 		return err
 	}
 
 	resolvedRemoteAddr, err := net.ResolveUDPAddr("udp", remoteAddr.String())
 	if err != nil {
+		c.Close()
 		return errors.New("failed to resolve remote address")
 	}
 
-	go h.handleTCP(conn, c)
-
-	pc, err := net.ListenPacket("udp", "")
+	pc, err := h.forward.ListenPacket()
 	if err != nil {
+		c.Close()
 		return err
 	}
 
@@ -166,6 +151,8 @@ func (h *udpHandler) connectInternal(conn core.UDPConn, dest string) error {
 	h.remoteAddrs[conn] = resolvedRemoteAddr
 	h.Unlock()
 
+	// 控制连接断开时关闭会话, 要在会话加入表之后才开始
+	go h.handleTCP(conn, c)
 	go h.fetchUDPInput(conn, pc)
 
 	log.Infof("new proxy connection to %v", dest)
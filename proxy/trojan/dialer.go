@@ -0,0 +1,146 @@
+// Package trojan connects through Trojan servers: a TLS connection that
+// starts with the password hash and the request.
+package trojan
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+
+	sssocks "github.com/shadowsocks/go-shadowsocks2/socks"
+
+	"github.com/MissGod1/PProxy/proxy/dialer"
+)
+
+// Trojan commands, the same as SOCKS5.
+const (
+	cmdConnect      = 1
+	cmdUDPAssociate = 3
+)
+
+// 最大的UDP包
+const maxPayloadSize = 65535
+
+var crlf = []byte{'\r', '\n'}
+
+type trojanDialer struct {
+	server  string
+	hash    []byte
+	tls     *tls.Config
+	forward dialer.Dialer
+}
+
+// NewDialer returns a dialer that connects through the Trojan server, which
+// is reached through forward, or directly if forward is nil.
+func NewDialer(proxyHost string, proxyPort uint16, password string, tlsConfig *tls.Config, forward dialer.Dialer) dialer.Dialer {
+	if forward == nil {
+		forward = dialer.Direct
+	}
+	sum := sha256.Sum224([]byte(password))
+	hash := make([]byte, hex.EncodedLen(len(sum)))
+	hex.Encode(hash, sum[:])
+	return &trojanDialer{
+		server:  net.JoinHostPort(proxyHost, strconv.Itoa(int(proxyPort))),
+		hash:    hash,
+		tls:     tlsConfig,
+		forward: forward,
+	}
+}
+
+// request connects to the server and sends the request header.
+func (d *trojanDialer) request(cmd byte, address string) (net.Conn, error) {
+	tgt := sssocks.ParseAddr(address)
+	if tgt == nil {
+		return nil, errors.New("invalid address " + address)
+	}
+	c, err := d.forward.Dial("tcp", d.server)
+	if err != nil {
+		return nil, err
+	}
+	tc := tls.Client(c, d.tls)
+	if err := tc.Handshake(); err != nil {
+		c.Close()
+		return nil, fmt.Errorf("tls handshake with trojan server failed: %v", err)
+	}
+
+	// hex(SHA224(password)) CRLF CMD ATYP DST.ADDR DST.PORT CRLF
+	b := make([]byte, 0, len(d.hash)+2+1+len(tgt)+2)
+	b = append(b, d.hash...)
+	b = append(b, crlf...)
+	b = append(b, cmd)
+	b = append(b, tgt...)
+	b = append(b, crlf...)
+	if _, err := tc.Write(b); err != nil {
+		tc.Close()
+		return nil, err
+	}
+	return tc, nil
+}
+
+func (d *trojanDialer) Dial(network, address string) (net.Conn, error) {
+	if network != "tcp" {
+		return nil, fmt.Errorf("network %v is not supported", network)
+	}
+	return d.request(cmdConnect, address)
+}
+
+// ListenPacket opens a UDP association, the datagrams are framed over the
+// TLS stream.
+func (d *trojanDialer) ListenPacket() (net.PacketConn, error) {
+	c, err := d.request(cmdUDPAssociate, "0.0.0.0:0")
+	if err != nil {
+		return nil, err
+	}
+	return &packetConn{Conn: c}, nil
+}
+
+// packetConn frames every datagram as ATYP DST.ADDR DST.PORT LENGTH CRLF
+// payload.
+type packetConn struct {
+	net.Conn
+}
+
+func (c *packetConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	tgt := sssocks.ParseAddr(addr.String())
+	if tgt == nil {
+		return 0, errors.New("invalid address " + addr.String())
+	}
+	if len(b) > maxPayloadSize {
+		return 0, errors.New("packet too large")
+	}
+	// 一次写入整个包, 并发写不会交错
+	buf := make([]byte, 0, len(tgt)+2+2+len(b))
+	buf = append(buf, tgt...)
+	buf = append(buf, byte(len(b)>>8), byte(len(b)))
+	buf = append(buf, crlf...)
+	buf = append(buf, b...)
+	if _, err := c.Conn.Write(buf); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *packetConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	addr, err := sssocks.ReadAddr(c.Conn)
+	if err != nil {
+		return 0, nil, err
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(c.Conn, buf); err != nil {
+		return 0, nil, err
+	}
+	if buf[2] != '\r' || buf[3] != '\n' {
+		return 0, nil, errors.New("bad packet header")
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(buf))
+	if _, err := io.ReadFull(c.Conn, payload); err != nil {
+		return 0, nil, err
+	}
+	return copy(b, payload), dialer.Addr(addr.String()), nil
+}
@@ -0,0 +1,207 @@
+package trojan
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	sssocks "github.com/shadowsocks/go-shadowsocks2/socks"
+
+	"github.com/MissGod1/PProxy/proxy/dialer"
+)
+
+// hex(sha224("secret"))
+const secretHash = "95c7fbca92ac5083afda62a564a3d014fc3b72c9140e3cb99ea6bf12"
+
+// testCert returns a self-signed certificate for example.com.
+func testCert(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "example.com"},
+		DNSNames:     []string{"example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+// accepted is the server side of a Trojan connection and the raw request
+// header it read.
+type accepted struct {
+	conn   net.Conn
+	header []byte
+	err    error
+}
+
+// listen starts a TLS server that reads the Trojan request header of every
+// connection.
+func listen(t *testing.T, cert tls.Certificate) (net.Listener, <-chan accepted) {
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	ch := make(chan accepted, 1)
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				a := accepted{conn: c}
+				a.header, a.err = readHeader(c)
+				ch <- a
+			}()
+		}
+	}()
+	return ln, ch
+}
+
+func readHeader(c net.Conn) ([]byte, error) {
+	b := make([]byte, len(secretHash)+2+1)
+	if _, err := io.ReadFull(c, b); err != nil {
+		return nil, err
+	}
+	addr, err := sssocks.ReadAddr(c)
+	if err != nil {
+		return nil, err
+	}
+	b = append(b, addr...)
+	end := make([]byte, 2)
+	if _, err := io.ReadFull(c, end); err != nil {
+		return nil, err
+	}
+	return append(b, end...), nil
+}
+
+func newTestDialer(t *testing.T, pool *x509.CertPool, ln net.Listener) dialer.Dialer {
+	addr := ln.Addr().(*net.TCPAddr)
+	return NewDialer(addr.IP.String(), uint16(addr.Port), "secret", &tls.Config{RootCAs: pool, ServerName: "example.com"}, nil)
+}
+
+func header(cmd byte, addr ...byte) []byte {
+	b := append([]byte(secretHash), '\r', '\n', cmd)
+	return append(append(b, addr...), '\r', '\n')
+}
+
+func TestDial(t *testing.T) {
+	cert, pool := testCert(t)
+	ln, accepted := listen(t, cert)
+	d := newTestDialer(t, pool, ln)
+	cases := []struct {
+		address string
+		header  []byte
+	}{
+		{"1.2.3.4:80", header(cmdConnect, 1, 1, 2, 3, 4, 0, 80)},
+		{"example.com:443", header(cmdConnect, append(append([]byte{3, 11}, "example.com"...), 1, 187)...)},
+		{"[2001:db8::1]:53", header(cmdConnect, 4, 0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0, 53)},
+	}
+	for _, c := range cases {
+		conn, err := d.Dial("tcp", c.address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		a := <-accepted
+		if a.err != nil {
+			t.Fatal(a.err)
+		}
+		if !bytes.Equal(a.header, c.header) {
+			t.Errorf("%v: header %q, want %q", c.address, a.header, c.header)
+		}
+
+		// 头之后就是原始数据
+		a.conn.Write([]byte("hello"))
+		b := make([]byte, 5)
+		if _, err := io.ReadFull(conn, b); err != nil || string(b) != "hello" {
+			t.Errorf("%v: read %q %v", c.address, b, err)
+		}
+		conn.Close()
+		a.conn.Close()
+	}
+
+	if _, err := d.Dial("udp", "1.2.3.4:53"); err == nil {
+		t.Error("udp dialed")
+	}
+	if _, err := d.Dial("tcp", "example.com"); err == nil {
+		t.Error("address without port accepted")
+	}
+}
+
+func TestDialBadCertificate(t *testing.T) {
+	cert, _ := testCert(t)
+	ln, _ := listen(t, cert)
+	_, pool := testCert(t)
+	if _, err := newTestDialer(t, pool, ln).Dial("tcp", "1.2.3.4:80"); err == nil {
+		t.Fatal("untrusted certificate accepted")
+	}
+}
+
+// 每个UDP包是ATYP DST.ADDR DST.PORT LENGTH CRLF payload
+func TestPacketConn(t *testing.T) {
+	cert, pool := testCert(t)
+	ln, accepted := listen(t, cert)
+	d := newTestDialer(t, pool, ln)
+	pc, err := d.ListenPacket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	a := <-accepted
+	if a.err != nil {
+		t.Fatal(a.err)
+	}
+	defer a.conn.Close()
+	if want := header(cmdUDPAssociate, 1, 0, 0, 0, 0, 0, 0); !bytes.Equal(a.header, want) {
+		t.Fatalf("header %q, want %q", a.header, want)
+	}
+
+	pc.WriteTo([]byte("query"), &net.UDPAddr{IP: net.IPv4(8, 8, 8, 8), Port: 53})
+	want := []byte{1, 8, 8, 8, 8, 0, 53, 0, 5, '\r', '\n', 'q', 'u', 'e', 'r', 'y'}
+	b := make([]byte, len(want))
+	if _, err := io.ReadFull(a.conn, b); err != nil || !bytes.Equal(b, want) {
+		t.Fatalf("packet %v %v, want %v", b, err, want)
+	}
+
+	a.conn.Write(append(append([]byte{3, 11}, "example.com"...), 0, 53, 0, 6, '\r', '\n', 'a', 'n', 's', 'w', 'e', 'r'))
+	b = make([]byte, 64)
+	n, addr, err := pc.ReadFrom(b)
+	if err != nil || string(b[:n]) != "answer" || addr.String() != "example.com:53" {
+		t.Fatalf("read %q %v %v", b[:n], addr, err)
+	}
+
+	if _, err := pc.WriteTo(make([]byte, maxPayloadSize+1), dialer.Addr("1.2.3.4:53")); err == nil {
+		t.Error("oversized packet written")
+	}
+	if _, err := pc.WriteTo([]byte("query"), dialer.Addr("1.2.3.4")); err == nil {
+		t.Error("address without port accepted")
+	}
+
+	a.conn.Write([]byte{1, 1, 2, 3, 4, 0, 53, 0, 1, 'x', 'x', 'x'})
+	if _, _, err := pc.ReadFrom(b); err == nil {
+		t.Error("packet without CRLF accepted")
+	}
+}
@@ -0,0 +1,106 @@
+package wireguard
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	mdns "github.com/miekg/dns"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+)
+
+// 隧道中DNS查询的超时
+const dnsTimeout = 5 * time.Second
+
+// packetConn is a UDP port of the tunnel address. Unlike gonet it takes
+// any net.Addr, domains are resolved through the tunnel.
+type packetConn struct {
+	*gonet.UDPConn
+	dev *Device
+}
+
+func (c *packetConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	dst, ok := addr.(*net.UDPAddr)
+	if !ok {
+		host, port, err := net.SplitHostPort(addr.String())
+		if err != nil {
+			return 0, err
+		}
+		p, err := strconv.Atoi(port)
+		if err != nil {
+			return 0, fmt.Errorf("invalid port %v", port)
+		}
+		ip, err := c.dev.resolve(host)
+		if err != nil {
+			return 0, err
+		}
+		dst = &net.UDPAddr{IP: ip, Port: p}
+	}
+	// gonet按地址长度区分IPv4和IPv6
+	full, err := c.dev.fullAddr(dst.IP, dst.Port)
+	if err != nil {
+		return 0, err
+	}
+	return c.UDPConn.WriteTo(b, &net.UDPAddr{IP: net.IP(full.Addr.AsSlice()), Port: dst.Port})
+}
+
+// resolve returns the IP of host. Domains are queried from the DNS server
+// of the tunnel, never on the host: a domain of the fake DNS must not leak.
+func (d *Device) resolve(host string) (net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return ip, nil
+	}
+	if d.dns == nil {
+		return nil, fmt.Errorf("wireguard: no dns to resolve %v", host)
+	}
+
+	qtype := mdns.TypeAAAA
+	if d.proto == ipv4.ProtocolNumber {
+		qtype = mdns.TypeA
+	}
+	query := new(mdns.Msg)
+	query.SetQuestion(mdns.Fqdn(host), qtype)
+	b, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	server, err := d.fullAddr(d.dns, 53)
+	if err != nil {
+		return nil, err
+	}
+	c, err := gonet.DialUDP(d.stack, &tcpip.FullAddress{NIC: nicID}, &server, d.proto)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(dnsTimeout))
+	if _, err := c.Write(b); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 1500)
+	for {
+		n, err := c.Read(buf)
+		if err != nil {
+			return nil, fmt.Errorf("wireguard: resolve %v failed: %v", host, err)
+		}
+		resp := new(mdns.Msg)
+		if resp.Unpack(buf[:n]) != nil || resp.Id != query.Id {
+			continue
+		}
+		for _, rr := range resp.Answer {
+			switch rr := rr.(type) {
+			case *mdns.A:
+				return rr.A, nil
+			case *mdns.AAAA:
+				return rr.AAAA, nil
+			}
+		}
+		return nil, errors.New("wireguard: no address for " + host)
+	}
+}
@@ -0,0 +1,232 @@
+// Package wireguard sends TCP and UDP through a userspace WireGuard peer.
+// The connections are made by a gVisor netstack in process, there is no
+// OS interface.
+package wireguard
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.zx2c4.com/wireguard/device"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/icmp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+)
+
+// DefaultMTU is the MTU of the tunnel, the same as wg-quick.
+const DefaultMTU = 1420
+
+// 协议栈只有一个网卡
+const nicID = 1
+
+// 没有给出超时的连接最多等待这么久, 否则SYN重传结束前不会返回
+const dialTimeout = 30 * time.Second
+
+// Config is the interface and peer configuration, the keys are base64
+// encoded like in wg-quick.
+type Config struct {
+	PrivateKey   string
+	PublicKey    string
+	PresharedKey string
+	// Endpoint is the host:port of the peer
+	Endpoint string
+	// Address is the tunnel address of this end
+	Address net.IP
+	// DNS resolves the domains through the tunnel, without it domains
+	// are refused instead of being resolved on the host
+	DNS        net.IP
+	ListenPort uint16
+	MTU        int
+}
+
+// Device is a WireGuard peer with a netstack behind it.
+type Device struct {
+	dev   *device.Device
+	tun   *netTun
+	stack *stack.Stack
+	addr  net.IP
+	proto tcpip.NetworkProtocolNumber
+	dns   net.IP
+}
+
+func hexKey(name, key string) (string, error) {
+	b, err := base64.StdEncoding.DecodeString(key)
+	if err != nil || len(b) != device.NoisePublicKeySize {
+		return "", fmt.Errorf("invalid %v", name)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// NewDevice starts the peer and configures it to send everything to the
+// endpoint.
+func NewDevice(c *Config) (*Device, error) {
+	if c.Address == nil {
+		return nil, errors.New("wireguard needs an address")
+	}
+	privateKey, err := hexKey("private_key", c.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	publicKey, err := hexKey("public_key", c.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	// uapi只接受IP地址
+	endpoint, err := net.ResolveUDPAddr("udp", c.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	mtu := c.MTU
+	if mtu == 0 {
+		mtu = DefaultMTU
+	}
+
+	d := &Device{
+		addr:  c.Address,
+		proto: ipv6.ProtocolNumber,
+		dns:   c.DNS,
+	}
+	if ip4 := d.addr.To4(); ip4 != nil {
+		d.addr = ip4
+		d.proto = ipv4.ProtocolNumber
+	}
+	if d.dns != nil && (d.dns.To4() != nil) != (d.proto == ipv4.ProtocolNumber) {
+		return nil, errors.New("wireguard: dns and address are of different ip versions")
+	}
+
+	var cfg strings.Builder
+	fmt.Fprintf(&cfg, "private_key=%v\n", privateKey)
+	fmt.Fprintf(&cfg, "listen_port=%v\n", c.ListenPort)
+	fmt.Fprintf(&cfg, "replace_peers=true\n")
+	fmt.Fprintf(&cfg, "public_key=%v\n", publicKey)
+	if c.PresharedKey != "" {
+		psk, err := hexKey("preshared_key", c.PresharedKey)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(&cfg, "preshared_key=%v\n", psk)
+	}
+	fmt.Fprintf(&cfg, "endpoint=%v\n", endpoint)
+	fmt.Fprintf(&cfg, "replace_allowed_ips=true\n")
+	fmt.Fprintf(&cfg, "allowed_ip=0.0.0.0/0\n")
+	fmt.Fprintf(&cfg, "allowed_ip=::/0\n")
+
+	d.tun = newNetTun(mtu)
+	if err := d.newStack(); err != nil {
+		d.tun.Close()
+		return nil, err
+	}
+	d.dev = device.NewDevice(d.tun, device.NewLogger(device.LogLevelError, "wireguard: "))
+	if err := d.dev.IpcSetOperation(bufio.NewReader(strings.NewReader(cfg.String()))); err != nil {
+		d.Close()
+		return nil, fmt.Errorf("configure wireguard failed: %v", err)
+	}
+	d.dev.Up()
+	return d, nil
+}
+
+// newStack creates the netstack on the link endpoint of the tun device,
+// with the tunnel address and a default route.
+func (d *Device) newStack() error {
+	d.stack = stack.New(stack.Options{
+		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol, ipv6.NewProtocol},
+		TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol, udp.NewProtocol, icmp.NewProtocol4, icmp.NewProtocol6},
+		HandleLocal:        true,
+	})
+	// SACK默认是关闭的
+	sack := tcpip.TCPSACKEnabled(true)
+	if err := d.stack.SetTransportProtocolOption(tcp.ProtocolNumber, &sack); err != nil {
+		return fmt.Errorf("wireguard: enable tcp sack failed: %v", err)
+	}
+	if err := d.stack.CreateNIC(nicID, d.tun.ep); err != nil {
+		return fmt.Errorf("wireguard: create nic failed: %v", err)
+	}
+	addr := tcpip.ProtocolAddress{
+		Protocol:          d.proto,
+		AddressWithPrefix: tcpip.AddrFromSlice(d.addr).WithPrefix(),
+	}
+	if err := d.stack.AddProtocolAddress(nicID, addr, stack.AddressProperties{}); err != nil {
+		return fmt.Errorf("wireguard: add address %v failed: %v", d.addr, err)
+	}
+	subnet := header.IPv4EmptySubnet
+	if d.proto == ipv6.ProtocolNumber {
+		subnet = header.IPv6EmptySubnet
+	}
+	d.stack.AddRoute(tcpip.Route{Destination: subnet, NIC: nicID})
+	return nil
+}
+
+// fullAddr converts ip and port to an address of the netstack. The
+// tunnel only has an address of one IP version.
+func (d *Device) fullAddr(ip net.IP, port int) (tcpip.FullAddress, error) {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	if (len(ip) == net.IPv4len) != (d.proto == ipv4.ProtocolNumber) {
+		return tcpip.FullAddress{}, fmt.Errorf("wireguard: %v is not reachable from %v", ip, d.addr)
+	}
+	return tcpip.FullAddress{NIC: nicID, Addr: tcpip.AddrFromSlice(ip), Port: uint16(port)}, nil
+}
+
+// Dial connects to address, a host:port, through the tunnel. It gives up
+// after dialTimeout.
+func (d *Device) Dial(network, address string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+	defer cancel()
+	return d.DialContext(ctx, network, address)
+}
+
+// DialContext connects to address, a host:port, through the tunnel until
+// ctx is done. Domains are resolved through the tunnel too.
+func (d *Device) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %v", port)
+	}
+	ip, err := d.resolve(host)
+	if err != nil {
+		return nil, err
+	}
+	addr, err := d.fullAddr(ip, p)
+	if err != nil {
+		return nil, err
+	}
+	return gonet.DialContextTCP(ctx, d.stack, addr, d.proto)
+}
+
+// ListenPacket returns a PacketConn on a free port of the tunnel address.
+func (d *Device) ListenPacket() (net.PacketConn, error) {
+	c, err := gonet.DialUDP(d.stack, &tcpip.FullAddress{NIC: nicID}, nil, d.proto)
+	if err != nil {
+		return nil, err
+	}
+	return &packetConn{UDPConn: c, dev: d}, nil
+}
+
+// Close stops the peer and the netstack.
+func (d *Device) Close() error {
+	if d.dev != nil {
+		d.dev.Close()
+	}
+	d.tun.Close()
+	d.stack.Close()
+	return nil
+}
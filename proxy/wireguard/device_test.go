@@ -0,0 +1,243 @@
+package wireguard
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	mdns "github.com/miekg/dns"
+	"golang.org/x/crypto/curve25519"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+
+	"github.com/MissGod1/PProxy/proxy/dialer"
+)
+
+func newKey(t *testing.T) (priv, pub string) {
+	var k [32]byte
+	if _, err := rand.Read(k[:]); err != nil {
+		t.Fatal(err)
+	}
+	k[0] &= 248
+	k[31] = k[31]&127 | 64
+	p, err := curve25519.X25519(k[:], curve25519.Basepoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(k[:]), base64.StdEncoding.EncodeToString(p)
+}
+
+func freePort(t *testing.T) uint16 {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	return uint16(pc.LocalAddr().(*net.UDPAddr).Port)
+}
+
+// newPair connects two devices over loopback, a is 10.0.0.1 and uses b,
+// 10.0.0.2, as its DNS server.
+func newPair(t *testing.T) (a, b *Device) {
+	privA, pubA := newKey(t)
+	privB, pubB := newKey(t)
+	portA, portB := freePort(t), freePort(t)
+
+	a, err := NewDevice(&Config{
+		PrivateKey: privA,
+		PublicKey:  pubB,
+		Endpoint:   net.JoinHostPort("127.0.0.1", strconv.Itoa(int(portB))),
+		Address:    net.IPv4(10, 0, 0, 1),
+		DNS:        net.IPv4(10, 0, 0, 2),
+		ListenPort: portA,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err = NewDevice(&Config{
+		PrivateKey: privB,
+		PublicKey:  pubA,
+		Endpoint:   net.JoinHostPort("127.0.0.1", strconv.Itoa(int(portA))),
+		Address:    net.IPv4(10, 0, 0, 2),
+		ListenPort: portB,
+	})
+	if err != nil {
+		a.Close()
+		t.Fatal(err)
+	}
+	return a, b
+}
+
+// listenUDP listens on port of the tunnel address of d.
+func listenUDP(t *testing.T, d *Device, port uint16) *gonet.UDPConn {
+	laddr := &tcpip.FullAddress{NIC: nicID, Addr: tcpip.AddrFromSlice(d.addr), Port: port}
+	c, err := gonet.DialUDP(d.stack, laddr, nil, ipv4.ProtocolNumber)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func echoUDP(c *gonet.UDPConn) {
+	b := make([]byte, 2048)
+	for {
+		n, addr, err := c.ReadFrom(b)
+		if err != nil {
+			return
+		}
+		c.WriteTo(b[:n], addr)
+	}
+}
+
+func TestDeviceUDP(t *testing.T) {
+	a, b := newPair(t)
+	defer a.Close()
+	defer b.Close()
+
+	echo := listenUDP(t, b, 7)
+	defer echo.Close()
+	go echoUDP(echo)
+
+	pc, err := a.ListenPacket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	pc.SetDeadline(time.Now().Add(5 * time.Second))
+
+	target := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 7}
+	if _, err := pc.WriteTo([]byte("ping"), target); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 64)
+	n, from, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "ping" {
+		t.Fatalf("answer %q", buf[:n])
+	}
+	if from.String() != target.String() {
+		t.Fatalf("answer from %v", from)
+	}
+}
+
+func TestDeviceTCP(t *testing.T) {
+	a, b := newPair(t)
+	defer a.Close()
+	defer b.Close()
+
+	l, err := gonet.ListenTCP(b.stack, tcpip.FullAddress{NIC: nicID, Addr: tcpip.AddrFromSlice(b.addr), Port: 80}, ipv4.ProtocolNumber)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		io.Copy(c, c)
+	}()
+
+	c, err := a.Dial("tcp", "10.0.0.2:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	// 大于MTU, 需要分段
+	data := make([]byte, 64*1024)
+	rand.Read(data)
+	go c.Write(data)
+	got := make([]byte, len(data))
+	if _, err := io.ReadFull(c, got); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != string(data) {
+		t.Fatal("echo mismatch")
+	}
+}
+
+// 对端不应答SYN时按超时放弃, 不等SYN重传结束
+func TestDeviceDialTimeout(t *testing.T) {
+	a, b := newPair(t)
+	defer a.Close()
+	defer b.Close()
+
+	start := time.Now()
+	if _, err := dialer.DialTimeout(a, "tcp", "10.0.0.3:80", 300*time.Millisecond); err == nil {
+		t.Fatal("connected to nothing")
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Fatalf("dial gave up after %v", d)
+	}
+}
+
+// 域名通过隧道中的DNS解析, 没有DNS时拒绝
+func TestDeviceResolve(t *testing.T) {
+	a, b := newPair(t)
+	defer a.Close()
+	defer b.Close()
+
+	dns := listenUDP(t, b, 53)
+	defer dns.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := dns.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			query := new(mdns.Msg)
+			if query.Unpack(buf[:n]) != nil {
+				continue
+			}
+			resp := new(mdns.Msg)
+			resp.SetReply(query)
+			resp.Answer = append(resp.Answer, &mdns.A{
+				Hdr: mdns.RR_Header{Name: query.Question[0].Name, Rrtype: mdns.TypeA, Class: mdns.ClassINET, Ttl: 60},
+				A:   net.IPv4(10, 0, 0, 2),
+			})
+			out, _ := resp.Pack()
+			dns.WriteTo(out, addr)
+		}
+	}()
+	echo := listenUDP(t, b, 7)
+	defer echo.Close()
+	go echoUDP(echo)
+
+	pc, err := a.ListenPacket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	pc.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := pc.WriteTo([]byte("ping"), addr("echo.example:7")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 64)
+	n, _, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "ping" {
+		t.Fatalf("answer %q", buf[:n])
+	}
+
+	if _, err := b.Dial("tcp", "echo.example:80"); err == nil {
+		t.Fatal("domain resolved without dns")
+	}
+}
+
+// addr is a host:port that is not resolved.
+type addr string
+
+func (a addr) Network() string { return "udp" }
+func (a addr) String() string  { return string(a) }
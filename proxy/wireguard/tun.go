@@ -0,0 +1,98 @@
+package wireguard
+
+import (
+	"os"
+	"sync"
+	"syscall"
+
+	"golang.zx2c4.com/wireguard/tun"
+	"gvisor.dev/gvisor/pkg/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+// netTun is the tun.Device of the WireGuard peer. There is no interface,
+// the packets are exchanged with the link endpoint of the netstack.
+type netTun struct {
+	ep     *channel.Endpoint
+	mtu    int
+	out    chan *buffer.View
+	events chan tun.Event
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newNetTun(mtu int) *netTun {
+	t := &netTun{
+		ep:     channel.New(1024, uint32(mtu), ""),
+		mtu:    mtu,
+		out:    make(chan *buffer.View),
+		events: make(chan tun.Event, 1),
+		closed: make(chan struct{}),
+	}
+	t.ep.AddNotify(t)
+	t.events <- tun.EventUp
+	return t
+}
+
+// WriteNotify is called by the netstack when it queued a packet for the
+// tunnel.
+func (t *netTun) WriteNotify() {
+	pkt := t.ep.Read()
+	if pkt.IsNil() {
+		return
+	}
+	view := pkt.ToView()
+	pkt.DecRef()
+
+	select {
+	case t.out <- view:
+	case <-t.closed:
+		view.Release()
+	}
+}
+
+func (t *netTun) File() *os.File { return nil }
+
+func (t *netTun) Read(b []byte, offset int) (int, error) {
+	select {
+	case view := <-t.out:
+		defer view.Release()
+		return view.Read(b[offset:])
+	case <-t.closed:
+		return 0, os.ErrClosed
+	}
+}
+
+func (t *netTun) Write(b []byte, offset int) (int, error) {
+	p := b[offset:]
+	if len(p) == 0 {
+		return 0, nil
+	}
+	pkb := stack.NewPacketBuffer(stack.PacketBufferOptions{Payload: buffer.MakeWithData(p)})
+	defer pkb.DecRef()
+	switch p[0] >> 4 {
+	case 4:
+		t.ep.InjectInbound(header.IPv4ProtocolNumber, pkb)
+	case 6:
+		t.ep.InjectInbound(header.IPv6ProtocolNumber, pkb)
+	default:
+		return 0, syscall.EAFNOSUPPORT
+	}
+	return len(p), nil
+}
+
+func (t *netTun) Flush() error           { return nil }
+func (t *netTun) MTU() (int, error)      { return t.mtu, nil }
+func (t *netTun) Name() (string, error)  { return "pproxy-wg", nil }
+func (t *netTun) Events() chan tun.Event { return t.events }
+
+func (t *netTun) Close() error {
+	t.once.Do(func() {
+		close(t.closed)
+		close(t.events)
+		t.ep.Close()
+	})
+	return nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/eycorsican/go-tun2socks/common/log"
+)
+
+// 检查进程配置文件是否修改的间隔
+const DefaultWatchInterval = 2 * time.Second
+
+// WatchProcess reloads the process config file into app when the file is
+// modified or on SIGHUP. A config that fails to load is logged and the
+// running one is kept.
+func WatchProcess(file string, app *App, interval time.Duration) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		defer signal.Stop(sig)
+
+		last, _ := os.Stat(file)
+		for {
+			select {
+			case <-sig:
+				log.Infof("reloading %v on signal", file)
+				reloadProcess(file, app)
+			case <-t.C:
+				info, err := os.Stat(file)
+				if err != nil || (last != nil && info.ModTime().Equal(last.ModTime()) && info.Size() == last.Size()) {
+					continue
+				}
+				last = info
+				log.Infof("%v is modified, reloading", file)
+				reloadProcess(file, app)
+			case <-app.done:
+				return
+			}
+		}
+	}()
+}
+
+func reloadProcess(file string, app *App) {
+	p, err := LoadProcess(file)
+	if err != nil {
+		log.Errorf("reload process config error: %v", err)
+		return
+	}
+	if err := app.Reload(p); err != nil {
+		log.Errorf("reload process config error: %v", err)
+		return
+	}
+	log.Infof("process config reloaded, %v processes, %v whitelist rules", len(p.Processes), len(p.Whitelist))
+}
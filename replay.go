@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/MissGod1/PProxy/device/pcap"
+)
+
+// ReplayDevice is a pcap file as capture backend. The processes come from
+// the socket events of the replay instead of the system.
+type ReplayDevice struct {
+	*pcap.Device
+}
+
+// OpenReplay opens a pcap file as capture backend. The packets emitted by
+// the stack are recorded to the record file if it is not empty. events is
+// the file of socket events that go with the capture, it may be empty.
+func OpenReplay(replay, record, events string, pace bool) (*ReplayDevice, error) {
+	in, err := os.Open(replay)
+	if err != nil {
+		return nil, fmt.Errorf("open replay file error: %v", err)
+	}
+	var out *os.File
+	if record != "" {
+		out, err = os.Create(record)
+		if err != nil {
+			in.Close()
+			return nil, fmt.Errorf("create record file error: %v", err)
+		}
+	}
+	var dev *pcap.Device
+	if out != nil {
+		dev, err = pcap.NewDevice(in, out)
+	} else {
+		dev, err = pcap.NewDevice(in, nil)
+	}
+	if err != nil {
+		in.Close()
+		if out != nil {
+			out.Close()
+		}
+		return nil, err
+	}
+	dev.Pace = pace
+
+	if events != "" {
+		f, err := os.Open(events)
+		if err != nil {
+			dev.Close()
+			return nil, fmt.Errorf("open socket events file error: %v", err)
+		}
+		defer f.Close()
+		if err := dev.LoadEvents(f); err != nil {
+			dev.Close()
+			return nil, err
+		}
+	}
+	return &ReplayDevice{Device: dev}, nil
+}
+
+// StartTime implements ProcessLookup with the processes of the events.
+func (d *ReplayDevice) StartTime(pid uint32) (int64, error) {
+	p, ok := d.Process(pid)
+	if !ok {
+		return 0, fmt.Errorf("no process %v in the socket events", pid)
+	}
+	return p.Start, nil
+}
+
+// Query implements ProcessLookup with the processes of the events.
+func (d *ReplayDevice) Query(pid uint32) (*Proc, error) {
+	p, ok := d.Process(pid)
+	if !ok {
+		return nil, fmt.Errorf("no process %v in the socket events", pid)
+	}
+	return &Proc{
+		PID:     p.PID,
+		PPID:    p.PPID,
+		Name:    p.Name,
+		Path:    p.Path,
+		Cmdline: p.Cmdline,
+		Start:   p.Start,
+	}, nil
+}
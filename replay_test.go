@@ -0,0 +1,112 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+func tcpPacket(t *testing.T, src string, sport uint16, dst string, dport uint16, syn bool) []byte {
+	ip := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolTCP,
+		SrcIP:    net.ParseIP(src).To4(),
+		DstIP:    net.ParseIP(dst).To4(),
+	}
+	tcp := &layers.TCP{
+		SrcPort: layers.TCPPort(sport),
+		DstPort: layers.TCPPort(dport),
+		SYN:     syn,
+		ACK:     !syn,
+		Window:  65535,
+	}
+	tcp.SetNetworkLayerForChecksum(ip)
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, ip, tcp); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// 回放socket事件后, 数据包按进程匹配会话
+func TestReplaySocketEvents(t *testing.T) {
+	dir, err := ioutil.TempDir("", "replay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	base := time.Date(2020, 8, 1, 10, 0, 0, 0, time.UTC)
+	packets := []struct {
+		at time.Duration
+		b  []byte
+	}{
+		// curl的连接被代理
+		{1000 * time.Millisecond, tcpPacket(t, "10.0.0.2", 50000, "1.2.3.4", 443, true)},
+		{1100 * time.Millisecond, tcpPacket(t, "10.0.0.2", 50000, "1.2.3.4", 443, false)},
+		// 其他进程和没有事件的连接直连
+		{1200 * time.Millisecond, tcpPacket(t, "10.0.0.2", 50001, "1.2.3.4", 443, true)},
+		{1300 * time.Millisecond, tcpPacket(t, "10.0.0.2", 50002, "5.6.7.8", 80, true)},
+	}
+	capture := filepath.Join(dir, "in.pcap")
+	f, err := os.Create(capture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := pcapgo.NewWriter(f)
+	w.WriteFileHeader(65535, layers.LinkTypeRaw)
+	for _, p := range packets {
+		ci := gopacket.CaptureInfo{Timestamp: base.Add(p.at), CaptureLength: len(p.b), Length: len(p.b)}
+		if err := w.WritePacket(ci, p.b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f.Close()
+
+	events := filepath.Join(dir, "events.jsonl")
+	err = ioutil.WriteFile(events, []byte(`
+{"time": "2020-08-01T10:00:00.5Z", "event": "connect", "protocol": "tcp", "local": "10.0.0.2:50000", "remote": "1.2.3.4:443", "pid": 42, "name": "curl", "start": 1}
+{"time": "2020-08-01T10:00:01.15Z", "event": "connect", "protocol": "tcp", "local": "10.0.0.2:50001", "remote": "1.2.3.4:443", "pid": 43, "name": "other", "start": 1}
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dev, err := OpenReplay(capture, "", events, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outbounds, err := NewOutbounds(&Servers{Outbounds: []*Server{
+		{Name: DefaultOutbound, Type: "socks5", Server: "127.0.0.1", ServerPort: 1},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer outbounds.Close()
+	app, err := NewApp(dev, &Process{Processes: []ProcessRule{{Name: "curl"}}}, outbounds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app.Close()
+
+	if _, err := app.WriteTo(ioutil.Discard); err != io.EOF {
+		t.Fatalf("replay ended with %v", err)
+	}
+	passed, diverted, _ := dev.Stats()
+	if diverted != 2 || passed != 2 {
+		t.Errorf("diverted %v, passed %v, want 2 and 2", diverted, passed)
+	}
+	if len(app.Sessions()) != 1 {
+		t.Errorf("%v sessions, want 1", len(app.Sessions()))
+	}
+}
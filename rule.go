@@ -0,0 +1,349 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/pmezard/adblock/adblock"
+
+	"github.com/MissGod1/PProxy/common/packet"
+)
+
+// Modes of the processes list.
+const (
+	// ModeInclude proxies the listed processes.
+	ModeInclude = "include"
+	// ModeExclude proxies every process except the listed ones.
+	ModeExclude = "exclude"
+)
+
+// Action is what happens to a flow.
+type Action uint8
+
+const (
+	// ActionNone means no rule matched, the flow is not captured.
+	ActionNone Action = iota
+	ActionProxy
+	ActionDirect
+	// ActionReject drops the packets of the flow.
+	ActionReject
+)
+
+func (a Action) String() string {
+	switch a {
+	case ActionProxy:
+		return "proxy"
+	case ActionDirect:
+		return "direct"
+	case ActionReject:
+		return "reject"
+	default:
+		return "none"
+	}
+}
+
+func (a Action) MarshalText() ([]byte, error) {
+	return []byte(a.String()), nil
+}
+
+func (a *Action) UnmarshalText(b []byte) error {
+	switch strings.ToLower(string(b)) {
+	case "proxy":
+		*a = ActionProxy
+	case "direct":
+		*a = ActionDirect
+	case "reject":
+		*a = ActionReject
+	default:
+		return fmt.Errorf("unknown action %q", b)
+	}
+	return nil
+}
+
+// Rule maps the flows it matches to an action. Every field that is given
+// must match, a list matches if any of its entries does.
+type Rule struct {
+	Processes []ProcessRule `json:"processes"`
+	// Domains are adblock rules like the whitelist. The domain of a flow is
+	// known from the DNS answers written back by the stack.
+	Domains []string `json:"domains"`
+	// CIDR of the remote address, a single address is allowed too.
+	CIDR []string `json:"cidr"`
+	// CIDRFiles list the CIDRs of the remote address one per line.
+	CIDRFiles []string `json:"cidr_files"`
+	// GeoIP are the ISO codes of the country of the remote address, looked
+	// up in the geoip_db of the process config.
+	GeoIP []string `json:"geoip"`
+	// Ports of the remote address, e.g. "80,443,27000-27100".
+	Ports string `json:"ports"`
+	// Protocol is "tcp" or "udp".
+	Protocol string `json:"protocol"`
+	Action   Action `json:"action"`
+	// Outbound is the name of the server proxy flows use, the first one
+	// if empty.
+	Outbound string `json:"outbound"`
+}
+
+// Flow is what the rules are matched against. Proc and Domain are empty if
+// they are not known, rules about them do not match then.
+type Flow struct {
+	packet.Key
+	Proc   *ProcEntry
+	Domain string
+}
+
+type portRange struct {
+	lo, hi uint16
+}
+
+type rule struct {
+	// anyProcess matches the flows of every known process but self
+	anyProcess bool
+	self       map[uint32]bool
+	processes  *ProcessMatcher
+	domains    *adblock.RuleMatcher
+	nets       *CIDRSet
+	geoip      *GeoIP
+	countries  map[string]bool
+	ports      []portRange
+	protocol   uint8
+	action     Action
+	outbound   string
+}
+
+// RuleSet is the ordered list of rules, the first matching rule decides.
+type RuleSet struct {
+	rules []rule
+}
+
+// NewRuleSet compiles the rules of the process config. The processes and
+// whitelist lists are proxy rules after the configured rules, so rules can
+// make exceptions for them. In exclude mode the processes are direct and
+// every other process is proxied instead, except the pids in self, which
+// are this program and its plugins.
+func NewRuleSet(p *Process, self ...uint32) (*RuleSet, error) {
+	exclude := false
+	switch strings.ToLower(p.Mode) {
+	case "", ModeInclude:
+	case ModeExclude:
+		exclude = true
+	default:
+		return nil, fmt.Errorf("unknown mode %v", p.Mode)
+	}
+
+	rules := append([]Rule(nil), p.Rules...)
+	if len(p.Processes) > 0 {
+		action := ActionProxy
+		if exclude {
+			action = ActionDirect
+		}
+		rules = append(rules, Rule{Processes: p.Processes, Action: action})
+	}
+	if len(p.Whitelist) > 0 {
+		rules = append(rules, Rule{Domains: p.Whitelist, Action: ActionProxy})
+	}
+
+	var geoip *GeoIP
+	if p.GeoIPDB != "" {
+		g, err := OpenGeoIP(p.GeoIPDB)
+		if err != nil {
+			return nil, fmt.Errorf("open geoip database error: %v", err)
+		}
+		geoip = g
+	}
+
+	rs := &RuleSet{}
+	for i := range rules {
+		r, err := compileRule(&rules[i], p.IgnoreCase, geoip)
+		if err != nil {
+			return nil, fmt.Errorf("rule %v error: %v", i+1, err)
+		}
+		rs.rules = append(rs.rules, r)
+	}
+	if exclude {
+		// 不知道进程的流量(系统进程和没有socket事件的数据包)不代理
+		// 自己和插件连接代理服务器的流量不能再转给自己
+		r := rule{anyProcess: true, self: make(map[uint32]bool), action: ActionProxy}
+		for _, pid := range self {
+			r.self[pid] = true
+		}
+		rs.rules = append(rs.rules, r)
+	}
+	return rs, nil
+}
+
+func compileRule(r *Rule, ignoreCase bool, geoip *GeoIP) (rule, error) {
+	c := rule{action: r.Action, outbound: r.Outbound}
+	if r.Action == ActionNone {
+		return c, fmt.Errorf("no action")
+	}
+	if len(r.Processes) > 0 {
+		m, err := NewProcessMatcher(r.Processes, ignoreCase)
+		if err != nil {
+			return c, err
+		}
+		c.processes = m
+	}
+	if len(r.Domains) > 0 {
+		c.domains = adblock.NewMatcher()
+		for _, d := range r.Domains {
+			rule, err := adblock.ParseRule(d)
+			if err != nil || rule == nil {
+				continue
+			}
+			c.domains.AddRule(rule, 0)
+		}
+	}
+	if len(r.CIDR) > 0 || len(r.CIDRFiles) > 0 {
+		c.nets = &CIDRSet{}
+		for _, s := range r.CIDR {
+			if err := c.nets.Add(s); err != nil {
+				return c, err
+			}
+		}
+		for _, file := range r.CIDRFiles {
+			if err := c.nets.AddFile(file); err != nil {
+				return c, err
+			}
+		}
+		c.nets.Compact()
+	}
+	if len(r.GeoIP) > 0 {
+		if geoip == nil {
+			return c, fmt.Errorf("geoip needs geoip_db")
+		}
+		c.geoip = geoip
+		c.countries = make(map[string]bool)
+		for _, country := range r.GeoIP {
+			c.countries[strings.ToUpper(country)] = true
+		}
+	}
+	if r.Ports != "" {
+		ports, err := parsePorts(r.Ports)
+		if err != nil {
+			return c, err
+		}
+		c.ports = ports
+	}
+	switch strings.ToLower(r.Protocol) {
+	case "":
+	case "tcp":
+		c.protocol = packet.ProtocolTCP
+	case "udp":
+		c.protocol = packet.ProtocolUDP
+	default:
+		return c, fmt.Errorf("unknown protocol %v", r.Protocol)
+	}
+	return c, nil
+}
+
+func parsePorts(s string) ([]portRange, error) {
+	var ports []portRange
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		lo, hi := f, f
+		if i := strings.IndexByte(f, '-'); i >= 0 {
+			lo, hi = f[:i], f[i+1:]
+		}
+		l, err := strconv.ParseUint(strings.TrimSpace(lo), 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port %v", f)
+		}
+		h, err := strconv.ParseUint(strings.TrimSpace(hi), 10, 16)
+		if err != nil || h < l {
+			return nil, fmt.Errorf("invalid port %v", f)
+		}
+		ports = append(ports, portRange{lo: uint16(l), hi: uint16(h)})
+	}
+	return ports, nil
+}
+
+// Match returns the action and outbound of the first rule matching the
+// flow, or ActionNone.
+func (rs *RuleSet) Match(f *Flow) (Action, string) {
+	for i := range rs.rules {
+		if rs.rules[i].match(f) {
+			return rs.rules[i].action, rs.rules[i].outbound
+		}
+	}
+	return ActionNone, ""
+}
+
+// Outbounds returns the outbounds named by the rules.
+func (rs *RuleSet) Outbounds() []string {
+	var names []string
+	for i := range rs.rules {
+		if rs.rules[i].outbound != "" {
+			names = append(names, rs.rules[i].outbound)
+		}
+	}
+	return names
+}
+
+// Direct reports whether a rule sends flows to the domain direct. Such
+// domains must not get fake addresses, they can not be reached directly.
+func (rs *RuleSet) Direct(domain string) bool {
+	for i := range rs.rules {
+		r := &rs.rules[i]
+		if r.action == ActionDirect && r.domains != nil && matchDomain(r.domains, domain) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *rule) match(f *Flow) bool {
+	if r.anyProcess && (f.Proc == nil || r.self[f.Proc.PID]) {
+		return false
+	}
+	if r.protocol != 0 && r.protocol != f.Protocol {
+		return false
+	}
+	if r.ports != nil {
+		ok := false
+		for _, p := range r.ports {
+			if f.DstPort >= p.lo && f.DstPort <= p.hi {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+	if r.nets != nil && !r.nets.Contains(&f.DstIP) {
+		return false
+	}
+	if r.processes != nil {
+		ok := false
+		// 没有开启children时没有Parent
+		for e := f.Proc; e != nil; e = e.Parent {
+			if r.processes.Match(&e.Proc) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+	if r.domains != nil {
+		if f.Domain == "" || !matchDomain(r.domains, f.Domain) {
+			return false
+		}
+	}
+	if r.geoip != nil && !r.countries[r.geoip.Country(net.IP(f.DstIP[:]))] {
+		return false
+	}
+	return true
+}
+
+func matchDomain(m *adblock.RuleMatcher, domain string) bool {
+	rq := &adblock.Request{
+		URL: fmt.Sprintf("https://%v/", domain),
+	}
+	found, _, err := m.Match(rq)
+	return err == nil && found
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/MissGod1/PProxy/common/packet"
+)
+
+// exclude模式下自己和插件的流量不代理
+func TestExcludeSelf(t *testing.T) {
+	rules, err := NewRuleSet(&Process{Mode: ModeExclude, Processes: []ProcessRule{{Name: "voice"}}}, 1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		proc   *ProcEntry
+		action Action
+	}{
+		{nil, ActionNone},
+		{&ProcEntry{Proc: Proc{PID: 1, Name: "PProxy"}}, ActionNone},
+		{&ProcEntry{Proc: Proc{PID: 2, Name: "v2ray-plugin"}}, ActionNone},
+		{&ProcEntry{Proc: Proc{PID: 3, Name: "voice"}}, ActionDirect},
+		{&ProcEntry{Proc: Proc{PID: 4, Name: "game"}}, ActionProxy},
+	}
+	for _, c := range cases {
+		f := Flow{Key: testKey(6, 50000), Proc: c.proc}
+		if action, _ := rules.Match(&f); action != c.action {
+			t.Errorf("%+v: %v, want %v", c.proc, action, c.action)
+		}
+	}
+}
+
+func TestParsePorts(t *testing.T) {
+	cases := []struct {
+		s    string
+		want []portRange
+	}{
+		{"80", []portRange{{80, 80}}},
+		{"80,443", []portRange{{80, 80}, {443, 443}}},
+		{" 80 , 27000-27100 ", []portRange{{80, 80}, {27000, 27100}}},
+		{"27000 - 27100", []portRange{{27000, 27100}}},
+		{"0-65535", []portRange{{0, 65535}}},
+		{"53-53", []portRange{{53, 53}}},
+		{"65536", nil},
+		{"100-80", nil},
+		{"80-", nil},
+		{"-80", nil},
+		{"http", nil},
+		{"80,,443", nil},
+		{"1-2-3", nil},
+	}
+	for _, c := range cases {
+		got, err := parsePorts(c.s)
+		if c.want == nil {
+			if err == nil {
+				t.Errorf("%q accepted: %v", c.s, got)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, c.want) {
+			t.Errorf("parsePorts(%q) = %v %v, want %v", c.s, got, err, c.want)
+		}
+	}
+}
+
+func testFlow(protocol uint8, dst string, port uint16, proc string, domain string) *Flow {
+	f := &Flow{
+		Key:    packet.NewKey(protocol, net.ParseIP("10.0.0.2"), 50000, net.ParseIP(dst), port),
+		Domain: domain,
+	}
+	if proc != "" {
+		f.Proc = &ProcEntry{Proc: Proc{PID: 42, Name: proc}}
+	}
+	return f
+}
+
+// 按顺序匹配, 第一个匹配的规则决定动作; processes和whitelist排在规则之后
+func TestRuleOrder(t *testing.T) {
+	var p Process
+	err := json.Unmarshal([]byte(`{
+		"rules": [
+			{"processes": ["game"], "ports": "25", "action": "reject"},
+			{"processes": ["game"], "cidr": ["10.0.0.0/8"], "action": "direct"},
+			{"processes": ["game"], "protocol": "udp", "ports": "27000-27100", "action": "proxy", "outbound": "fast"},
+			{"cidr": ["10.1.0.0/16"], "action": "proxy"},
+			{"domains": ["||cn.example.com^"], "action": "direct"}
+		],
+		"processes": ["game", "browser"],
+		"whitelist": ["||example.com^"]
+	}`), &p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules, err := NewRuleSet(&p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := rules.Outbounds(); !reflect.DeepEqual(got, []string{"fast"}) {
+		t.Fatalf("outbounds %v", got)
+	}
+
+	cases := []struct {
+		name     string
+		flow     *Flow
+		action   Action
+		outbound string
+	}{
+		{"reject before direct", testFlow(packet.ProtocolTCP, "10.1.2.3", 25, "game", ""), ActionReject, ""},
+		{"direct before proxy", testFlow(packet.ProtocolTCP, "10.1.2.3", 443, "game", ""), ActionDirect, ""},
+		{"direct before outbound", testFlow(packet.ProtocolUDP, "10.1.2.3", 27015, "game", ""), ActionDirect, ""},
+		{"outbound", testFlow(packet.ProtocolUDP, "1.2.3.4", 27015, "game", ""), ActionProxy, "fast"},
+		{"protocol", testFlow(packet.ProtocolTCP, "1.2.3.4", 27015, "game", ""), ActionProxy, ""},
+		{"port range end", testFlow(packet.ProtocolUDP, "1.2.3.4", 27100, "game", ""), ActionProxy, "fast"},
+		{"port range out", testFlow(packet.ProtocolUDP, "1.2.3.4", 27101, "game", ""), ActionProxy, ""},
+		{"cidr without process", testFlow(packet.ProtocolTCP, "10.1.2.3", 25, "", ""), ActionProxy, ""},
+		{"rule before whitelist", testFlow(packet.ProtocolTCP, "1.2.3.4", 443, "", "cn.example.com"), ActionDirect, ""},
+		{"domain rule before processes", testFlow(packet.ProtocolTCP, "1.2.3.4", 443, "browser", "cn.example.com"), ActionDirect, ""},
+		{"processes", testFlow(packet.ProtocolTCP, "1.2.3.4", 443, "browser", ""), ActionProxy, ""},
+		{"whitelist", testFlow(packet.ProtocolTCP, "1.2.3.4", 443, "", "www.example.com"), ActionProxy, ""},
+		{"no rule", testFlow(packet.ProtocolTCP, "1.2.3.4", 443, "other", "other.com"), ActionNone, ""},
+	}
+	for _, c := range cases {
+		action, outbound := rules.Match(c.flow)
+		if action != c.action || outbound != c.outbound {
+			t.Errorf("%v: %v %q, want %v %q", c.name, action, outbound, c.action, c.outbound)
+		}
+	}
+
+	if !rules.Direct("cn.example.com") || rules.Direct("www.example.com") {
+		t.Error("direct domains are wrong")
+	}
+}
+
+// 开启children时子进程通过Parent匹配
+func TestRuleChildren(t *testing.T) {
+	rules, err := NewRuleSet(&Process{Processes: []ProcessRule{{Name: "launcher"}}, Children: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := testFlow(packet.ProtocolTCP, "1.2.3.4", 443, "game", "")
+	if action, _ := rules.Match(f); action != ActionNone {
+		t.Fatalf("unrelated process: %v", action)
+	}
+	f.Proc.Parent = &ProcEntry{Proc: Proc{PID: 1, Name: "launcher"}}
+	if action, _ := rules.Match(f); action != ActionProxy {
+		t.Fatalf("child process: %v", action)
+	}
+}
+
+func TestRuleErrors(t *testing.T) {
+	cases := []struct {
+		name string
+		rule Rule
+	}{
+		{"no action", Rule{CIDR: []string{"1.2.3.4"}}},
+		{"cidr", Rule{CIDR: []string{"1.2.3.4/40"}, Action: ActionProxy}},
+		{"ports", Rule{Ports: "80-", Action: ActionProxy}},
+		{"protocol", Rule{Protocol: "icmp", Action: ActionProxy}},
+		{"geoip", Rule{GeoIP: []string{"CN"}, Action: ActionDirect}},
+	}
+	for _, c := range cases {
+		if _, err := NewRuleSet(&Process{Rules: []Rule{c.rule}}); err == nil {
+			t.Errorf("%v: accepted", c.name)
+		}
+	}
+	if _, err := NewRuleSet(&Process{Mode: "all"}); err == nil {
+		t.Error("unknown mode accepted")
+	}
+	var a Action
+	if err := json.Unmarshal([]byte(`"block"`), &a); err == nil {
+		t.Error("unknown action accepted")
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/MissGod1/PProxy/common/packet"
+)
+
+const (
+	DefaultUDPTimeout = 60 * time.Second
+	DefaultTCPTimeout = 2 * time.Hour
+	// 双向FIN之后还要转发最后的ACK, 等一段时间再删除
+	DefaultFINTimeout = 10 * time.Second
+)
+
+// FIN seen on a session
+const (
+	finLocal  = 1 << iota // 本机发出的FIN
+	finRemote             // 协议栈代远端发出的FIN
+	finBoth   = finLocal | finRemote
+)
+
+// Session is a connection that matched a rule.
+type Session struct {
+	lastSeen int64 // unix nano
+	closing  int64 // unix nano of the FIN of the last side, 0 if open
+	fin      uint32
+
+	Key      packet.Key `json:"key"`
+	Protocol uint8      `json:"protocol"`
+	PID      uint32     `json:"pid"`
+	Action   Action     `json:"action"`
+	Outbound string     `json:"outbound,omitempty"`
+	Created  time.Time  `json:"created"`
+	LastSeen time.Time  `json:"last_seen"`
+	Closing  bool       `json:"closing"`
+}
+
+// SessionTable holds the sessions of the matched processes and drops them
+// once they are closed or idle for too long.
+type SessionTable struct {
+	sync.RWMutex
+	sessions map[packet.Key]*Session
+	// UDP本地端口对应的进程, 会话过期后按端口重新找回进程
+	owners map[uint16]uint32
+
+	udpTimeout time.Duration
+	tcpTimeout time.Duration
+	finTimeout time.Duration
+}
+
+func NewSessionTable(udpTimeout, tcpTimeout time.Duration) *SessionTable {
+	if udpTimeout <= 0 {
+		udpTimeout = DefaultUDPTimeout
+	}
+	if tcpTimeout <= 0 {
+		tcpTimeout = DefaultTCPTimeout
+	}
+	return &SessionTable{
+		sessions:   make(map[packet.Key]*Session),
+		owners:     make(map[uint16]uint32),
+		udpTimeout: udpTimeout,
+		tcpTimeout: tcpTimeout,
+		finTimeout: DefaultFINTimeout,
+	}
+}
+
+// Add stores a new session. A session left over under the same key, e.g.
+// from a reused local port, is replaced.
+func (t *SessionTable) Add(key packet.Key, protocol uint8, pid uint32, action Action, outbound string) {
+	now := time.Now()
+	t.Lock()
+	t.sessions[key] = &Session{
+		Key:      key,
+		Protocol: protocol,
+		PID:      pid,
+		Action:   action,
+		Outbound: outbound,
+		Created:  now,
+		lastSeen: now.UnixNano(),
+	}
+	t.Unlock()
+}
+
+// Lookup returns the action of the session and marks it as active.
+func (t *SessionTable) Lookup(key packet.Key) (Action, bool) {
+	t.RLock()
+	s, ok := t.sessions[key]
+	t.RUnlock()
+	if !ok {
+		return ActionNone, false
+	}
+	atomic.StoreInt64(&s.lastSeen, time.Now().UnixNano())
+	return s.Action, true
+}
+
+// Outbound returns the outbound of the session, "" if there is no session
+// or it uses the first outbound.
+func (t *SessionTable) Outbound(key packet.Key) string {
+	t.RLock()
+	s, ok := t.sessions[key]
+	t.RUnlock()
+	if !ok {
+		return ""
+	}
+	return s.Outbound
+}
+
+// FIN records a FIN of the session, sent by the local host or by the stack
+// for the remote side. A proxied session is closing once both sides sent
+// one, the others on the first FIN.
+func (t *SessionTable) FIN(key packet.Key, remote bool) {
+	t.RLock()
+	s, ok := t.sessions[key]
+	t.RUnlock()
+	if !ok {
+		return
+	}
+	bit := uint32(finLocal)
+	if remote {
+		bit = finRemote
+	}
+	// 只有代理的连接才能看到协议栈发出的FIN, 其他连接中途过期也照样直连
+	if s.Action != ActionProxy {
+		bit = finBoth
+	}
+	for {
+		old := atomic.LoadUint32(&s.fin)
+		if atomic.CompareAndSwapUint32(&s.fin, old, old|bit) {
+			if old|bit == finBoth {
+				atomic.CompareAndSwapInt64(&s.closing, 0, time.Now().UnixNano())
+			}
+			return
+		}
+	}
+}
+
+// Remove drops the session at once.
+func (t *SessionTable) Remove(key packet.Key) {
+	t.Lock()
+	delete(t.sessions, key)
+	t.Unlock()
+}
+
+// Bind remembers the process of a UDP socket bound to the local port.
+func (t *SessionTable) Bind(port uint16, pid uint32) {
+	t.Lock()
+	t.owners[port] = pid
+	t.Unlock()
+}
+
+// Unbind forgets the process of the closed UDP socket.
+func (t *SessionTable) Unbind(port uint16) {
+	t.Lock()
+	delete(t.owners, port)
+	t.Unlock()
+}
+
+// Owner returns the process of the UDP socket bound to the local port.
+func (t *SessionTable) Owner(port uint16) (uint32, bool) {
+	t.RLock()
+	pid, ok := t.owners[port]
+	t.RUnlock()
+	return pid, ok
+}
+
+// Expire drops the sessions that are idle or closed for longer than their
+// timeout and returns how many were dropped.
+func (t *SessionTable) Expire(now time.Time) int {
+	n := now.UnixNano()
+	expired := 0
+
+	t.Lock()
+	defer t.Unlock()
+	for k, s := range t.sessions {
+		timeout := t.udpTimeout
+		if s.Protocol == packet.ProtocolTCP {
+			timeout = t.tcpTimeout
+		}
+		if closing := atomic.LoadInt64(&s.closing); closing != 0 && n-closing > int64(t.finTimeout) {
+			delete(t.sessions, k)
+			expired++
+		} else if n-atomic.LoadInt64(&s.lastSeen) > int64(timeout) {
+			delete(t.sessions, k)
+			expired++
+		}
+	}
+	return expired
+}
+
+// Len returns the number of sessions.
+func (t *SessionTable) Len() int {
+	t.RLock()
+	defer t.RUnlock()
+	return len(t.sessions)
+}
+
+// Snapshot returns a copy of the sessions ordered by creation time.
+func (t *SessionTable) Snapshot() []Session {
+	t.RLock()
+	ss := make([]Session, 0, len(t.sessions))
+	for _, s := range t.sessions {
+		c := Session{
+			Key:      s.Key,
+			Protocol: s.Protocol,
+			PID:      s.PID,
+			Action:   s.Action,
+			Outbound: s.Outbound,
+			Created:  s.Created,
+			LastSeen: time.Unix(0, atomic.LoadInt64(&s.lastSeen)),
+			Closing:  atomic.LoadInt64(&s.closing) != 0,
+		}
+		ss = append(ss, c)
+	}
+	t.RUnlock()
+
+	sort.Slice(ss, func(i, j int) bool {
+		return ss[i].Created.Before(ss[j].Created)
+	})
+	return ss
+}
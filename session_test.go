@@ -0,0 +1,135 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/MissGod1/PProxy/common/packet"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func testKey(protocol uint8, sport uint16) packet.Key {
+	return packet.NewKey(protocol, net.ParseIP("10.0.0.2"), sport, net.ParseIP("1.2.3.4"), 443)
+}
+
+// 代理的连接只有一端FIN时不会过期
+func TestSessionHalfClose(t *testing.T) {
+	st := NewSessionTable(0, 0)
+	key := testKey(packet.ProtocolTCP, 50000)
+	st.Add(key, packet.ProtocolTCP, 42, ActionProxy, "")
+
+	st.FIN(key, false)
+	if n := st.Expire(time.Now().Add(time.Minute)); n != 0 {
+		t.Fatalf("half closed session expired")
+	}
+	st.FIN(key, false)
+	if n := st.Expire(time.Now().Add(time.Minute)); n != 0 {
+		t.Fatalf("session expired after two local FINs")
+	}
+
+	st.FIN(key, true)
+	if n := st.Expire(time.Now()); n != 0 {
+		t.Fatalf("closed session expired before the FIN timeout")
+	}
+	if n := st.Expire(time.Now().Add(DefaultFINTimeout + time.Second)); n != 1 {
+		t.Fatalf("closed session is not expired")
+	}
+}
+
+// 直连的连接看不到远端的FIN, 本机FIN之后就过期
+func TestSessionDirectClose(t *testing.T) {
+	st := NewSessionTable(0, 0)
+	key := testKey(packet.ProtocolTCP, 50000)
+	st.Add(key, packet.ProtocolTCP, 42, ActionDirect, "")
+
+	st.FIN(key, false)
+	if n := st.Expire(time.Now().Add(DefaultFINTimeout + time.Second)); n != 1 {
+		t.Fatalf("closed direct session is not expired")
+	}
+}
+
+func udpPacket(t testing.TB, src string, sport uint16, dst string, dport uint16) []byte {
+	ip := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolUDP,
+		SrcIP:    net.ParseIP(src).To4(),
+		DstIP:    net.ParseIP(dst).To4(),
+	}
+	udp := &layers.UDP{
+		SrcPort: layers.UDPPort(sport),
+		DstPort: layers.UDPPort(dport),
+	}
+	udp.SetNetworkLayerForChecksum(ip)
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, ip, udp, gopacket.Payload("ping")); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func testApp(t testing.TB, lookup ProcessLookup, p *Process) *App {
+	rules, err := NewRuleSet(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := &App{
+		pids:      NewPidCache(lookup, p.Children),
+		sessions:  NewSessionTable(0, 0),
+		domainIPs: NewDomainIPTable(),
+	}
+	app.rules.Store(rules)
+	return app
+}
+
+// 协议栈代远端发出RST时立即删除会话, 发出FIN时等本机也FIN
+func TestCheckReply(t *testing.T) {
+	app := testApp(t, newFakeLookup(), &Process{})
+	key := testKey(packet.ProtocolTCP, 50000)
+
+	app.sessions.Add(key, packet.ProtocolTCP, 42, ActionProxy, "")
+	reply := packet.Packet{Key: key.Reverse(), TCPFlags: packet.FlagFIN | packet.FlagACK}
+	app.checkReply(&reply)
+	if n := app.sessions.Expire(time.Now().Add(time.Minute)); n != 0 {
+		t.Fatalf("session expired after the remote FIN only")
+	}
+	app.sessions.FIN(key, false)
+	if n := app.sessions.Expire(time.Now().Add(time.Minute)); n != 1 {
+		t.Fatalf("session is not expired after both FINs")
+	}
+
+	app.sessions.Add(key, packet.ProtocolTCP, 42, ActionProxy, "")
+	reply.TCPFlags = packet.FlagRST
+	app.checkReply(&reply)
+	if app.sessions.Len() != 0 {
+		t.Fatalf("session is kept after RST")
+	}
+}
+
+// UDP会话空闲过期后, 同一个socket的数据包按本地端口找回进程
+func TestUDPSessionRelearn(t *testing.T) {
+	lookup := newFakeLookup(Proc{PID: 42, Name: "curl", Start: 1})
+	app := testApp(t, lookup, &Process{Processes: []ProcessRule{{Name: "curl"}}})
+	b := udpPacket(t, "10.0.0.2", 50000, "1.2.3.4", 443)
+
+	app.sessions.Bind(50000, 42)
+	if action := app.CheckSession(b); action != ActionProxy {
+		t.Fatalf("action %v, want proxy", action)
+	}
+	app.sessions.Expire(time.Now().Add(DefaultUDPTimeout + time.Second))
+	if action := app.CheckSession(b); action != ActionProxy {
+		t.Fatalf("action %v after expiry, want proxy", action)
+	}
+	if ss := app.Sessions(); len(ss) != 1 || ss[0].PID != 42 {
+		t.Fatalf("sessions %+v, want one of pid 42", ss)
+	}
+
+	app.sessions.Unbind(50000)
+	app.sessions.Expire(time.Now().Add(DefaultUDPTimeout + time.Second))
+	if action := app.CheckSession(b); action != ActionNone {
+		t.Fatalf("action %v after the socket closed, want none", action)
+	}
+}